@@ -2,19 +2,41 @@ package main
 
 import (
 	"flag"
+	"os"
+	"time"
 
 	"github.com/vleurgat/regstat/internal/app/regstat"
 )
 
 func main() {
-	var port string
-	var pgConnStr string
-	var dockerConfigFile string
-	var equivRegistriesFile string
-	flag.StringVar(&port, "port", "3333", "the port number to listen on")
-	flag.StringVar(&pgConnStr, "pg-conn-str", "\"host=localhost port=5432 user=postgres sslmode=disable\"", "the Postgres connect string, e.g. \"host=host port=1234 user=user password=pw ...\"")
-	flag.StringVar(&dockerConfigFile, "docker-config", "", "the path to the Docker registry config.json file, used to obtain login credentials")
-	flag.StringVar(&equivRegistriesFile, "equiv-registries", "", "the path to the equiv-registries.json file, used to combine equivalent registries")
+	var config regstat.Config
+	flag.StringVar(&config.Port, "port", "3333", "the port number to listen on")
+	flag.StringVar(&config.PgConnStr, "pg-conn-str", "\"host=localhost port=5432 user=postgres sslmode=disable\"", "the Postgres connect string, e.g. \"host=host port=1234 user=user password=pw ...\"")
+	flag.StringVar(&config.DockerConfigFile, "docker-config", "", "the path to the Docker registry config.json file, used to obtain login credentials")
+	flag.StringVar(&config.EquivRegistriesFile, "equiv-registries", "", "the path to the equiv-registries.json file, used to combine equivalent registries")
+	flag.StringVar(&config.MediaTypesFile, "media-types", "", "the path to a media-types.json file, used to classify additional blob media types as config, layer or foreign")
+	flag.StringVar(&config.IgnorePullUserAgents, "ignore-pull-user-agents", `^regstat\b`, "a regular expression matching the user agents whose pulls are only recorded in the events audit log, e.g. those of tools that discover what the registry holds; empty means none")
+	flag.StringVar(&config.IgnorePullActors, "ignore-pull-actors", "", "a regular expression matching the actors, i.e. user names, whose pulls are only recorded in the events audit log; empty means none")
+	flag.BoolVar(&config.DigestPullTags, "digest-pull-tags", false, "count a pull of a manifest by digest as a pull of each tag, in the same repository, that refers to the manifest")
+	flag.StringVar(&config.Auth.AdminToken, "admin-token", "", "a bearer token that report requests must provide in their Authorization header; the reports are disabled if it isn't set")
+	flag.StringVar(&config.Auth.Token, "auth-token", "", "a bearer token that notification requests must provide in their Authorization header")
+	flag.StringVar(&config.Auth.BasicUser, "auth-basic-user", "", "the user name that notification requests must provide via basic auth")
+	flag.StringVar(&config.Auth.BasicPassword, "auth-basic-password", "", "the password that notification requests must provide via basic auth")
+	flag.StringVar(&config.Auth.HMACSecret, "auth-hmac-secret", "", "a secret used to verify the HMAC-SHA256 signature of notification request bodies")
+	flag.StringVar(&config.Auth.HMACHeader, "auth-hmac-header", "X-Regstat-Signature", "the header containing the HMAC-SHA256 signature of the request body")
+	flag.StringVar(&config.Auth.AllowedCIDRs, "auth-allow-cidrs", "", "a comma separated list of networks, e.g. \"10.0.0.0/8,192.168.1.0/24\", from which notification requests are accepted")
+	flag.StringVar(&config.TLS.CertFile, "tls-cert", "", "the path to a PEM encoded certificate; if provided RegStat listens using HTTPS")
+	flag.StringVar(&config.TLS.KeyFile, "tls-key", "", "the path to the PEM encoded private key of the -tls-cert certificate")
+	flag.StringVar(&config.TLS.ClientCAFile, "tls-client-ca", "", "the path to a PEM encoded CA bundle; if provided notification and admin requests must present a certificate signed by one of those CAs")
+	flag.BoolVar(&config.Sync, "sync", false, "process each notification before responding, so that the registry retries those that fail")
+	flag.StringVar(&config.JournalFile, "journal", "", "the path to a journal file in which notifications are stored until they have been processed")
+	flag.IntVar(&config.Workers, "workers", 10, "the number of events that are processed concurrently; events for the same repository are processed in order")
+	flag.IntVar(&config.QueueSize, "queue-size", 1000, "the number of events that can wait to be processed before further notifications are rejected")
+	flag.DurationVar(&config.EventIDTTL, "event-id-ttl", 24*time.Hour, "how long the IDs of processed events are kept, in order to skip events that the registry delivers more than once")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "how long to wait, on receipt of a SIGTERM or SIGINT, for accepted notifications to be processed")
+	flag.DurationVar(&config.EnrichmentRetryInterval, "enrichment-retry-interval", time.Minute, "how long to wait before fetching again a pushed manifest that couldn't be fetched; the wait doubles after each failure, up to a day")
+	flag.Int64Var(&config.MaxBodySize, "max-body-size", 1<<20, "the maximum size, in bytes, of a notification request body; 0 means no limit")
+	flag.BoolVar(&config.CheckContentType, "check-content-type", true, "reject notification requests whose content type isn't \"application/vnd.docker.distribution.events.v1+json\"")
 	flag.Parse()
-	regstat.Regstat(port, pgConnStr, dockerConfigFile, equivRegistriesFile)
+	os.Exit(regstat.Regstat(config))
 }
@@ -0,0 +1,154 @@
+// Package artifact extracts typed metadata from the OCI artifacts, such as
+// Helm charts and signatures, that are pushed to a registry.
+//
+// Extractors are Handlers, registered with a Registry under the artifact type
+// or media type that identifies the artifacts they understand. The handlers in
+// this package are registered with the default registry, and other packages
+// may register further handlers from their init functions.
+package artifact
+
+import (
+	"github.com/vleurgat/regstat/internal/app/database"
+	"github.com/vleurgat/regstat/internal/app/registry"
+)
+
+// MediaTypeOCIEmpty is the media type of the empty config that an artifact
+// gives when it has no config of its own.
+const MediaTypeOCIEmpty = "application/vnd.oci.empty.v1+json"
+
+// imageConfigMediaTypes are the config media types that identify images
+// rather than other kinds of artifact.
+var imageConfigMediaTypes = map[string]bool{
+	registry.MediaTypeDockerImageConfig: true,
+	registry.MediaTypeOCIImageConfig:    true,
+}
+
+// Descriptor refers to a blob or manifest from within a manifest.
+type Descriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// SignatureTypes are the artifact types of the referrers that sign the
+// manifest that is their subject.
+var SignatureTypes = []string{
+	MediaTypeCosignArtifactSignature,
+	MediaTypeNotarySignature,
+}
+
+// Manifest is an OCI image or artifact manifest. An artifact manifest lists
+// its blobs rather than a config and layers. The manifest of a referrer, e.g.
+// a signature, refers to its subject.
+type Manifest struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Config       *Descriptor       `json:"config,omitempty"`
+	Layers       []Descriptor      `json:"layers,omitempty"`
+	Blobs        []Descriptor      `json:"blobs,omitempty"`
+	Subject      *Descriptor       `json:"subject,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// Type returns the type of artifact that the manifest describes: its
+// artifactType if it has one, or else the media type of its config. Images,
+// and artifacts that identify themselves only by their layers, have no type.
+func (m *Manifest) Type() string {
+	if m.ArtifactType != "" {
+		return m.ArtifactType
+	}
+	if m.Config != nil && m.Config.MediaType != MediaTypeOCIEmpty && !imageConfigMediaTypes[m.Config.MediaType] {
+		return m.Config.MediaType
+	}
+	return ""
+}
+
+// Artifact is a manifest that has been pushed to the registry, along with the
+// means to fetch its blobs.
+type Artifact struct {
+	Digest     string
+	Repository string
+	Manifest   *Manifest
+	getBlob    func(digest string) ([]byte, error)
+}
+
+// CreateArtifact creates an artifact whose blobs are fetched by getBlob.
+func CreateArtifact(digest string, repository string, manifest *Manifest, getBlob func(digest string) ([]byte, error)) *Artifact {
+	return &Artifact{Digest: digest, Repository: repository, Manifest: manifest, getBlob: getBlob}
+}
+
+// GetBlob fetches one of the artifact's blobs from the registry.
+func (a *Artifact) GetBlob(digest string) ([]byte, error) {
+	return a.getBlob(digest)
+}
+
+// Handler extracts metadata from artifacts of a particular type, returning
+// the name and value of each item of metadata.
+type Handler interface {
+	Extract(artifact *Artifact) ([]database.ArtifactMetadata, error)
+}
+
+// HandlerFunc adapts a function to a Handler.
+type HandlerFunc func(artifact *Artifact) ([]database.ArtifactMetadata, error)
+
+// Extract calls f.
+func (f HandlerFunc) Extract(artifact *Artifact) ([]database.ArtifactMetadata, error) {
+	return f(artifact)
+}
+
+// Registry maps artifact types and media types to the handlers of the
+// artifacts they identify.
+type Registry struct {
+	handlers map[string]Handler
+}
+
+// CreateRegistry creates an empty registry.
+func CreateRegistry() *Registry {
+	return &Registry{handlers: map[string]Handler{}}
+}
+
+// Register adds a handler for the artifacts identified by key, which is an
+// artifactType, a config media type or a layer media type. It replaces any
+// handler already registered for that key.
+func (r *Registry) Register(key string, handler Handler) {
+	r.handlers[key] = handler
+}
+
+// Handler finds the handler for the artifact that a manifest describes, by
+// looking up its artifactType, then the media type of its config, then the
+// media types of its layers or blobs in order, returning the key that
+// matched along with the handler. It returns a nil handler if none is
+// registered, in which case the manifest is recorded with its blobs alone.
+func (r *Registry) Handler(m *Manifest) (string, Handler) {
+	if r == nil {
+		return "", nil
+	}
+	keys := []string{m.ArtifactType}
+	if m.Config != nil {
+		keys = append(keys, m.Config.MediaType)
+	}
+	for _, layer := range append(m.Layers, m.Blobs...) {
+		keys = append(keys, layer.MediaType)
+	}
+	for _, key := range keys {
+		if handler, ok := r.handlers[key]; ok && key != "" {
+			return key, handler
+		}
+	}
+	return "", nil
+}
+
+var defaultRegistry = CreateRegistry()
+
+// Register adds a handler to the default registry.
+func Register(key string, handler Handler) {
+	defaultRegistry.Register(key, handler)
+}
+
+// Default returns the default registry, which holds the handlers of this
+// package and those registered by other packages.
+func Default() *Registry {
+	return defaultRegistry
+}
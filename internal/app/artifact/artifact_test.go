@@ -0,0 +1,146 @@
+package artifact
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/vleurgat/regstat/internal/app/database"
+)
+
+func TestType(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest Manifest
+		expected string
+	}{
+		{"image", Manifest{Config: &Descriptor{MediaType: "application/vnd.oci.image.config.v1+json"}}, ""},
+		{"config", Manifest{Config: &Descriptor{MediaType: "application/vnd.cncf.helm.config.v1+json"}}, "application/vnd.cncf.helm.config.v1+json"},
+		{"artifact type", Manifest{ArtifactType: "application/vnd.example.sbom", Config: &Descriptor{MediaType: MediaTypeOCIEmpty}}, "application/vnd.example.sbom"},
+		{"empty config", Manifest{Config: &Descriptor{MediaType: MediaTypeOCIEmpty}}, ""},
+		{"no config", Manifest{}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := test.manifest.Type(); actual != test.expected {
+				t.Errorf("expected %q; got %q", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	byType := HandlerFunc(func(*Artifact) ([]database.ArtifactMetadata, error) { return nil, nil })
+	byLayer := HandlerFunc(func(*Artifact) ([]database.ArtifactMetadata, error) { return nil, nil })
+	registry := CreateRegistry()
+	registry.Register("application/vnd.example.sbom", byType)
+	registry.Register("application/vnd.example.layer", byLayer)
+
+	t.Run("artifact type first", func(t *testing.T) {
+		key, handler := registry.Handler(&Manifest{
+			ArtifactType: "application/vnd.example.sbom",
+			Layers:       []Descriptor{{MediaType: "application/vnd.example.layer"}},
+		})
+		if key != "application/vnd.example.sbom" || handler == nil {
+			t.Error("unexpected handler", key)
+		}
+	})
+
+	t.Run("layer", func(t *testing.T) {
+		key, handler := registry.Handler(&Manifest{
+			Config: &Descriptor{MediaType: MediaTypeOCIEmpty},
+			Blobs:  []Descriptor{{MediaType: "application/octet-stream"}, {MediaType: "application/vnd.example.layer"}},
+		})
+		if key != "application/vnd.example.layer" || handler == nil {
+			t.Error("unexpected handler", key)
+		}
+	})
+
+	t.Run("none", func(t *testing.T) {
+		key, handler := registry.Handler(&Manifest{Config: &Descriptor{MediaType: "application/vnd.oci.image.config.v1+json"}})
+		if key != "" || handler != nil {
+			t.Error("expected no handler", key)
+		}
+	})
+
+	t.Run("nil registry", func(t *testing.T) {
+		var registry *Registry
+		if _, handler := registry.Handler(&Manifest{ArtifactType: "application/vnd.example.sbom"}); handler != nil {
+			t.Error("expected no handler")
+		}
+	})
+}
+
+func createTestArtifact(manifest *Manifest, blobs map[string]string) *Artifact {
+	return CreateArtifact("sha256:b00", "hello", manifest, func(digest string) ([]byte, error) {
+		blob, ok := blobs[digest]
+		if !ok {
+			return nil, errors.New("404 Not Found")
+		}
+		return []byte(blob), nil
+	})
+}
+
+func TestHelmChart(t *testing.T) {
+	manifest := &Manifest{Config: &Descriptor{MediaType: MediaTypeHelmConfig, Digest: "sha256:c4a7"}}
+	_, handler := Default().Handler(manifest)
+	if handler == nil {
+		t.Fatal("expected helm chart handler")
+	}
+
+	t.Run("config", func(t *testing.T) {
+		metadata, err := handler.Extract(createTestArtifact(manifest, map[string]string{
+			"sha256:c4a7": `{"name": "hello", "version": "1.2.3"}`,
+		}))
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if fmt.Sprint(metadata) != "[{ chart_name hello} { chart_version 1.2.3}]" {
+			t.Error("unexpected metadata", metadata)
+		}
+	})
+
+	t.Run("invalid config", func(t *testing.T) {
+		_, err := handler.Extract(createTestArtifact(manifest, map[string]string{"sha256:c4a7": "name: hello"}))
+		if err == nil {
+			t.Error("expected non nil err")
+		}
+	})
+
+	t.Run("missing config", func(t *testing.T) {
+		_, err := handler.Extract(createTestArtifact(manifest, map[string]string{}))
+		if err == nil {
+			t.Error("expected non nil err")
+		}
+	})
+}
+
+func TestCosignSignature(t *testing.T) {
+	manifest := &Manifest{
+		Config: &Descriptor{MediaType: "application/vnd.oci.image.config.v1+json", Digest: "sha256:c0ffee"},
+		Layers: []Descriptor{{
+			MediaType:   MediaTypeCosignSignature,
+			Digest:      "sha256:5197",
+			Annotations: map[string]string{cosignSignatureAnnotation: "MEUCIQ=="},
+		}},
+	}
+	payload := `{"critical":{"identity":{"docker-reference":"my.registry.com/hello"},` +
+		`"image":{"docker-manifest-digest":"sha256:1ma6e"},"type":"cosign container image signature"},"optional":null}`
+	_, handler := Default().Handler(manifest)
+	if handler == nil {
+		t.Fatal("expected cosign signature handler")
+	}
+	metadata, err := handler.Extract(createTestArtifact(manifest, map[string]string{"sha256:5197": payload}))
+	if err != nil {
+		t.Fatalf("expected nil err; got %s", err)
+	}
+	expected := []database.ArtifactMetadata{
+		{Name: "signed_digest", Value: "sha256:1ma6e"},
+		{Name: "signed_reference", Value: "my.registry.com/hello"},
+		{Name: "signature", Value: "MEUCIQ=="},
+		{Name: "payload", Value: payload},
+	}
+	if fmt.Sprint(metadata) != fmt.Sprint(expected) {
+		t.Error("unexpected metadata", metadata)
+	}
+}
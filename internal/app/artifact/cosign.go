@@ -0,0 +1,66 @@
+package artifact
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/vleurgat/regstat/internal/app/database"
+)
+
+// MediaTypeCosignSignature is the layer media type of a cosign signature,
+// whose layer holds the signed payload.
+const MediaTypeCosignSignature = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+// MediaTypeCosignArtifactSignature is the artifact type of a cosign signature
+// that is pushed as a referrer of the image it signs, rather than under a tag
+// derived from the image's digest.
+const MediaTypeCosignArtifactSignature = "application/vnd.dev.cosign.artifact.sig.v1+json"
+
+// MediaTypeNotarySignature is the artifact type of a Notary Project signature,
+// as pushed by notation.
+const MediaTypeNotarySignature = "application/vnd.cncf.notary.signature"
+
+// cosignSignatureAnnotation is the layer annotation holding the signature of
+// the payload.
+const cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+func init() {
+	Register(MediaTypeCosignSignature, HandlerFunc(extractCosignSignatures))
+}
+
+// extractCosignSignatures records, for each signature held by a cosign
+// signature manifest, the digest and reference of the image that was signed,
+// the signature, and the signed payload.
+func extractCosignSignatures(artifact *Artifact) ([]database.ArtifactMetadata, error) {
+	var metadata []database.ArtifactMetadata
+	for _, layer := range artifact.Manifest.Layers {
+		if layer.MediaType != MediaTypeCosignSignature {
+			continue
+		}
+		payload, err := artifact.GetBlob(layer.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var simpleSigning struct {
+			Critical struct {
+				Identity struct {
+					DockerReference string `json:"docker-reference"`
+				} `json:"identity"`
+				Image struct {
+					DockerManifestDigest string `json:"docker-manifest-digest"`
+				} `json:"image"`
+			} `json:"critical"`
+		}
+		err = json.Unmarshal(payload, &simpleSigning)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cosign signature payload: %s", err)
+		}
+		metadata = append(metadata, nonEmpty(
+			database.ArtifactMetadata{Name: "signed_digest", Value: simpleSigning.Critical.Image.DockerManifestDigest},
+			database.ArtifactMetadata{Name: "signed_reference", Value: simpleSigning.Critical.Identity.DockerReference},
+			database.ArtifactMetadata{Name: "signature", Value: layer.Annotations[cosignSignatureAnnotation]},
+			database.ArtifactMetadata{Name: "payload", Value: string(payload)},
+		)...)
+	}
+	return metadata, nil
+}
@@ -0,0 +1,54 @@
+package artifact
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/vleurgat/regstat/internal/app/database"
+)
+
+// MediaTypeHelmConfig is the config media type of a Helm chart.
+const MediaTypeHelmConfig = "application/vnd.cncf.helm.config.v1+json"
+
+func init() {
+	Register(MediaTypeHelmConfig, HandlerFunc(extractHelmChart))
+}
+
+// extractHelmChart records the name and versions of a Helm chart, which its
+// config holds in the form of its Chart.yaml.
+func extractHelmChart(artifact *Artifact) ([]database.ArtifactMetadata, error) {
+	if artifact.Manifest.Config == nil {
+		return nil, fmt.Errorf("helm chart %s has no config", artifact.Digest)
+	}
+	body, err := artifact.GetBlob(artifact.Manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var chart struct {
+		Name       string `json:"name"`
+		Version    string `json:"version"`
+		AppVersion string `json:"appVersion"`
+		APIVersion string `json:"apiVersion"`
+	}
+	err = json.Unmarshal(body, &chart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid helm chart config: %s", err)
+	}
+	return nonEmpty(
+		database.ArtifactMetadata{Name: "chart_name", Value: chart.Name},
+		database.ArtifactMetadata{Name: "chart_version", Value: chart.Version},
+		database.ArtifactMetadata{Name: "app_version", Value: chart.AppVersion},
+		database.ArtifactMetadata{Name: "api_version", Value: chart.APIVersion},
+	), nil
+}
+
+// nonEmpty drops the items of metadata that have no value.
+func nonEmpty(metadata ...database.ArtifactMetadata) []database.ArtifactMetadata {
+	var kept []database.ArtifactMetadata
+	for _, item := range metadata {
+		if item.Value != "" {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
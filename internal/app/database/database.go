@@ -1,26 +1,97 @@
 package database
 
 import (
+	"errors"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 )
 
 // Blob representation in the database.
+//
+// A Size of 0 means that the size isn't known, e.g. for the layers of a
+// schema1 manifest. Repository is the repository in which the blob was
+// pushed or pulled, if known. MediaType and Role, i.e. config, layer or
+// foreign, are empty if they aren't known.
 type Blob struct {
-	Digest string
-	Pushed time.Time
-	Pulled time.Time
+	Digest     string
+	Repository string
+	MediaType  string
+	Role       string
+	Size       int64
+	Pushed     time.Time
+	Pulled     time.Time
 }
 
 // Manifest representation in the database.
 //
-// A manifest is linked to one or more blobs.
+// An image manifest is linked to one or more blobs; a manifest list or image
+// index is instead linked to the manifests of its platform specific images.
+// Repository is the repository in which the manifest was pushed or pulled, if
+// known. Config holds the details of an image manifest's config, if they
+// could be fetched from the registry. ArtifactType identifies the kind of an
+// OCI artifact, e.g. a Helm chart, and is empty for images; Metadata holds
+// what was extracted from the artifact, if anything. Subject is the digest of
+// the manifest that a referrer, e.g. a signature or SBOM, refers to.
 type Manifest struct {
-	Digest string
-	Pushed time.Time
-	Pulled time.Time
-	Blobs  []Blob
+	Digest       string
+	Repository   string
+	Size         int64
+	Pushed       time.Time
+	Pulled       time.Time
+	Blobs        []Blob
+	Children     []ChildManifest
+	Config       *ImageConfig
+	ArtifactType string
+	Metadata     []ArtifactMetadata
+	Subject      string
+}
+
+// BlobMount representation in the database.
+//
+// A blob is mounted into a repository when a client pushes a blob that the
+// registry already has in another repository, which it can access.
+type BlobMount struct {
+	Blob           Blob
+	Repository     string
+	FromRepository string
+}
+
+// Platform identifies the operating system and CPU architecture that an image
+// is built for.
+type Platform struct {
+	OS           string
+	Architecture string
+	Variant      string
+}
+
+// ChildManifest is a manifest referred to by a manifest list or image index.
+type ChildManifest struct {
+	Digest   string
+	Size     int64
+	Platform Platform
+}
+
+// ImageConfig holds the details recorded in the config blob of an image.
+// Created is the zero time if the image doesn't record when it was built.
+type ImageConfig struct {
+	Digest        string
+	Platform      Platform
+	Created       time.Time
+	Author        string
+	Entrypoint    []string
+	Cmd           []string
+	ExposedPorts  []string
+	HistoryLength int
+}
+
+// ArtifactMetadata is an item of metadata extracted from an OCI artifact,
+// e.g. the version of a Helm chart. Type is the artifact type or media type
+// of the handler that extracted it.
+type ArtifactMetadata struct {
+	Type  string
+	Name  string
+	Value string
 }
 
 // Tag representation in the database.
@@ -36,18 +107,203 @@ type Tag struct {
 	Pulled     time.Time
 }
 
+// StorageTotals is the number of bytes used by all of the blobs and manifests
+// in the registry. Those whose size isn't known are counted in UnknownSizes.
+// Foreign layers aren't stored by the registry, so their bytes are counted in
+// ForeignBytes rather than in Bytes or BlobBytes.
+type StorageTotals struct {
+	Bytes         int64 `json:"bytes" db:"bytes"`
+	BlobBytes     int64 `json:"blob_bytes" db:"blob_bytes"`
+	ManifestBytes int64 `json:"manifest_bytes" db:"manifest_bytes"`
+	ForeignBytes  int64 `json:"foreign_bytes" db:"foreign_bytes"`
+	UnknownSizes  int64 `json:"unknown_sizes" db:"unknown_sizes"`
+}
+
+// StorageUsage is the number of bytes used by the manifests and blobs of the
+// images of a repository or tag, counting each blob once however many of
+// those images share it. ExclusiveBytes only counts the manifests and blobs
+// that no other repository or tag uses, i.e. the bytes that deleting the
+// repository or tag would free up.
+type StorageUsage struct {
+	Registry       string `json:"registry" db:"registry"`
+	Repository     string `json:"repository" db:"repository"`
+	Tag            string `json:"tag,omitempty" db:"tag"`
+	Bytes          int64  `json:"bytes" db:"bytes"`
+	ExclusiveBytes int64  `json:"exclusive_bytes" db:"exclusive_bytes"`
+}
+
+// TagImage describes an image that a tag refers to, either directly or as one
+// of the platform images of a manifest list or index: the platform that its
+// config says it was built for, when it was built, and when the tag was
+// pushed. The declared platform is the one that a manifest list or index
+// gives for the image, and is empty for an image that a tag refers to
+// directly; PlatformMismatch is true if that differs from the config's.
+type TagImage struct {
+	Registry             string     `json:"registry" db:"registry"`
+	Repository           string     `json:"repository" db:"repository"`
+	Tag                  string     `json:"tag" db:"tag"`
+	Digest               string     `json:"digest" db:"digest"`
+	OS                   string     `json:"os" db:"os"`
+	Architecture         string     `json:"architecture" db:"architecture"`
+	Variant              string     `json:"variant,omitempty" db:"variant"`
+	DeclaredOS           string     `json:"declared_os,omitempty" db:"declared_os"`
+	DeclaredArchitecture string     `json:"declared_architecture,omitempty" db:"declared_architecture"`
+	DeclaredVariant      string     `json:"declared_variant,omitempty" db:"declared_variant"`
+	PlatformMismatch     bool       `json:"platform_mismatch" db:"platform_mismatch"`
+	Created              *time.Time `json:"created,omitempty" db:"created"`
+	Pushed               time.Time  `json:"pushed" db:"pushed"`
+}
+
+// Referrer is a manifest, e.g. a signature, SBOM or provenance attestation,
+// whose subject is another manifest. ArtifactType is empty if the referrer
+// doesn't give one.
+type Referrer struct {
+	Digest       string    `json:"digest" db:"digest"`
+	ArtifactType string    `json:"artifact_type" db:"artifact_type"`
+	Size         int64     `json:"size" db:"size"`
+	Pushed       time.Time `json:"pushed" db:"pushed"`
+}
+
+// UnsignedTag is a tag whose manifest has no signature.
+type UnsignedTag struct {
+	Registry   string    `json:"registry" db:"registry"`
+	Repository string    `json:"repository" db:"repository"`
+	Tag        string    `json:"tag" db:"tag"`
+	Digest     string    `json:"digest" db:"digest"`
+	Pushed     time.Time `json:"pushed" db:"pushed"`
+}
+
+// MediaTypeUsage is the number and total size of the blobs of a media type.
+// MediaType and Role are empty for blobs whose media type isn't known.
+type MediaTypeUsage struct {
+	MediaType string `json:"media_type" db:"media_type"`
+	Role      string `json:"role" db:"role"`
+	Blobs     int64  `json:"blobs" db:"blobs"`
+	Bytes     int64  `json:"bytes" db:"bytes"`
+}
+
+// TagPulls counts the pulls of a tag: in total, and since a given day, along
+// with the number of days since then on which the tag was pulled. LastPulled
+// is nil if the tag has never been pulled.
+type TagPulls struct {
+	Registry    string     `json:"registry" db:"registry"`
+	Repository  string     `json:"repository" db:"repository"`
+	Tag         string     `json:"tag" db:"tag"`
+	PullCount   int64      `json:"pull_count" db:"pull_count"`
+	LastPulled  *time.Time `json:"last_pulled,omitempty" db:"last_pulled"`
+	RecentPulls int64      `json:"recent_pulls" db:"recent_pulls"`
+	RecentDays  int64      `json:"recent_days" db:"recent_days"`
+}
+
+// Event is the audit record of a processed registry notification event: what
+// it did, to which object, and who did it from where. Fields that the
+// registry didn't provide are empty.
+type Event struct {
+	ID               string    `json:"id" db:"id"`
+	Action           string    `json:"action" db:"action"`
+	Timestamp        time.Time `json:"timestamp" db:"occurred"`
+	Registry         string    `json:"registry" db:"registry"`
+	Repository       string    `json:"repository" db:"repository"`
+	FromRepository   string    `json:"from_repository,omitempty" db:"from_repository"`
+	Tag              string    `json:"tag,omitempty" db:"tag"`
+	Digest           string    `json:"digest,omitempty" db:"digest"`
+	MediaType        string    `json:"media_type,omitempty" db:"media_type"`
+	Size             int64     `json:"size,omitempty" db:"size"`
+	URL              string    `json:"url,omitempty" db:"url"`
+	Actor            string    `json:"actor,omitempty" db:"actor"`
+	RequestID        string    `json:"request_id,omitempty" db:"request_id"`
+	RequestAddr      string    `json:"request_addr,omitempty" db:"request_addr"`
+	RequestMethod    string    `json:"request_method,omitempty" db:"request_method"`
+	RequestUserAgent string    `json:"request_user_agent,omitempty" db:"request_user_agent"`
+	SourceInstanceID string    `json:"source_instance_id,omitempty" db:"source_instance_id"`
+	SourceAddr       string    `json:"source_addr,omitempty" db:"source_addr"`
+	Recorded         time.Time `json:"recorded" db:"recorded"`
+}
+
+// EventQuery selects audit events. Empty fields match any event, and Limit
+// bounds the number of events returned, the most recent first.
+type EventQuery struct {
+	Actor      string
+	Repository string
+	Tag        string
+	Digest     string
+	Action     string
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+}
+
+// PendingEnrichment is a pushed manifest that couldn't be fetched from the
+// registry, and so is recorded without the blobs or children that it refers
+// to until a retry succeeds. LastError is the error of the most recent of its
+// failed Attempts.
+type PendingEnrichment struct {
+	Digest      string    `json:"digest" db:"digest"`
+	Repository  string    `json:"repository" db:"repository"`
+	MediaType   string    `json:"media_type" db:"media_type"`
+	URL         string    `json:"url" db:"url"`
+	Pushed      time.Time `json:"pushed" db:"pushed"`
+	Attempts    int       `json:"attempts" db:"attempts"`
+	LastError   string    `json:"last_error" db:"last_error"`
+	NextAttempt time.Time `json:"next_attempt" db:"next_attempt"`
+}
+
+// TransientError wraps a database error that is likely to go away if the
+// operation is retried, e.g. a lost connection.
+type TransientError struct {
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying database error.
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient determines whether the given error is, or wraps, a TransientError.
+func IsTransient(err error) bool {
+	var transient *TransientError
+	return errors.As(err, &transient)
+}
+
 // Database operations.
 type Database interface {
 	GetConnection() *sqlx.DB
+	Close() error
+	Ping() error
 	CreateSchemaIfNecessary()
-	IsBlob(digest string) bool
-	PushBlob(blob *Blob)
-	PullBlob(blob *Blob)
-	DeleteBlob(digest string)
-	IsManifest(digest string) bool
-	PushManifest(manifest *Manifest)
-	PullManifest(manifest *Manifest)
-	DeleteManifest(digest string)
-	PushTag(tag *Tag)
-	PullTag(tag *Tag)
+	CheckSchema() error
+	IsBlob(digest string) (bool, error)
+	PushBlob(blob *Blob) error
+	PullBlob(blob *Blob) error
+	DeleteBlob(repository string, digest string) error
+	IsManifest(digest string) (bool, error)
+	PushManifest(manifest *Manifest) error
+	PullManifest(manifest *Manifest) error
+	DeleteManifest(repository string, digest string) error
+	MountBlob(mount *BlobMount) error
+	PushTag(tag *Tag) error
+	PullTag(tag *Tag) error
+	PullManifestTags(tag *Tag) error
+	DeleteTag(name string) error
+	Transaction(fn func(db Database) error) error
+	IsEventProcessed(id string) (bool, error)
+	MarkEventProcessed(id string) (bool, error)
+	ExpireProcessedEvents(ttl time.Duration) (int64, error)
+	SavePendingEnrichment(pending *PendingEnrichment) error
+	DeletePendingEnrichment(digest string) error
+	PendingEnrichments(due time.Time) ([]PendingEnrichment, error)
+	MediaTypeStorage() ([]MediaTypeUsage, error)
+	TagImages(registry string, repository string) ([]TagImage, error)
+	TagPulls(registry string, repository string, since time.Time) ([]TagPulls, error)
+	Referrers(digest string, artifactType string) ([]Referrer, error)
+	UnsignedTags(registry string, repository string, signatureTypes []string) ([]UnsignedTag, error)
+	RecordEvent(event *Event) error
+	Events(query EventQuery) ([]Event, error)
+	StorageTotals() (StorageTotals, error)
+	RepositoryStorage() ([]StorageUsage, error)
+	TagStorage(registry string, repository string) ([]StorageUsage, error)
 }
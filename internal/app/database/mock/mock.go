@@ -1,35 +1,64 @@
 package mock
 
 import (
+	"time"
+
 	"github.com/jmoiron/sqlx"
 	"github.com/vleurgat/regstat/internal/app/database"
 )
 
 // Database is a mock implementation of database.Database
 type Database struct {
-	IsBlobRetValue     bool
-	IsManifestRetValue bool
-	PushedBlobs        *[]*database.Blob
-	PushedManifests    *[]*database.Manifest
-	PushedTags         *[]*database.Tag
-	PulledBlobs        *[]*database.Blob
-	PulledManifests    *[]*database.Manifest
-	PulledTags         *[]*database.Tag
-	DeletedBlobs       *[]string
-	DeletedManifests   *[]string
+	IsBlobRetValue              bool
+	IsManifestRetValue          bool
+	PushedBlobs                 *[]*database.Blob
+	MountedBlobs                *[]*database.BlobMount
+	PushedManifests             *[]*database.Manifest
+	PushedTags                  *[]*database.Tag
+	PulledBlobs                 *[]*database.Blob
+	PulledManifests             *[]*database.Manifest
+	PulledTags                  *[]*database.Tag
+	PulledManifestTags          *[]*database.Tag
+	DeletedBlobs                *[]string
+	DeletedBlobRepositories     *[]string
+	DeletedManifests            *[]string
+	DeletedManifestRepositories *[]string
+	DeletedTags                 *[]string
+	ProcessedEvents             *map[string]bool
+	RecordedEvents              *[]*database.Event
+	SavedPendingEnrichments     *[]*database.PendingEnrichment
+	DeletedPendingEnrichments   *[]string
+	PendingEnrichmentsRetValue  []database.PendingEnrichment
+	StorageTotalsRetValue       database.StorageTotals
+	StorageUsages               []database.StorageUsage
+	TagPullsRetValue            []database.TagPulls
+	MediaTypeUsages             []database.MediaTypeUsage
+	TagImagesRetValue           []database.TagImage
+	ReferrersRetValue           map[string][]database.Referrer
+	UnsignedTagsRetValue        []database.UnsignedTag
+	Err                         error
 }
 
 // CreateDatabase creates a mock Database implementation
 func CreateDatabase() Database {
 	return Database{
-		PushedBlobs:      &[]*database.Blob{},
-		PushedManifests:  &[]*database.Manifest{},
-		PushedTags:       &[]*database.Tag{},
-		PulledBlobs:      &[]*database.Blob{},
-		PulledManifests:  &[]*database.Manifest{},
-		PulledTags:       &[]*database.Tag{},
-		DeletedBlobs:     &[]string{},
-		DeletedManifests: &[]string{},
+		PushedBlobs:                 &[]*database.Blob{},
+		MountedBlobs:                &[]*database.BlobMount{},
+		PushedManifests:             &[]*database.Manifest{},
+		PushedTags:                  &[]*database.Tag{},
+		PulledBlobs:                 &[]*database.Blob{},
+		PulledManifests:             &[]*database.Manifest{},
+		PulledTags:                  &[]*database.Tag{},
+		PulledManifestTags:          &[]*database.Tag{},
+		DeletedBlobs:                &[]string{},
+		DeletedBlobRepositories:     &[]string{},
+		DeletedManifests:            &[]string{},
+		DeletedManifestRepositories: &[]string{},
+		DeletedTags:                 &[]string{},
+		ProcessedEvents:             &map[string]bool{},
+		RecordedEvents:              &[]*database.Event{},
+		SavedPendingEnrichments:     &[]*database.PendingEnrichment{},
+		DeletedPendingEnrichments:   &[]string{},
 	}
 }
 
@@ -38,58 +67,304 @@ func (db Database) GetConnection() *sqlx.DB {
 	return nil
 }
 
+// Close does nothing.
+func (db Database) Close() error {
+	return nil
+}
+
+// Ping returns the mock error.
+func (db Database) Ping() error {
+	return db.Err
+}
+
 // CreateSchemaIfNecessary does what it says on the tin.
 func (db Database) CreateSchemaIfNecessary() {
 	// no op
 }
 
+// CheckSchema returns the mock error.
+func (db Database) CheckSchema() error {
+	return db.Err
+}
+
 // IsBlob determines whether the given digest belongs to a persisted blob.
-func (db Database) IsBlob(digest string) bool {
-	return db.IsBlobRetValue
+func (db Database) IsBlob(digest string) (bool, error) {
+	return db.IsBlobRetValue, db.Err
 }
 
 // PushBlob writes a blob to the database, or updates the pushed time of an existing one.
-func (db Database) PushBlob(blob *database.Blob) {
+func (db Database) PushBlob(blob *database.Blob) error {
+	if db.Err != nil {
+		return db.Err
+	}
 	*db.PushedBlobs = append(*db.PushedBlobs, blob)
+	return nil
+}
+
+// MountBlob writes a blob to the database, recording the repository it was mounted from.
+func (db Database) MountBlob(mount *database.BlobMount) error {
+	if db.Err != nil {
+		return db.Err
+	}
+	*db.MountedBlobs = append(*db.MountedBlobs, mount)
+	return nil
 }
 
 // PullBlob writes a blob to the database, or updates the pulled time of an existing one.
-func (db Database) PullBlob(blob *database.Blob) {
+func (db Database) PullBlob(blob *database.Blob) error {
+	if db.Err != nil {
+		return db.Err
+	}
 	*db.PulledBlobs = append(*db.PulledBlobs, blob)
+	return nil
 }
 
-// DeleteBlob deletes a blob from the database, moving the existing entry to the deleted_blobs table.
-func (db Database) DeleteBlob(digest string) {
+// DeleteBlob removes the link between a repository and a blob, deleting the blob once no repository links it.
+func (db Database) DeleteBlob(repository string, digest string) error {
+	if db.Err != nil {
+		return db.Err
+	}
 	*db.DeletedBlobs = append(*db.DeletedBlobs, digest)
+	*db.DeletedBlobRepositories = append(*db.DeletedBlobRepositories, repository)
+	return nil
 }
 
 // IsManifest determines whether the given digest belongs to a persisted manifest.
-func (db Database) IsManifest(digest string) bool {
-	return db.IsManifestRetValue
+func (db Database) IsManifest(digest string) (bool, error) {
+	return db.IsManifestRetValue, db.Err
 }
 
 // PushManifest writes a manifest to the database, or updates the pushed time of an existing one.
-func (db Database) PushManifest(manifest *database.Manifest) {
+func (db Database) PushManifest(manifest *database.Manifest) error {
+	if db.Err != nil {
+		return db.Err
+	}
 	*db.PushedManifests = append(*db.PushedManifests, manifest)
+	return nil
 }
 
 // PullManifest writes a manifest to the database, or updates the pulled time of an existing one.
-func (db Database) PullManifest(manifest *database.Manifest) {
+func (db Database) PullManifest(manifest *database.Manifest) error {
+	if db.Err != nil {
+		return db.Err
+	}
 	*db.PulledManifests = append(*db.PulledManifests, manifest)
+	return nil
 }
 
-// DeleteManifest deletes a manifest and associated tag from the database, moving the
-// existing entries to the deleted_manifests and deleted_tags tables.
-func (db Database) DeleteManifest(digest string) {
+// DeleteManifest removes the link between a repository and a manifest, deleting the
+// manifest once no repository links it.
+func (db Database) DeleteManifest(repository string, digest string) error {
+	if db.Err != nil {
+		return db.Err
+	}
 	*db.DeletedManifests = append(*db.DeletedManifests, digest)
+	*db.DeletedManifestRepositories = append(*db.DeletedManifestRepositories, repository)
+	return nil
 }
 
 // PushTag writes a tag to the database, or updates the pushed time of an existing one.
-func (db Database) PushTag(tag *database.Tag) {
+func (db Database) PushTag(tag *database.Tag) error {
+	if db.Err != nil {
+		return db.Err
+	}
 	*db.PushedTags = append(*db.PushedTags, tag)
+	return nil
 }
 
 // PullTag writes a tag to the database, or updates the pulled time of an existing one.
-func (db Database) PullTag(tag *database.Tag) {
+func (db Database) PullTag(tag *database.Tag) error {
+	if db.Err != nil {
+		return db.Err
+	}
 	*db.PulledTags = append(*db.PulledTags, tag)
+	return nil
+}
+
+// PullManifestTags records the repository tag, of a manifest pulled by digest,
+// in PulledManifestTags.
+func (db Database) PullManifestTags(tag *database.Tag) error {
+	if db.Err != nil {
+		return db.Err
+	}
+	*db.PulledManifestTags = append(*db.PulledManifestTags, tag)
+	return nil
+}
+
+// Transaction calls fn with this mock Database.
+func (db Database) Transaction(fn func(db database.Database) error) error {
+	return fn(db)
+}
+
+// DeleteTag deletes a tag from the database.
+func (db Database) DeleteTag(name string) error {
+	if db.Err != nil {
+		return db.Err
+	}
+	*db.DeletedTags = append(*db.DeletedTags, name)
+	return nil
+}
+
+// IsEventProcessed determines whether the event with the given ID has been
+// recorded as processed.
+func (db Database) IsEventProcessed(id string) (bool, error) {
+	return (*db.ProcessedEvents)[id], db.Err
+}
+
+// MarkEventProcessed records that the event with the given ID has been
+// processed, returning false if it had already been recorded.
+func (db Database) MarkEventProcessed(id string) (bool, error) {
+	if db.Err != nil {
+		return false, db.Err
+	}
+	if (*db.ProcessedEvents)[id] {
+		return false, nil
+	}
+	(*db.ProcessedEvents)[id] = true
+	return true, nil
+}
+
+// ExpireProcessedEvents forgets all the processed event IDs.
+func (db Database) ExpireProcessedEvents(ttl time.Duration) (int64, error) {
+	expired := int64(len(*db.ProcessedEvents))
+	*db.ProcessedEvents = map[string]bool{}
+	return expired, db.Err
+}
+
+// SavePendingEnrichment records the pending enrichment in SavedPendingEnrichments.
+func (db Database) SavePendingEnrichment(pending *database.PendingEnrichment) error {
+	if db.Err != nil {
+		return db.Err
+	}
+	*db.SavedPendingEnrichments = append(*db.SavedPendingEnrichments, pending)
+	return nil
+}
+
+// DeletePendingEnrichment records the digest in DeletedPendingEnrichments.
+func (db Database) DeletePendingEnrichment(digest string) error {
+	if db.Err != nil {
+		return db.Err
+	}
+	*db.DeletedPendingEnrichments = append(*db.DeletedPendingEnrichments, digest)
+	return nil
+}
+
+// PendingEnrichments returns the mock pending enrichments that are due by the
+// given time, or all of them if it is zero.
+func (db Database) PendingEnrichments(due time.Time) ([]database.PendingEnrichment, error) {
+	pendings := []database.PendingEnrichment{}
+	for _, pending := range db.PendingEnrichmentsRetValue {
+		if due.IsZero() || !pending.NextAttempt.After(due) {
+			pendings = append(pendings, pending)
+		}
+	}
+	return pendings, db.Err
+}
+
+// MediaTypeStorage returns the mock media type usages.
+func (db Database) MediaTypeStorage() ([]database.MediaTypeUsage, error) {
+	return db.MediaTypeUsages, db.Err
+}
+
+// TagImages returns the mock tag images that match the given registry and repository.
+func (db Database) TagImages(registry string, repository string) ([]database.TagImage, error) {
+	images := []database.TagImage{}
+	for _, image := range db.TagImagesRetValue {
+		if (registry == "" || image.Registry == registry) && (repository == "" || image.Repository == repository) {
+			images = append(images, image)
+		}
+	}
+	return images, db.Err
+}
+
+// Referrers returns the mock referrers of the given digest that match the
+// given artifact type.
+func (db Database) Referrers(digest string, artifactType string) ([]database.Referrer, error) {
+	referrers := []database.Referrer{}
+	for _, referrer := range db.ReferrersRetValue[digest] {
+		if artifactType == "" || referrer.ArtifactType == artifactType {
+			referrers = append(referrers, referrer)
+		}
+	}
+	return referrers, db.Err
+}
+
+// UnsignedTags returns the mock unsigned tags that match the given registry
+// and repository.
+func (db Database) UnsignedTags(registry string, repository string, signatureTypes []string) ([]database.UnsignedTag, error) {
+	tags := []database.UnsignedTag{}
+	for _, tag := range db.UnsignedTagsRetValue {
+		if (registry == "" || tag.Registry == registry) && (repository == "" || tag.Repository == repository) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, db.Err
+}
+
+// TagPulls returns the mock tag pulls that match the given registry and repository.
+func (db Database) TagPulls(registry string, repository string, since time.Time) ([]database.TagPulls, error) {
+	pulls := []database.TagPulls{}
+	for _, tagPulls := range db.TagPullsRetValue {
+		if (registry == "" || tagPulls.Registry == registry) && (repository == "" || tagPulls.Repository == repository) {
+			pulls = append(pulls, tagPulls)
+		}
+	}
+	return pulls, db.Err
+}
+
+// RecordEvent appends an event to the audit log.
+func (db Database) RecordEvent(event *database.Event) error {
+	if db.Err != nil {
+		return db.Err
+	}
+	*db.RecordedEvents = append(*db.RecordedEvents, event)
+	return nil
+}
+
+// Events returns the recorded events that match the query, the most recently
+// recorded first.
+func (db Database) Events(query database.EventQuery) ([]database.Event, error) {
+	events := []database.Event{}
+	for i := len(*db.RecordedEvents) - 1; i >= 0; i-- {
+		event := (*db.RecordedEvents)[i]
+		if (query.Actor == "" || event.Actor == query.Actor) &&
+			(query.Repository == "" || event.Repository == query.Repository) &&
+			(query.Tag == "" || event.Tag == query.Tag) &&
+			(query.Digest == "" || event.Digest == query.Digest) &&
+			(query.Action == "" || event.Action == query.Action) &&
+			(query.Since.IsZero() || !event.Timestamp.Before(query.Since)) &&
+			(query.Until.IsZero() || event.Timestamp.Before(query.Until)) &&
+			(query.Limit == 0 || len(events) < query.Limit) {
+			events = append(events, *event)
+		}
+	}
+	return events, db.Err
+}
+
+// StorageTotals returns the mock storage totals.
+func (db Database) StorageTotals() (database.StorageTotals, error) {
+	return db.StorageTotalsRetValue, db.Err
+}
+
+// RepositoryStorage returns the mock storage usages that have no tag.
+func (db Database) RepositoryStorage() ([]database.StorageUsage, error) {
+	usages := []database.StorageUsage{}
+	for _, usage := range db.StorageUsages {
+		if usage.Tag == "" {
+			usages = append(usages, usage)
+		}
+	}
+	return usages, db.Err
+}
+
+// TagStorage returns the mock storage usages that have a tag and match the
+// given registry and repository.
+func (db Database) TagStorage(registry string, repository string) ([]database.StorageUsage, error) {
+	usages := []database.StorageUsage{}
+	for _, usage := range db.StorageUsages {
+		if usage.Tag != "" && (registry == "" || usage.Registry == registry) && (repository == "" || usage.Repository == repository) {
+			usages = append(usages, usage)
+		}
+	}
+	return usages, db.Err
 }
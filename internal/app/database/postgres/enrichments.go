@@ -0,0 +1,59 @@
+package postgres
+
+import (
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/vleurgat/regstat/internal/app/database"
+)
+
+// SavePendingEnrichment records a manifest that couldn't be fetched, or the
+// latest failed attempt to fetch it again.
+func (db Database) SavePendingEnrichment(pending *database.PendingEnrichment) error {
+	err := db.transact(func(tx *sqlx.Tx) {
+		tx.MustExec("INSERT INTO regstat.pending_enrichments "+
+			"(digest, repository, media_type, url, pushed, attempts, last_error, next_attempt) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8) "+
+			"ON CONFLICT (digest) "+
+			"DO UPDATE SET "+
+			"repository = $2, "+
+			"media_type = $3, "+
+			"url = $4, "+
+			"pushed = $5, "+
+			"attempts = $6, "+
+			"last_error = $7, "+
+			"next_attempt = $8",
+			pending.Digest, pending.Repository, pending.MediaType, pending.URL, pending.Pushed,
+			pending.Attempts, pending.LastError, pending.NextAttempt)
+	})
+	if err == nil {
+		log.Println("pending enrichment", pending.Digest, pending.Attempts, pending.NextAttempt)
+	}
+	return err
+}
+
+// DeletePendingEnrichment forgets a pending enrichment, if there is one, e.g.
+// once the manifest has been fetched.
+func (db Database) DeletePendingEnrichment(digest string) error {
+	return db.transact(func(tx *sqlx.Tx) {
+		tx.MustExec("DELETE FROM regstat.pending_enrichments "+
+			"WHERE digest = $1",
+			digest)
+	})
+}
+
+// PendingEnrichments lists the pending enrichments whose next attempt is due
+// by the given time, or all of them if the time is zero, those due soonest
+// first.
+func (db Database) PendingEnrichments(due time.Time) ([]database.PendingEnrichment, error) {
+	pendings := []database.PendingEnrichment{}
+	err := db.selectRows(&pendings, "SELECT digest, repository, media_type, url, pushed, "+
+		"attempts, last_error, next_attempt "+
+		"FROM regstat.pending_enrichments "+
+		"WHERE $1::timestamp IS NULL OR next_attempt <= $1 "+
+		"ORDER BY next_attempt, digest",
+		sql.NullTime{Time: due, Valid: !due.IsZero()})
+	return pendings, err
+}
@@ -0,0 +1,68 @@
+package postgres
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/vleurgat/regstat/internal/app/database"
+)
+
+// RecordEvent appends an event to the events audit log. Events are never
+// updated or deleted.
+func (db Database) RecordEvent(event *database.Event) error {
+	return db.transact(func(tx *sqlx.Tx) {
+		tx.MustExec("INSERT INTO regstat.events "+
+			"(id, action, occurred, registry, repository, from_repository, tag, digest, media_type, size, url, "+
+			"actor, request_id, request_addr, request_method, request_user_agent, source_instance_id, source_addr, recorded) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, NOW())",
+			event.ID, event.Action, event.Timestamp, event.Registry, event.Repository, event.FromRepository,
+			event.Tag, event.Digest, event.MediaType, size(event.Size), event.URL,
+			event.Actor, event.RequestID, event.RequestAddr, event.RequestMethod, event.RequestUserAgent,
+			event.SourceInstanceID, event.SourceAddr)
+	})
+}
+
+// Events finds the audit events that match the query, the most recent first.
+func (db Database) Events(query database.EventQuery) ([]database.Event, error) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	for _, match := range []struct {
+		column string
+		value  string
+	}{
+		{"actor", query.Actor},
+		{"repository", query.Repository},
+		{"tag", query.Tag},
+		{"digest", query.Digest},
+		{"action", query.Action},
+	} {
+		if match.value != "" {
+			where(match.column+" = $%d", match.value)
+		}
+	}
+	if !query.Since.IsZero() {
+		where("occurred >= $%d", query.Since)
+	}
+	if !query.Until.IsZero() {
+		where("occurred < $%d", query.Until)
+	}
+	sql := "SELECT id, action, occurred, registry, repository, from_repository, tag, digest, media_type, " +
+		"COALESCE(size, 0) AS size, url, actor, request_id, request_addr, request_method, request_user_agent, " +
+		"source_instance_id, source_addr, recorded " +
+		"FROM regstat.events "
+	if len(conditions) > 0 {
+		sql += "WHERE " + strings.Join(conditions, " AND ") + " "
+	}
+	sql += "ORDER BY occurred DESC, seq DESC"
+	if query.Limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", query.Limit)
+	}
+	events := []database.Event{}
+	err := db.selectRows(&events, sql, args...)
+	return events, err
+}
@@ -1,17 +1,28 @@
 package postgres
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"net"
+	"runtime"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq" // import Postgres driver
+	"github.com/lib/pq" // Postgres driver
 	"github.com/vleurgat/regstat/internal/app/database"
 )
 
 // Database is an implementation of database.Database for Postgres.
+//
+// A Database created by Transaction performs all of its operations within
+// that one transaction, rather than in a transaction per operation.
 type Database struct {
 	conn *sqlx.DB
+	tx   *sqlx.Tx
 }
 
 // CreateDatabase creates a PostgresDatabase which contains a connection to a Postgres database.
@@ -33,6 +44,16 @@ func (db Database) GetConnection() *sqlx.DB {
 	return db.conn
 }
 
+// Close closes the database connection, waiting for any queries in progress to finish.
+func (db Database) Close() error {
+	return db.conn.Close()
+}
+
+// Ping checks that the database can be reached.
+func (db Database) Ping() error {
+	return classify(db.conn.Ping())
+}
+
 // CreateSchemaIfNecessary does what it says on the tin.
 func (db Database) CreateSchemaIfNecessary() {
 	var schemaExists bool
@@ -56,192 +77,755 @@ func (db Database) CreateSchemaIfNecessary() {
 	} else {
 		log.Println("regstat schema already exists")
 	}
+	db.upgradeSchema()
+}
+
+// upgradeSchema applies those schemaUpgrades that haven't yet been applied
+// and records the resulting version in the schema_version table. Databases
+// created before the schema was versioned are at version 1. An advisory lock
+// stops instances that start at the same time applying the same upgrades.
+// Failing to read the version, or to commit the upgrades, is fatal.
+func (db Database) upgradeSchema() {
+	tx := db.conn.MustBegin()
+	tx.MustExec("SELECT pg_advisory_xact_lock($1)", schemaLockID)
+	tx.MustExec("CREATE TABLE IF NOT EXISTS regstat.schema_version (version integer NOT NULL)")
+	var version int
+	err := tx.QueryRow("SELECT COALESCE(MAX(version), 1) FROM regstat.schema_version").Scan(&version)
+	if err != nil {
+		log.Fatalln("failed to read regstat schema version", err)
+	}
+	for version < schemaVersion {
+		log.Println("upgrading regstat schema to version", version+1)
+		tx.MustExec(schemaUpgrades[version-1])
+		version++
+	}
+	tx.MustExec("DELETE FROM regstat.schema_version")
+	tx.MustExec("INSERT INTO regstat.schema_version (version) VALUES ($1)", version)
+	err = tx.Commit()
+	if err != nil {
+		log.Fatalln("failed to upgrade regstat schema", err)
+	}
+}
+
+// CheckSchema returns an error if the regstat schema is not at the version
+// expected by this code.
+func (db Database) CheckSchema() error {
+	var version int
+	err := db.conn.QueryRow("SELECT MAX(version) FROM regstat.schema_version").Scan(&version)
+	if err != nil {
+		return classify(err)
+	}
+	if version != schemaVersion {
+		return fmt.Errorf("regstat schema is at version %d, expected version %d", version, schemaVersion)
+	}
+	return nil
+}
+
+// Transaction calls fn with a Database that performs all of its operations in
+// a single transaction, which is committed if fn succeeds and otherwise
+// rolled back.
+func (db Database) Transaction(fn func(db database.Database) error) error {
+	if db.tx != nil {
+		return fn(db)
+	}
+	return db.transact(func(tx *sqlx.Tx) {
+		err := fn(Database{conn: db.conn, tx: tx})
+		if err != nil {
+			panic(err)
+		}
+	})
+}
+
+// transact runs fn within a transaction, which is committed once fn returns.
+// Any panic raised by the sqlx Must functions is recovered, the transaction
+// rolled back and the panic's error returned instead; other panics, including
+// runtime errors, are raised again once the transaction is rolled back. If the Database was
+// created by Transaction then fn runs in, and leaves the fate of, that
+// transaction.
+func (db Database) transact(fn func(tx *sqlx.Tx)) (err error) {
+	tx := db.tx
+	if tx == nil {
+		tx, err = db.conn.Beginx()
+		if err != nil {
+			return classify(err)
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if db.tx == nil {
+				tx.Rollback()
+			}
+			// only errors raised deliberately are returned; a runtime error is
+			// a bug, and is left to crash
+			recovered, ok := r.(error)
+			if _, isRuntime := r.(runtime.Error); !ok || isRuntime {
+				panic(r)
+			}
+			err = classify(recovered)
+		}
+	}()
+	fn(tx)
+	if db.tx != nil {
+		return nil
+	}
+	return classify(tx.Commit())
+}
+
+// queryRow runs a query that returns a single row, within the Database's
+// transaction if it has one.
+func (db Database) queryRow(query string, args ...interface{}) *sql.Row {
+	if db.tx != nil {
+		return db.tx.QueryRow(query, args...)
+	}
+	return db.conn.QueryRow(query, args...)
+}
+
+// classify wraps errors that are likely to succeed on a retry, i.e. those
+// caused by connection problems or by Postgres being overloaded or shut down,
+// in a database.TransientError.
+func classify(err error) error {
+	if err == nil || err == sql.ErrNoRows {
+		return err
+	}
+	transient := false
+	if _, ok := err.(*database.TransientError); ok {
+		return err
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code.Class() {
+		case "08", // connection exception
+			"40", // transaction rollback, e.g. serialization failure or deadlock
+			"53", // insufficient resources
+			"57", // operator intervention, e.g. admin shutdown
+			"58": // system error
+			transient = true
+		}
+	} else if _, ok := err.(net.Error); ok {
+		transient = true
+	} else if err == driver.ErrBadConn || err == sql.ErrConnDone || err == io.EOF || err == io.ErrUnexpectedEOF {
+		transient = true
+	}
+	if transient {
+		return &database.TransientError{Err: err}
+	}
+	return err
 }
 
 // IsBlob determines whether the given digest belongs to a persisted blob.
-func (db Database) IsBlob(digest string) bool {
+func (db Database) IsBlob(digest string) (bool, error) {
 	var exists bool
-	db.conn.QueryRow("SELECT EXISTS("+
+	err := db.queryRow("SELECT EXISTS("+
 		"SELECT 1 FROM regstat.blobs "+
 		"WHERE digest = $1"+
 		")",
 		digest).Scan(&exists)
-	return exists
+	return exists, classify(err)
 }
 
 // PushBlob writes a blob to the database, or updates the pushed time of an existing one.
-func (db Database) PushBlob(blob *database.Blob) {
-	tx := db.conn.MustBegin()
+func (db Database) PushBlob(blob *database.Blob) error {
+	err := db.transact(func(tx *sqlx.Tx) {
+		pushBlob(blob, tx)
+	})
+	if err == nil {
+		log.Println("push blob", blob.Digest)
+	}
+	return err
+}
+
+func pushBlob(blob *database.Blob, tx *sqlx.Tx) {
 	tx.MustExec("INSERT INTO regstat.blobs "+
-		"(digest, pushed) "+
-		"VALUES ($1, $2) "+
+		"(digest, size, media_type, role, pushed) "+
+		"VALUES ($1, $2, $3, $4, $5) "+
 		"ON CONFLICT (digest) "+
 		"DO UPDATE SET "+
-		"pushed = $2",
-		blob.Digest, blob.Pushed)
-	tx.Commit()
-	log.Println("push blob", blob.Digest)
+		"size = COALESCE(EXCLUDED.size, blobs.size), "+
+		"media_type = COALESCE(EXCLUDED.media_type, blobs.media_type), "+
+		"role = COALESCE(EXCLUDED.role, blobs.role), "+
+		"pushed = $5",
+		blob.Digest, size(blob.Size), text(blob.MediaType), text(blob.Role), blob.Pushed)
+	pushLink(tx, "repository_blobs", blob.Repository, blob.Digest, blob.Pushed)
 }
 
-// PullBlob writes a blob to the database, or updates the pulled time of an existing one.
-func (db Database) PullBlob(blob *database.Blob) {
-	tx := db.conn.MustBegin()
-	pullBlob(blob, tx)
-	tx.Commit()
-	log.Println("pull blob", blob.Digest)
+// PullBlob writes a blob to the database, or updates the pulled time of an
+// existing one, and counts the pull.
+func (db Database) PullBlob(blob *database.Blob) error {
+	err := db.transact(func(tx *sqlx.Tx) {
+		pullBlob(blob, tx)
+		countPull(tx, "blobs", blob.Digest)
+	})
+	if err == nil {
+		log.Println("pull blob", blob.Digest)
+	}
+	return err
 }
 
 func pullBlob(blob *database.Blob, tx *sqlx.Tx) {
 	tx.MustExec("INSERT INTO regstat.blobs "+
-		"(digest, pushed, pulled) "+
-		"VALUES ($1, $2, $3) "+
+		"(digest, size, media_type, role, pushed, pulled) "+
+		"VALUES ($1, $2, $3, $4, $5, $6) "+
 		"ON CONFLICT (digest) "+
 		"DO UPDATE SET "+
-		"pulled = $3",
-		blob.Digest, blob.Pushed, blob.Pulled)
+		"size = COALESCE(EXCLUDED.size, blobs.size), "+
+		"media_type = COALESCE(EXCLUDED.media_type, blobs.media_type), "+
+		"role = COALESCE(EXCLUDED.role, blobs.role), "+
+		"pulled = GREATEST(blobs.pulled, EXCLUDED.pulled)",
+		blob.Digest, size(blob.Size), text(blob.MediaType), text(blob.Role), blob.Pushed, blob.Pulled)
+	pullLink(tx, "repository_blobs", blob.Repository, blob.Digest, blob.Pushed, blob.Pulled)
 }
 
-// DeleteBlob deletes a blob from the database, moving the existing entry to the deleted_blobs table.
-func (db Database) DeleteBlob(digest string) {
-	tx := db.conn.MustBegin()
-	tx.MustExec("INSERT INTO regstat.deleted_blobs "+
-		"SELECT digest, pushed, pulled, NOW() FROM regstat.blobs "+
-		"WHERE digest = $1 "+
-		"ON CONFLICT (digest) "+
-		"DO UPDATE SET "+
-		"deleted = NOW()",
-		digest)
-	tx.MustExec("INSERT INTO regstat.deleted_manifest_blob "+
-		"SELECT manifest_digest, blob_digest FROM regstat.manifest_blob "+
-		"WHERE blob_digest = $1 "+
-		"ON CONFLICT (manifest_digest, blob_digest) "+
-		"DO NOTHING",
-		digest)
-	tx.MustExec("DELETE FROM regstat.manifest_blob "+
-		"WHERE blob_digest = $1",
-		digest)
-	tx.MustExec("DELETE FROM regstat.blobs "+
+// countPull increments the pull count of a blob or manifest. The blobs of a
+// pulled manifest aren't counted, as the client pulls those that it doesn't
+// already have, and the registry notifies those pulls separately.
+func countPull(tx *sqlx.Tx, table string, digest string) {
+	tx.MustExec("UPDATE regstat."+table+" "+
+		"SET pull_count = pull_count + 1 "+
 		"WHERE digest = $1",
 		digest)
-	tx.Commit()
-	log.Println("delete blob", digest)
 }
 
-// IsManifest determines whether the given digest belongs to a persisted manifest.
-func (db Database) IsManifest(digest string) bool {
+// pushLink records that a repository links a blob or manifest, in the
+// repository_blobs or repository_manifests table respectively, or updates the
+// pushed time of an existing link. Nothing is recorded if the repository
+// isn't known.
+func pushLink(tx *sqlx.Tx, table string, repository string, digest string, pushed time.Time) {
+	if repository == "" {
+		return
+	}
+	tx.MustExec("INSERT INTO regstat."+table+" "+
+		"(repository, digest, pushed) "+
+		"VALUES ($1, $2, $3) "+
+		"ON CONFLICT (repository, digest) "+
+		"DO UPDATE SET "+
+		"pushed = $3",
+		repository, digest, pushed)
+}
+
+// pullLink is like pushLink, but updates the pulled time of an existing link.
+// The pulled time never goes backwards, as the blobs of a manifest whose
+// enrichment is retried are recorded as pulled when the manifest was pushed.
+func pullLink(tx *sqlx.Tx, table string, repository string, digest string, pushed time.Time, pulled time.Time) {
+	if repository == "" {
+		return
+	}
+	tx.MustExec("INSERT INTO regstat."+table+" "+
+		"(repository, digest, pushed, pulled) "+
+		"VALUES ($1, $2, $3, $4) "+
+		"ON CONFLICT (repository, digest) "+
+		"DO UPDATE SET "+
+		"pulled = GREATEST("+table+".pulled, EXCLUDED.pulled)",
+		repository, digest, pushed, pulled)
+}
+
+// isLinked determines whether any repository links a blob or manifest.
+func isLinked(tx *sqlx.Tx, table string, digest string) bool {
+	var linked bool
+	err := tx.QueryRow("SELECT EXISTS("+
+		"SELECT 1 FROM regstat."+table+" "+
+		"WHERE digest = $1"+
+		")",
+		digest).Scan(&linked)
+	if err != nil {
+		panic(err)
+	}
+	return linked
+}
+
+// size converts a size of 0, which means that the size isn't known, to NULL
+// so that it doesn't overwrite a size that is known.
+func size(bytes int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: bytes, Valid: bytes > 0}
+}
+
+// text converts an empty string, which means that the value isn't known, to
+// NULL so that it doesn't overwrite a value that is known.
+func text(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// day is the date, in UTC, of a timestamp, as used by the tag_pulls table.
+func day(timestamp time.Time) string {
+	return timestamp.UTC().Format("2006-01-02")
+}
+
+// DeleteBlob removes the link between a repository and a blob. If no other
+// repository links the blob, or the repository isn't known, then the blob is
+// deleted from the database, moving the existing entry to the deleted_blobs table.
+func (db Database) DeleteBlob(repository string, digest string) error {
+	linked := false
+	err := db.transact(func(tx *sqlx.Tx) {
+		if repository != "" {
+			tx.MustExec("DELETE FROM regstat.repository_blobs "+
+				"WHERE repository = $1 AND digest = $2",
+				repository, digest)
+			tx.MustExec("DELETE FROM regstat.blob_mounts "+
+				"WHERE repository = $1 AND digest = $2",
+				repository, digest)
+			linked = isLinked(tx, "repository_blobs", digest)
+			if linked {
+				return
+			}
+		}
+		tx.MustExec("INSERT INTO regstat.deleted_blobs "+
+			"(digest, pushed, pulled, deleted, size, pull_count, media_type, role) "+
+			"SELECT digest, pushed, pulled, NOW(), size, pull_count, media_type, role FROM regstat.blobs "+
+			"WHERE digest = $1 "+
+			"ON CONFLICT (digest) "+
+			"DO UPDATE SET "+
+			"deleted = NOW()",
+			digest)
+		tx.MustExec("INSERT INTO regstat.deleted_manifest_blob "+
+			"SELECT manifest_digest, blob_digest FROM regstat.manifest_blob "+
+			"WHERE blob_digest = $1 "+
+			"ON CONFLICT (manifest_digest, blob_digest) "+
+			"DO NOTHING",
+			digest)
+		tx.MustExec("DELETE FROM regstat.manifest_blob "+
+			"WHERE blob_digest = $1",
+			digest)
+		tx.MustExec("DELETE FROM regstat.blob_mounts "+
+			"WHERE digest = $1",
+			digest)
+		tx.MustExec("DELETE FROM regstat.repository_blobs "+
+			"WHERE digest = $1",
+			digest)
+		tx.MustExec("DELETE FROM regstat.blobs "+
+			"WHERE digest = $1",
+			digest)
+	})
+	if err == nil && linked {
+		log.Println("unlink blob", repository, digest)
+	} else if err == nil {
+		log.Println("delete blob", digest)
+	}
+	return err
+}
+
+// MountBlob writes a blob to the database, or updates the pushed time of an existing
+// one, and records the repository from which it was mounted.
+func (db Database) MountBlob(mount *database.BlobMount) error {
+	blob := &mount.Blob
+	err := db.transact(func(tx *sqlx.Tx) {
+		pushBlob(blob, tx)
+		tx.MustExec("INSERT INTO regstat.blob_mounts "+
+			"(digest, repository, from_repository, mounted) "+
+			"VALUES ($1, $2, $3, $4) "+
+			"ON CONFLICT (digest, repository) "+
+			"DO UPDATE SET "+
+			"from_repository = $3, "+
+			"mounted = $4",
+			blob.Digest, mount.Repository, mount.FromRepository, blob.Pushed)
+	})
+	if err == nil {
+		log.Println("mount blob", blob.Digest, mount.FromRepository, "->", mount.Repository)
+	}
+	return err
+}
+
+// IsManifest determines whether the given digest belongs to a persisted
+// manifest. Within a transaction the manifest is locked until the transaction
+// ends, so that it can't be deleted in the meantime.
+func (db Database) IsManifest(digest string) (bool, error) {
 	var exists bool
-	db.conn.QueryRow("SELECT EXISTS("+
+	err := db.queryRow("SELECT EXISTS("+
 		"SELECT 1 FROM regstat.manifests "+
-		"WHERE digest = $1"+
+		"WHERE digest = $1 "+
+		"FOR UPDATE"+
 		")",
 		digest).Scan(&exists)
-	return exists
+	return exists, classify(err)
 }
 
 // PushManifest writes a manifest to the database, or updates the pushed time of an existing one.
-func (db Database) PushManifest(manifest *database.Manifest) {
-	tx := db.conn.MustBegin()
-	tx.MustExec("INSERT INTO regstat.manifests "+
-		"(digest, pushed)"+
-		"VALUES ($1, $2) "+
-		"ON CONFLICT (digest) "+
+func (db Database) PushManifest(manifest *database.Manifest) error {
+	err := db.transact(func(tx *sqlx.Tx) {
+		tx.MustExec("INSERT INTO regstat.manifests "+
+			"(digest, size, pushed, artifact_type, subject_digest)"+
+			"VALUES ($1, $2, $3, $4, $5) "+
+			"ON CONFLICT (digest) "+
+			"DO UPDATE SET "+
+			"size = COALESCE(EXCLUDED.size, manifests.size), "+
+			"pushed = $3, "+
+			"artifact_type = COALESCE(EXCLUDED.artifact_type, manifests.artifact_type), "+
+			"subject_digest = COALESCE(EXCLUDED.subject_digest, manifests.subject_digest)",
+			manifest.Digest, size(manifest.Size), manifest.Pushed, text(manifest.ArtifactType), text(manifest.Subject))
+		pushLink(tx, "repository_manifests", manifest.Repository, manifest.Digest, manifest.Pushed)
+		for _, blob := range manifest.Blobs {
+			pullBlob(&blob, tx)
+			tx.MustExec("INSERT INTO regstat.manifest_blob "+
+				"(manifest_digest, blob_digest)"+
+				"VALUES ($1, $2) "+
+				"ON CONFLICT (manifest_digest, blob_digest) "+
+				"DO NOTHING",
+				manifest.Digest, blob.Digest)
+		}
+		for _, child := range manifest.Children {
+			// the registry only accepts an index once its children have been
+			// pushed, so this normally finds the child already present
+			tx.MustExec("INSERT INTO regstat.manifests "+
+				"(digest, size, pushed)"+
+				"VALUES ($1, $2, $3) "+
+				"ON CONFLICT (digest) "+
+				"DO UPDATE SET "+
+				"size = COALESCE(manifests.size, EXCLUDED.size)",
+				child.Digest, size(child.Size), manifest.Pushed)
+			if manifest.Repository != "" {
+				tx.MustExec("INSERT INTO regstat.repository_manifests "+
+					"(repository, digest, pushed) "+
+					"VALUES ($1, $2, $3) "+
+					"ON CONFLICT (repository, digest) "+
+					"DO NOTHING",
+					manifest.Repository, child.Digest, manifest.Pushed)
+			}
+			tx.MustExec("INSERT INTO regstat.manifest_children "+
+				"(parent_digest, child_digest, os, architecture, variant)"+
+				"VALUES ($1, $2, $3, $4, $5) "+
+				"ON CONFLICT (parent_digest, child_digest) "+
+				"DO UPDATE SET "+
+				"os = $3, "+
+				"architecture = $4, "+
+				"variant = $5",
+				manifest.Digest, child.Digest, child.Platform.OS, child.Platform.Architecture, child.Platform.Variant)
+		}
+		if manifest.Config != nil {
+			pushImageConfig(manifest.Digest, manifest.Config, tx)
+		}
+		if manifest.Metadata != nil {
+			pushArtifactMetadata(manifest.Digest, manifest.Metadata, tx)
+		}
+	})
+	if err == nil {
+		log.Println("push manifest", manifest.Digest, len(manifest.Blobs), len(manifest.Children))
+	}
+	return err
+}
+
+// pushImageConfig writes the details of a manifest's image config to the
+// database, replacing any that were recorded by an earlier push.
+func pushImageConfig(digest string, config *database.ImageConfig, tx *sqlx.Tx) {
+	tx.MustExec("INSERT INTO regstat.image_configs "+
+		"(manifest_digest, config_digest, os, architecture, variant, created, author, "+
+		"entrypoint, cmd, exposed_ports, history_length) "+
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8::jsonb, $9::jsonb, $10::jsonb, $11) "+
+		"ON CONFLICT (manifest_digest) "+
 		"DO UPDATE SET "+
-		"pushed = $2",
-		manifest.Digest, manifest.Pushed)
-	for _, blob := range manifest.Blobs {
-		pullBlob(&blob, tx)
-		tx.MustExec("INSERT INTO regstat.manifest_blob "+
-			"(manifest_digest, blob_digest)"+
-			"VALUES ($1, $2) "+
+		"config_digest = $2, "+
+		"os = $3, "+
+		"architecture = $4, "+
+		"variant = $5, "+
+		"created = $6, "+
+		"author = $7, "+
+		"entrypoint = $8::jsonb, "+
+		"cmd = $9::jsonb, "+
+		"exposed_ports = $10::jsonb, "+
+		"history_length = $11",
+		digest, config.Digest, config.Platform.OS, config.Platform.Architecture, config.Platform.Variant,
+		sql.NullTime{Time: config.Created, Valid: !config.Created.IsZero()}, config.Author,
+		jsonArray(config.Entrypoint), jsonArray(config.Cmd), jsonArray(config.ExposedPorts), config.HistoryLength)
+}
+
+// pushArtifactMetadata writes the metadata extracted from an artifact to the
+// database, replacing any that was extracted from an earlier push.
+func pushArtifactMetadata(digest string, metadata []database.ArtifactMetadata, tx *sqlx.Tx) {
+	tx.MustExec("DELETE FROM regstat.artifact_metadata "+
+		"WHERE manifest_digest = $1",
+		digest)
+	for seq, item := range metadata {
+		tx.MustExec("INSERT INTO regstat.artifact_metadata "+
+			"(manifest_digest, seq, artifact_type, name, value) "+
+			"VALUES ($1, $2, $3, $4, $5)",
+			digest, seq, item.Type, item.Name, item.Value)
+	}
+}
+
+// jsonArray converts a list of strings to a JSON array, or to NULL if there
+// is no list.
+func jsonArray(values []string) sql.NullString {
+	if values == nil {
+		return sql.NullString{}
+	}
+	array, err := json.Marshal(values)
+	if err != nil {
+		panic(err)
+	}
+	return sql.NullString{String: string(array), Valid: true}
+}
+
+// PullManifest writes a manifest to the database, or updates the pulled time of an existing one.
+func (db Database) PullManifest(manifest *database.Manifest) error {
+	err := db.transact(func(tx *sqlx.Tx) {
+		tx.MustExec("INSERT INTO regstat.manifests "+
+			"(digest, size, pushed, pulled)"+
+			"VALUES ($1, $2, $3, $4) "+
+			"ON CONFLICT (digest) "+
+			"DO UPDATE SET "+
+			"size = COALESCE(EXCLUDED.size, manifests.size), "+
+			"pulled = $4",
+			manifest.Digest, size(manifest.Size), manifest.Pushed, manifest.Pulled)
+		countPull(tx, "manifests", manifest.Digest)
+		tx.MustExec("UPDATE regstat.blobs b "+
+			"SET pulled = $1 "+
+			"FROM regstat.manifest_blob mb "+
+			"WHERE b.digest = mb.blob_digest AND mb.manifest_digest = $2",
+			manifest.Pulled, manifest.Digest)
+		// a pull of a manifest list or image index counts as a pull of each of
+		// its platform manifests, and so of their blobs
+		tx.MustExec("UPDATE regstat.manifests m "+
+			"SET pulled = $1 "+
+			"FROM regstat.manifest_children mc "+
+			"WHERE m.digest = mc.child_digest AND mc.parent_digest = $2",
+			manifest.Pulled, manifest.Digest)
+		tx.MustExec("UPDATE regstat.blobs b "+
+			"SET pulled = $1 "+
+			"FROM regstat.manifest_blob mb, regstat.manifest_children mc "+
+			"WHERE b.digest = mb.blob_digest AND mb.manifest_digest = mc.child_digest AND mc.parent_digest = $2",
+			manifest.Pulled, manifest.Digest)
+		if manifest.Repository == "" {
+			return
+		}
+		pullLink(tx, "repository_manifests", manifest.Repository, manifest.Digest, manifest.Pushed, manifest.Pulled)
+		tx.MustExec("UPDATE regstat.repository_manifests rm "+
+			"SET pulled = $1 "+
+			"FROM regstat.manifest_children mc "+
+			"WHERE rm.digest = mc.child_digest AND mc.parent_digest = $2 AND rm.repository = $3",
+			manifest.Pulled, manifest.Digest, manifest.Repository)
+		tx.MustExec("UPDATE regstat.repository_blobs rb "+
+			"SET pulled = $1 "+
+			"FROM regstat.manifest_blob mb "+
+			"WHERE rb.digest = mb.blob_digest AND rb.repository = $3 AND ("+
+			"mb.manifest_digest = $2 OR mb.manifest_digest IN ("+
+			"SELECT child_digest FROM regstat.manifest_children WHERE parent_digest = $2"+
+			"))",
+			manifest.Pulled, manifest.Digest, manifest.Repository)
+	})
+	if err == nil {
+		log.Println("pull manifest", manifest.Digest)
+	}
+	return err
+}
+
+// DeleteManifest removes the link between a repository and a manifest, moving the
+// repository's tags of the manifest to the deleted_tags table. If no other
+// repository links the manifest, or the repository isn't known, then the
+// manifest and all of its tags are deleted from the database, moving the
+// existing entries to the deleted_manifests and deleted_tags tables. Any links
+// between the manifest and a manifest list or index, whether as parent or as
+// child, are moved to the deleted_manifest_children table.
+func (db Database) DeleteManifest(repository string, digest string) error {
+	linked := false
+	err := db.transact(func(tx *sqlx.Tx) {
+		if repository != "" {
+			deleteTags(tx, "manifest_digest = $1 AND repository = $2", digest, repository)
+			tx.MustExec("DELETE FROM regstat.repository_manifests "+
+				"WHERE repository = $1 AND digest = $2",
+				repository, digest)
+			linked = isLinked(tx, "repository_manifests", digest)
+			if linked {
+				return
+			}
+		}
+		tx.MustExec("INSERT INTO regstat.deleted_manifests "+
+			"(digest, pushed, pulled, deleted, size, pull_count, artifact_type, subject_digest) "+
+			"SELECT digest, pushed, pulled, NOW(), size, pull_count, artifact_type, subject_digest FROM regstat.manifests "+
+			"WHERE digest = $1 "+
+			"ON CONFLICT (digest) "+
+			"DO UPDATE SET "+
+			"deleted = NOW()",
+			digest)
+		deleteTags(tx, "manifest_digest = $1", digest)
+		tx.MustExec("INSERT INTO regstat.deleted_manifest_blob "+
+			"SELECT manifest_digest, blob_digest FROM regstat.manifest_blob "+
+			"WHERE manifest_digest = $1 "+
 			"ON CONFLICT (manifest_digest, blob_digest) "+
 			"DO NOTHING",
-			manifest.Digest, blob.Digest)
+			digest)
+		tx.MustExec("INSERT INTO regstat.deleted_manifest_children "+
+			"SELECT parent_digest, child_digest, os, architecture, variant FROM regstat.manifest_children "+
+			"WHERE parent_digest = $1 OR child_digest = $1 "+
+			"ON CONFLICT (parent_digest, child_digest) "+
+			"DO NOTHING",
+			digest)
+		tx.MustExec("DELETE FROM regstat.manifest_children "+
+			"WHERE parent_digest = $1 OR child_digest = $1",
+			digest)
+		tx.MustExec("DELETE FROM regstat.manifest_blob "+
+			"WHERE manifest_digest = $1",
+			digest)
+		tx.MustExec("DELETE FROM regstat.repository_manifests "+
+			"WHERE digest = $1",
+			digest)
+		tx.MustExec("DELETE FROM regstat.image_configs "+
+			"WHERE manifest_digest = $1",
+			digest)
+		tx.MustExec("DELETE FROM regstat.artifact_metadata "+
+			"WHERE manifest_digest = $1",
+			digest)
+		tx.MustExec("DELETE FROM regstat.pending_enrichments "+
+			"WHERE digest = $1",
+			digest)
+		tx.MustExec("DELETE FROM regstat.manifests "+
+			"WHERE digest = $1",
+			digest)
+	})
+	if err == nil && linked {
+		log.Println("unlink manifest", repository, digest)
+	} else if err == nil {
+		log.Println("delete manifest", digest)
 	}
-	tx.Commit()
-	log.Println("push manifest", manifest.Digest, len(manifest.Blobs))
+	return err
 }
 
-// PullManifest writes a manifest to the database, or updates the pulled time of an existing one.
-func (db Database) PullManifest(manifest *database.Manifest) {
-	tx := db.conn.MustBegin()
-	tx.MustExec("INSERT INTO regstat.manifests "+
-		"(digest, pushed, pulled)"+
-		"VALUES ($1, $2, $3) "+
-		"ON CONFLICT (digest) "+
-		"DO UPDATE SET "+
-		"pulled = $3",
-		manifest.Digest, manifest.Pushed, manifest.Pulled)
-	tx.MustExec("UPDATE regstat.blobs b "+
-		"SET pulled = $1 "+
-		"FROM regstat.manifest_blob mb "+
-		"WHERE b.digest = mb.blob_digest AND mb.manifest_digest = $2",
-		manifest.Pulled, manifest.Digest)
-	tx.Commit()
-	log.Println("pull manifest", manifest.Digest)
-}
-
-// DeleteManifest deletes a manifest and associated tag from the database, moving the
-// existing entries to the deleted_manifests and deleted_tags tables.
-func (db Database) DeleteManifest(digest string) {
-	tx := db.conn.MustBegin()
-	tx.MustExec("INSERT INTO regstat.deleted_manifests "+
-		"SELECT digest, pushed, pulled, NOW() FROM regstat.manifests "+
-		"WHERE digest = $1 "+
-		"ON CONFLICT (digest) "+
-		"DO UPDATE SET "+
-		"deleted = NOW()",
-		digest)
+// deleteTags moves the tags that match the where clause to the deleted_tags
+// table, which keeps their total pull counts but not their daily ones.
+func deleteTags(tx *sqlx.Tx, where string, args ...interface{}) {
 	tx.MustExec("INSERT INTO regstat.deleted_tags "+
-		"SELECT name, registry, repository, tag, manifest_digest, pushed, pulled, NOW() FROM regstat.tags "+
-		"WHERE manifest_digest = $1 "+
+		"(name, registry, repository, tag, manifest_digest, pushed, pulled, deleted, pull_count) "+
+		"SELECT name, registry, repository, tag, manifest_digest, pushed, pulled, NOW(), pull_count FROM regstat.tags "+
+		"WHERE "+where+" "+
 		"ON CONFLICT (name) "+
 		"DO UPDATE SET "+
+		"manifest_digest = EXCLUDED.manifest_digest, "+
+		"pushed = EXCLUDED.pushed, "+
+		"pulled = EXCLUDED.pulled, "+
+		"pull_count = EXCLUDED.pull_count, "+
 		"deleted = NOW()",
-		digest)
-	tx.MustExec("INSERT INTO regstat.deleted_manifest_blob "+
-		"SELECT manifest_digest, blob_digest FROM regstat.manifest_blob "+
-		"WHERE manifest_digest = $1 "+
-		"ON CONFLICT (manifest_digest, blob_digest) "+
-		"DO NOTHING",
-		digest)
+		args...)
+	tx.MustExec("DELETE FROM regstat.tag_pulls "+
+		"WHERE name IN (SELECT name FROM regstat.tags WHERE "+where+")",
+		args...)
 	tx.MustExec("DELETE FROM regstat.tags "+
-		"WHERE manifest_digest = $1",
-		digest)
-	tx.MustExec("DELETE FROM regstat.manifest_blob "+
-		"WHERE manifest_digest = $1",
-		digest)
-	tx.MustExec("DELETE FROM regstat.manifests "+
-		"WHERE digest = $1",
-		digest)
-	tx.Commit()
-	log.Println("delete manifest", digest)
+		"WHERE "+where,
+		args...)
 }
 
 // PushTag writes a tag to the database, or updates the pushed time of an existing one.
-func (db Database) PushTag(tag *database.Tag) {
-	tx := db.conn.MustBegin()
-	tx.MustExec("INSERT INTO regstat.tags "+
-		"(name, registry, repository, tag, manifest_digest, pushed) "+
-		"VALUES ($1, $2, $3, $4, $5, $6) "+
-		"ON CONFLICT (name) "+
-		"DO UPDATE SET "+
-		"manifest_digest = $5, "+
-		"pushed = $6",
-		tag.Name, tag.Registry, tag.Repository, tag.Tag, tag.Manifest.Digest, tag.Pushed)
-	tx.Commit()
-	log.Println("push tag", tag.Name)
+func (db Database) PushTag(tag *database.Tag) error {
+	err := db.transact(func(tx *sqlx.Tx) {
+		tx.MustExec("INSERT INTO regstat.tags "+
+			"(name, registry, repository, tag, manifest_digest, pushed) "+
+			"VALUES ($1, $2, $3, $4, $5, $6) "+
+			"ON CONFLICT (name) "+
+			"DO UPDATE SET "+
+			"manifest_digest = $5, "+
+			"pushed = $6",
+			tag.Name, tag.Registry, tag.Repository, tag.Tag, tag.Manifest.Digest, tag.Pushed)
+	})
+	if err == nil {
+		log.Println("push tag", tag.Name)
+	}
+	return err
 }
 
-// PullTag writes a tag to the database, or updates the pulled time of an existing one.
-func (db Database) PullTag(tag *database.Tag) {
-	tx := db.conn.MustBegin()
-	tx.MustExec("INSERT INTO regstat.tags "+
-		"(name, registry, repository, tag, manifest_digest, pushed, pulled) "+
-		"VALUES ($1, $2, $3, $4, $5, $6, $7) "+
-		"ON CONFLICT (name) "+
-		"DO UPDATE SET "+
-		"pulled = $7",
-		tag.Name, tag.Registry, tag.Repository, tag.Tag, tag.Manifest.Digest, tag.Pushed, tag.Pulled)
-	tx.Commit()
-	log.Println("pull tag", tag.Name)
+// PullTag writes a tag to the database, or updates the pulled time of an
+// existing one, and counts the pull, both in total and on the day of the pull.
+func (db Database) PullTag(tag *database.Tag) error {
+	err := db.transact(func(tx *sqlx.Tx) {
+		tx.MustExec("INSERT INTO regstat.tags "+
+			"(name, registry, repository, tag, manifest_digest, pushed, pulled, pull_count) "+
+			"VALUES ($1, $2, $3, $4, $5, $6, $7, 1) "+
+			"ON CONFLICT (name) "+
+			"DO UPDATE SET "+
+			"pulled = $7, "+
+			"pull_count = tags.pull_count + 1",
+			tag.Name, tag.Registry, tag.Repository, tag.Tag, tag.Manifest.Digest, tag.Pushed, tag.Pulled)
+		tx.MustExec("INSERT INTO regstat.tag_pulls "+
+			"(name, day, pulls) "+
+			"VALUES ($1, $2, 1) "+
+			"ON CONFLICT (name, day) "+
+			"DO UPDATE SET "+
+			"pulls = tag_pulls.pulls + 1",
+			tag.Name, day(tag.Pulled))
+	})
+	if err == nil {
+		log.Println("pull tag", tag.Name)
+	}
+	return err
+}
+
+// PullManifestTags records a pull of a manifest by digest as a pull of each
+// tag that currently refers to the manifest. The given tag names the
+// repository, without a tag, and so restricts the tags to those of the
+// repository in that registry or its equivalents.
+func (db Database) PullManifestTags(tag *database.Tag) error {
+	var pulled int64
+	err := db.transact(func(tx *sqlx.Tx) {
+		result := tx.MustExec("WITH pulled AS ("+
+			"UPDATE regstat.tags "+
+			"SET pulled = $3, pull_count = pull_count + 1 "+
+			"WHERE manifest_digest = $2 AND left(name, length($1)) = $1 "+
+			"RETURNING name"+
+			") "+
+			"INSERT INTO regstat.tag_pulls "+
+			"(name, day, pulls) "+
+			"SELECT name, $4, 1 FROM pulled "+
+			"ON CONFLICT (name, day) "+
+			"DO UPDATE SET "+
+			"pulls = tag_pulls.pulls + 1",
+			tag.Name+":", tag.Manifest.Digest, tag.Pulled, day(tag.Pulled))
+		pulled, _ = result.RowsAffected()
+	})
+	if err == nil {
+		log.Println("pull tags of manifest", tag.Name, tag.Manifest.Digest, pulled)
+	}
+	return err
+}
+
+// DeleteTag deletes a tag from the database, moving the existing entry to the
+// deleted_tags table. The tag's manifest is left in place.
+func (db Database) DeleteTag(name string) error {
+	err := db.transact(func(tx *sqlx.Tx) {
+		deleteTags(tx, "name = $1", name)
+	})
+	if err == nil {
+		log.Println("delete tag", name)
+	}
+	return err
+}
+
+// IsEventProcessed determines whether the event with the given ID has been
+// recorded as processed, and not yet expired.
+func (db Database) IsEventProcessed(id string) (bool, error) {
+	var exists bool
+	err := db.queryRow("SELECT EXISTS("+
+		"SELECT 1 FROM regstat.processed_events "+
+		"WHERE id = $1"+
+		")",
+		id).Scan(&exists)
+	return exists, classify(err)
+}
+
+// MarkEventProcessed records that the event with the given ID has been
+// processed, returning false if it had already been recorded.
+func (db Database) MarkEventProcessed(id string) (bool, error) {
+	var inserted bool
+	err := db.transact(func(tx *sqlx.Tx) {
+		result := tx.MustExec("INSERT INTO regstat.processed_events "+
+			"(id, processed) "+
+			"VALUES ($1, NOW()) "+
+			"ON CONFLICT (id) "+
+			"DO NOTHING",
+			id)
+		rows, err := result.RowsAffected()
+		if err != nil {
+			panic(err)
+		}
+		inserted = rows == 1
+	})
+	return inserted, err
+}
+
+// ExpireProcessedEvents forgets the IDs of events that were processed more
+// than ttl ago, returning the number of IDs removed.
+func (db Database) ExpireProcessedEvents(ttl time.Duration) (int64, error) {
+	var expired int64
+	err := db.transact(func(tx *sqlx.Tx) {
+		result := tx.MustExec("DELETE FROM regstat.processed_events "+
+			"WHERE processed < NOW() - $1 * INTERVAL '1 second'",
+			ttl.Seconds())
+		expired, _ = result.RowsAffected()
+	})
+	if err == nil && expired > 0 {
+		log.Println("expired processed events", expired)
+	}
+	return expired, err
 }
@@ -11,6 +11,10 @@
 package postgres
 
 import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -52,6 +56,12 @@ func TestCreateSchemaIfNecessary(t *testing.T) {
 	if !blobTableExists {
 		t.Error("expected blobs table to exist")
 	}
+	if err := db.Ping(); err != nil {
+		t.Error("expected database to be reachable", err)
+	}
+	if err := db.CheckSchema(); err != nil {
+		t.Error("expected schema to be at the current version", err)
+	}
 }
 
 func TestPushPullDelete(t *testing.T) {
@@ -75,11 +85,14 @@ func TestPushPullDelete(t *testing.T) {
 	})
 
 	t.Run("is blob", func(t *testing.T) {
-		isBlob := db.IsBlob(testBlob.Digest)
+		isBlob, err := db.IsBlob(testBlob.Digest)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
 		if !isBlob {
 			t.Error("expected pushed blob to be a blob")
 		}
-		isBlob = db.IsBlob("fake1234")
+		isBlob, _ = db.IsBlob("fake1234")
 		if isBlob {
 			t.Error("expected fake blob to not be a blob")
 		}
@@ -126,11 +139,14 @@ func TestPushPullDelete(t *testing.T) {
 	})
 
 	t.Run("is manifest", func(t *testing.T) {
-		isManifest := db.IsManifest(testManifest.Digest)
+		isManifest, err := db.IsManifest(testManifest.Digest)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
 		if !isManifest {
 			t.Error("expected pushed manifest to be a manifest")
 		}
-		isManifest = db.IsManifest("fake1234")
+		isManifest, _ = db.IsManifest("fake1234")
 		if isManifest {
 			t.Error("expected fake manifest to not be a manifest")
 		}
@@ -190,8 +206,8 @@ func TestPushPullDelete(t *testing.T) {
 	})
 
 	t.Run("delete blob", func(t *testing.T) {
-		db.DeleteBlob(testBlob.Digest)
-		if db.IsBlob(testBlob.Digest) {
+		db.DeleteBlob("", testBlob.Digest)
+		if isBlob, _ := db.IsBlob(testBlob.Digest); isBlob {
 			t.Error("expected blob to have been deleted")
 		}
 		var deletedBlobExists bool
@@ -264,8 +280,8 @@ func TestPushPullDelete(t *testing.T) {
 	})
 
 	t.Run("delete manifest", func(t *testing.T) {
-		db.DeleteManifest(testManifest.Digest)
-		if db.IsManifest(testManifest.Digest) {
+		db.DeleteManifest("", testManifest.Digest)
+		if isManifest, _ := db.IsManifest(testManifest.Digest); isManifest {
 			t.Error("expected manifest to have been deleted")
 		}
 		var deletedManifestExists bool
@@ -324,3 +340,763 @@ func TestPushPullDelete(t *testing.T) {
 		}
 	})
 }
+
+func TestProcessedEvents(t *testing.T) {
+	createTestDatabase()
+
+	t.Run("mark event processed", func(t *testing.T) {
+		processed, err := db.IsEventProcessed("event1234")
+		if err != nil || processed {
+			t.Fatal("expected event to not have been processed", err)
+		}
+		isNew, err := db.MarkEventProcessed("event1234")
+		if err != nil || !isNew {
+			t.Fatal("expected event to be new", err)
+		}
+		processed, err = db.IsEventProcessed("event1234")
+		if err != nil || !processed {
+			t.Fatal("expected event to have been processed", err)
+		}
+		isNew, err = db.MarkEventProcessed("event1234")
+		if err != nil || isNew {
+			t.Fatal("expected event to have already been processed", err)
+		}
+	})
+
+	t.Run("rolled back transaction", func(t *testing.T) {
+		err := db.Transaction(func(txdb database.Database) error {
+			txdb.MarkEventProcessed("event5678")
+			return errors.New("oops")
+		})
+		if err == nil || err.Error() != "oops" {
+			t.Fatalf("expected oops; got %v", err)
+		}
+		isNew, _ := db.MarkEventProcessed("event5678")
+		if !isNew {
+			t.Fatal("expected event to have been rolled back")
+		}
+	})
+
+	t.Run("runtime error", func(t *testing.T) {
+		defer func() {
+			if _, ok := recover().(runtime.Error); !ok {
+				t.Error("expected runtime error to be raised again")
+			}
+			isNew, _ := db.MarkEventProcessed("event9012")
+			if !isNew {
+				t.Error("expected event to have been rolled back")
+			}
+		}()
+		db.Transaction(func(txdb database.Database) error {
+			txdb.MarkEventProcessed("event9012")
+			var manifest *database.Manifest
+			return txdb.PushManifest(manifest)
+		})
+	})
+
+	t.Run("expire processed events", func(t *testing.T) {
+		time.Sleep(time.Second)
+		expired, err := db.ExpireProcessedEvents(time.Millisecond)
+		if err != nil || expired < 2 {
+			t.Fatal("expected processed events to have expired", expired, err)
+		}
+		isNew, _ := db.MarkEventProcessed("event1234")
+		if !isNew {
+			t.Fatal("expected expired event to be new")
+		}
+	})
+}
+
+func TestManifestList(t *testing.T) {
+	createTestDatabase()
+	conn := db.GetConnection()
+
+	pushTime := time.Now()
+	testBlob := database.Blob{Digest: "blob5678", Pushed: pushTime}
+	testChild := database.Manifest{Digest: "child5678", Pushed: pushTime, Blobs: []database.Blob{testBlob}}
+	testList := database.Manifest{Digest: "list5678", Pushed: pushTime, Children: []database.ChildManifest{
+		{Digest: "child5678", Platform: database.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+	}}
+
+	t.Run("push manifest list", func(t *testing.T) {
+		db.PushManifest(&testChild)
+		err := db.PushManifest(&testList)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		var architecture, variant string
+		conn.QueryRow("SELECT architecture, variant FROM regstat.manifest_children "+
+			"WHERE parent_digest = $1 AND child_digest = $2",
+			"list5678", "child5678").Scan(&architecture, &variant)
+		if architecture != "arm" || variant != "v7" {
+			t.Fatal("expected manifest_children to record the platform", architecture, variant)
+		}
+	})
+
+	t.Run("pull manifest list", func(t *testing.T) {
+		testList.Pulled = time.Now().Truncate(time.Second)
+		db.PullManifest(&testList)
+		var childHasBeenPulled bool
+		conn.QueryRow("SELECT EXISTS("+
+			"SELECT 1 FROM regstat.manifests "+
+			"WHERE digest = $1 AND pulled = $2"+
+			")",
+			"child5678", testList.Pulled).Scan(&childHasBeenPulled)
+		if !childHasBeenPulled {
+			t.Fatal("expected child manifest to have been pulled")
+		}
+		var blobHasBeenPulled bool
+		conn.QueryRow("SELECT EXISTS("+
+			"SELECT 1 FROM regstat.blobs "+
+			"WHERE digest = $1 AND pulled = $2"+
+			")",
+			"blob5678", testList.Pulled).Scan(&blobHasBeenPulled)
+		if !blobHasBeenPulled {
+			t.Fatal("expected child manifest's blob to have been pulled")
+		}
+	})
+
+	t.Run("delete manifest list", func(t *testing.T) {
+		err := db.DeleteManifest("", testList.Digest)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		var deletedChildExists bool
+		conn.QueryRow("SELECT EXISTS("+
+			"SELECT 1 FROM regstat.deleted_manifest_children "+
+			"WHERE parent_digest = $1"+
+			")",
+			"list5678").Scan(&deletedChildExists)
+		if !deletedChildExists {
+			t.Fatal("expected manifest_children to have been written to deleted table")
+		}
+		if isManifest, _ := db.IsManifest(testChild.Digest); !isManifest {
+			t.Error("expected child manifest to remain")
+		}
+		db.DeleteManifest("", testChild.Digest)
+	})
+}
+
+func TestStorage(t *testing.T) {
+	createTestDatabase()
+
+	pushTime := time.Now()
+	shared := database.Blob{Digest: "sharedblob", Size: 1000, Pushed: pushTime}
+	manifestA := database.Manifest{Digest: "storagemanA", Size: 10, Pushed: pushTime, Blobs: []database.Blob{
+		shared, {Digest: "blobA", Size: 200, Pushed: pushTime},
+	}}
+	// the registry doesn't store foreign layers, so they count towards no usage
+	foreign := database.Blob{Digest: "foreignblob", Size: 5000, Role: "foreign", Pushed: pushTime}
+	manifestB := database.Manifest{Digest: "storagemanB", Size: 20, Pushed: pushTime, Blobs: []database.Blob{
+		shared, {Digest: "blobB", Size: 300, Pushed: pushTime}, foreign,
+	}}
+	db.PushManifest(&manifestA)
+	db.PushManifest(&manifestB)
+	db.PushTag(&database.Tag{Name: "storage/a:1", Registry: "storage", Repository: "a", Tag: "1", Manifest: manifestA, Pushed: pushTime})
+	db.PushTag(&database.Tag{Name: "storage/a:2", Registry: "storage", Repository: "a", Tag: "2", Manifest: manifestA, Pushed: pushTime})
+	db.PushTag(&database.Tag{Name: "storage/b:1", Registry: "storage", Repository: "b", Tag: "1", Manifest: manifestB, Pushed: pushTime})
+	// repository a is also tagged under another name for the registry
+	db.PushTag(&database.Tag{Name: "storage-alias/a:3", Registry: "storage-alias", Repository: "a", Tag: "3", Manifest: manifestA, Pushed: pushTime})
+	// an untagged signature of manifest A, which is linked to repository a
+	signature := database.Manifest{Digest: "storagesig", Repository: "a", Size: 5, Pushed: pushTime, Subject: "storagemanA",
+		Blobs: []database.Blob{{Digest: "sigblob", Repository: "a", Size: 50, Pushed: pushTime}}}
+	db.PushManifest(&signature)
+
+	t.Run("totals", func(t *testing.T) {
+		totals, err := db.StorageTotals()
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		if totals.BlobBytes < 1500 || totals.ManifestBytes < 30 || totals.Bytes != totals.BlobBytes+totals.ManifestBytes {
+			t.Error("unexpected totals", totals)
+		}
+		if totals.ForeignBytes < 5000 {
+			t.Error("expected foreign bytes to be counted separately", totals)
+		}
+	})
+
+	t.Run("repositories", func(t *testing.T) {
+		usages, err := db.RepositoryStorage()
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		found := map[string]database.StorageUsage{}
+		for _, usage := range usages {
+			if strings.HasPrefix(usage.Registry, "storage") {
+				found[usage.Registry+"/"+usage.Repository] = usage
+			}
+		}
+		// the shared blob is counted by both repositories, but is exclusive to
+		// neither; the untagged signature counts towards a, once
+		if found["storage/a"].Bytes != 1265 || found["storage/a"].ExclusiveBytes != 265 {
+			t.Error("unexpected usage of a", found["storage/a"])
+		}
+		if found["storage-alias/a"].Bytes != 1210 || found["storage-alias/a"].ExclusiveBytes != 210 {
+			t.Error("unexpected usage of a under the other name", found["storage-alias/a"])
+		}
+		if found["storage/b"].Bytes != 1320 || found["storage/b"].ExclusiveBytes != 320 {
+			t.Error("unexpected usage of b", found["storage/b"])
+		}
+	})
+
+	t.Run("tags", func(t *testing.T) {
+		usages, err := db.TagStorage("storage", "a")
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		if len(usages) != 2 {
+			t.Fatal("expected 2 tags", usages)
+		}
+		// both tags refer to the same manifest, so deleting either frees nothing
+		for _, usage := range usages {
+			if usage.Bytes != 1210 || usage.ExclusiveBytes != 0 {
+				t.Error("unexpected usage", usage)
+			}
+		}
+	})
+
+	db.DeleteTag("storage-alias/a:3")
+	db.DeleteManifest("", signature.Digest)
+	db.DeleteManifest("", manifestA.Digest)
+	db.DeleteManifest("", manifestB.Digest)
+}
+
+func TestMountBlob(t *testing.T) {
+	createTestDatabase()
+	conn := db.GetConnection()
+
+	mount := database.BlobMount{
+		Blob:           database.Blob{Digest: "mountblob", Size: 42, Pushed: time.Now()},
+		Repository:     "to",
+		FromRepository: "from",
+	}
+	err := db.MountBlob(&mount)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if isBlob, _ := db.IsBlob("mountblob"); !isBlob {
+		t.Fatal("expected mounted blob to exist")
+	}
+	var fromRepository string
+	conn.QueryRow("SELECT from_repository FROM regstat.blob_mounts "+
+		"WHERE digest = $1 AND repository = $2",
+		"mountblob", "to").Scan(&fromRepository)
+	if fromRepository != "from" {
+		t.Fatal("expected blob mount to record the source repository", fromRepository)
+	}
+	err = db.DeleteBlob("", "mountblob")
+	if err != nil {
+		t.Fatal("expected mounted blob to be deletable", err)
+	}
+}
+
+func TestDeleteTag(t *testing.T) {
+	createTestDatabase()
+	conn := db.GetConnection()
+
+	pushTime := time.Now()
+	testManifest := database.Manifest{Digest: "tagdeleteman", Pushed: pushTime}
+	db.PushManifest(&testManifest)
+	db.PushTag(&database.Tag{Name: "reg1/rep1:gone", Registry: "reg1", Repository: "rep1", Tag: "gone", Manifest: testManifest, Pushed: pushTime})
+
+	err := db.DeleteTag("reg1/rep1:gone")
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	var tagExists bool
+	conn.QueryRow("SELECT EXISTS("+
+		"SELECT 1 FROM regstat.tags "+
+		"WHERE name = $1"+
+		")",
+		"reg1/rep1:gone").Scan(&tagExists)
+	if tagExists {
+		t.Fatal("expected tag to not exist")
+	}
+	var deletedTagExists bool
+	conn.QueryRow("SELECT EXISTS("+
+		"SELECT 1 FROM regstat.deleted_tags "+
+		"WHERE name = $1 AND manifest_digest = $2"+
+		")",
+		"reg1/rep1:gone", "tagdeleteman").Scan(&deletedTagExists)
+	if !deletedTagExists {
+		t.Fatal("expected tag to have been written to deleted table")
+	}
+	if isManifest, _ := db.IsManifest("tagdeleteman"); !isManifest {
+		t.Error("expected manifest to remain")
+	}
+	db.DeleteManifest("", "tagdeleteman")
+}
+
+func TestRepositoryLinks(t *testing.T) {
+	createTestDatabase()
+
+	pushTime := time.Now()
+	for _, repository := range []string{"links-a", "links-b"} {
+		manifest := database.Manifest{Digest: "linkman", Repository: repository, Pushed: pushTime}
+		manifest.Blobs = []database.Blob{{Digest: "linkblob", Repository: repository, Pushed: pushTime}}
+		err := db.PushManifest(&manifest)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	t.Run("unlink", func(t *testing.T) {
+		err := db.DeleteManifest("links-a", "linkman")
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		err = db.DeleteBlob("links-a", "linkblob")
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		// still linked by the other repository
+		if isManifest, _ := db.IsManifest("linkman"); !isManifest {
+			t.Error("expected manifest to remain")
+		}
+		if isBlob, _ := db.IsBlob("linkblob"); !isBlob {
+			t.Error("expected blob to remain")
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		err := db.DeleteManifest("links-b", "linkman")
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		err = db.DeleteBlob("links-b", "linkblob")
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		if isManifest, _ := db.IsManifest("linkman"); isManifest {
+			t.Error("expected manifest to be deleted")
+		}
+		if isBlob, _ := db.IsBlob("linkblob"); isBlob {
+			t.Error("expected blob to be deleted")
+		}
+	})
+}
+
+func TestEvents(t *testing.T) {
+	createTestDatabase()
+
+	// a unique actor keeps the events of earlier test runs out of the results
+	actor := fmt.Sprintf("audit-%d", time.Now().UnixNano())
+	occurred := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	for i, action := range []string{"push", "pull", "delete"} {
+		err := db.RecordEvent(&database.Event{
+			ID:         fmt.Sprintf("%s-%d", actor, i),
+			Action:     action,
+			Timestamp:  occurred.Add(time.Duration(i) * time.Hour),
+			Repository: "audited",
+			Tag:        "1",
+			Actor:      actor,
+			Size:       int64(i),
+		})
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	events, err := db.Events(database.EventQuery{Actor: actor})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if len(events) != 3 || events[0].Action != "delete" || events[2].Action != "push" {
+		t.Fatal("expected 3 events, most recent first", events)
+	}
+
+	events, _ = db.Events(database.EventQuery{Actor: actor, Repository: "audited", Since: occurred.Add(time.Hour), Until: occurred.Add(2 * time.Hour)})
+	if len(events) != 1 || events[0].Action != "pull" {
+		t.Error("expected the pull event only", events)
+	}
+
+	events, _ = db.Events(database.EventQuery{Actor: actor, Limit: 1})
+	if len(events) != 1 {
+		t.Error("expected 1 event", events)
+	}
+
+	events, err = db.Events(database.EventQuery{Actor: "nobody" + actor})
+	if err != nil || events == nil || len(events) != 0 {
+		t.Error("expected an empty list of events", events, err)
+	}
+}
+
+func TestPullCounts(t *testing.T) {
+	createTestDatabase()
+	conn := db.GetConnection()
+
+	pushTime := time.Now()
+	testBlob := database.Blob{Digest: "countblob", Pushed: pushTime, Pulled: pushTime}
+	testManifest := database.Manifest{Digest: "countman", Pushed: pushTime, Pulled: pushTime}
+	testTag := database.Tag{Name: "reg1/rep1:counted", Registry: "reg1", Repository: "rep1", Tag: "counted", Manifest: testManifest, Pushed: pushTime}
+	db.PushManifest(&testManifest)
+	db.PushTag(&testTag)
+	for i := 0; i < 3; i++ {
+		testTag.Pulled = pushTime.AddDate(0, 0, i-1)
+		db.PullBlob(&testBlob)
+		db.PullManifest(&testManifest)
+		db.PullTag(&testTag)
+	}
+
+	for table, key := range map[string]string{"blobs": "countblob", "manifests": "countman"} {
+		var pullCount int64
+		conn.QueryRow("SELECT pull_count FROM regstat."+table+" WHERE digest = $1", key).Scan(&pullCount)
+		if pullCount != 3 {
+			t.Errorf("expected 3 %s pulls; got %d", table, pullCount)
+		}
+	}
+
+	pulls, err := db.TagPulls("reg1", "rep1", pushTime)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	var found *database.TagPulls
+	for i := range pulls {
+		if pulls[i].Tag == "counted" {
+			found = &pulls[i]
+		}
+	}
+	// one pull yesterday, one today, and one tomorrow
+	if found == nil || found.PullCount != 3 || found.RecentPulls != 2 || found.RecentDays != 2 {
+		t.Error("unexpected tag pulls", found)
+	}
+
+	db.DeleteManifest("", "countman")
+	db.DeleteBlob("", "countblob")
+}
+
+func TestBlobMediaType(t *testing.T) {
+	createTestDatabase()
+	conn := db.GetConnection()
+
+	pushTime := time.Now()
+	db.PushBlob(&database.Blob{Digest: "typedblob", MediaType: "application/vnd.oci.image.layer.v1.tar+zstd", Role: "layer", Size: 10, Pushed: pushTime})
+	// blob pulls don't know the media type, which mustn't be forgotten
+	db.PullBlob(&database.Blob{Digest: "typedblob", Pushed: pushTime, Pulled: pushTime})
+	var mediaType, role string
+	conn.QueryRow("SELECT media_type, role FROM regstat.blobs "+
+		"WHERE digest = $1",
+		"typedblob").Scan(&mediaType, &role)
+	if mediaType != "application/vnd.oci.image.layer.v1.tar+zstd" || role != "layer" {
+		t.Error("unexpected media type and role", mediaType, role)
+	}
+
+	usages, err := db.MediaTypeStorage()
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	found := false
+	for _, usage := range usages {
+		if usage.MediaType == "application/vnd.oci.image.layer.v1.tar+zstd" && usage.Role == "layer" && usage.Blobs > 0 {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected the media type to be reported", usages)
+	}
+	db.DeleteBlob("", "typedblob")
+}
+
+func TestImageConfigs(t *testing.T) {
+	createTestDatabase()
+
+	pushTime := time.Now()
+	amd64 := database.Manifest{Digest: "cfgamd64", Pushed: pushTime, Config: &database.ImageConfig{
+		Digest:       "cfgblob1",
+		Platform:     database.Platform{OS: "linux", Architecture: "amd64"},
+		Created:      pushTime.AddDate(0, -1, 0),
+		Entrypoint:   []string{"/bin/hello"},
+		ExposedPorts: []string{"8080/tcp"},
+	}}
+	// declared as arm64 by the index, but built for amd64
+	arm64 := database.Manifest{Digest: "cfgarm64", Pushed: pushTime, Config: &database.ImageConfig{
+		Digest:   "cfgblob2",
+		Platform: database.Platform{OS: "linux", Architecture: "amd64"},
+	}}
+	index := database.Manifest{Digest: "cfgindex", Pushed: pushTime, Children: []database.ChildManifest{
+		{Digest: "cfgamd64", Platform: database.Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "cfgarm64", Platform: database.Platform{OS: "linux", Architecture: "arm64"}},
+	}}
+	for _, manifest := range []*database.Manifest{&amd64, &arm64, &index} {
+		err := db.PushManifest(manifest)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+	db.PushTag(&database.Tag{Name: "cfgreg/cfgrep:1", Registry: "cfgreg", Repository: "cfgrep", Tag: "1", Manifest: index, Pushed: pushTime})
+
+	images, err := db.TagImages("cfgreg", "cfgrep")
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if len(images) != 2 {
+		t.Fatal("expected 2 images", images)
+	}
+	for _, image := range images {
+		if image.PlatformMismatch != (image.Digest == "cfgarm64") {
+			t.Error("unexpected platform mismatch", image)
+		}
+		if (image.Created != nil) != (image.Digest == "cfgamd64") {
+			t.Error("unexpected created time", image)
+		}
+	}
+
+	db.DeleteManifest("", "cfgindex")
+	db.DeleteManifest("", "cfgamd64")
+	db.DeleteManifest("", "cfgarm64")
+}
+
+func TestArtifactMetadata(t *testing.T) {
+	createTestDatabase()
+	conn := db.GetConnection()
+
+	chart := database.Manifest{Digest: "artchart", Pushed: time.Now(), ArtifactType: "application/vnd.cncf.helm.config.v1+json",
+		Metadata: []database.ArtifactMetadata{
+			{Type: "application/vnd.cncf.helm.config.v1+json", Name: "chart_name", Value: "hello"},
+			{Type: "application/vnd.cncf.helm.config.v1+json", Name: "chart_version", Value: "1.0.0"},
+		}}
+	err := db.PushManifest(&chart)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	// a repush without metadata leaves the metadata, and artifact type, in place
+	err = db.PushManifest(&database.Manifest{Digest: "artchart", Pushed: time.Now()})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	var artifactType string
+	var count int
+	conn.QueryRow("SELECT artifact_type FROM regstat.manifests WHERE digest = $1", "artchart").Scan(&artifactType)
+	conn.QueryRow("SELECT COUNT(*) FROM regstat.artifact_metadata WHERE manifest_digest = $1", "artchart").Scan(&count)
+	if artifactType != chart.ArtifactType || count != 2 {
+		t.Error("unexpected artifact type or metadata", artifactType, count)
+	}
+
+	// a repush with metadata replaces it
+	chart.Metadata = chart.Metadata[:1]
+	err = db.PushManifest(&chart)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	conn.QueryRow("SELECT COUNT(*) FROM regstat.artifact_metadata WHERE manifest_digest = $1", "artchart").Scan(&count)
+	if count != 1 {
+		t.Error("expected 1 item of metadata", count)
+	}
+
+	err = db.DeleteManifest("", "artchart")
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	conn.QueryRow("SELECT artifact_type FROM regstat.deleted_manifests WHERE digest = $1", "artchart").Scan(&artifactType)
+	conn.QueryRow("SELECT COUNT(*) FROM regstat.artifact_metadata WHERE manifest_digest = $1", "artchart").Scan(&count)
+	if artifactType != chart.ArtifactType || count != 0 {
+		t.Error("unexpected deleted artifact type or metadata", artifactType, count)
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	createTestDatabase()
+
+	pushTime := time.Now()
+	image := database.Manifest{Digest: "refimage", Pushed: pushTime}
+	other := database.Manifest{Digest: "refother", Pushed: pushTime}
+	signature := database.Manifest{Digest: "refsig", Pushed: pushTime, Subject: "refimage",
+		ArtifactType: "application/vnd.cncf.notary.signature"}
+	sbom := database.Manifest{Digest: "refsbom", Pushed: pushTime.Add(time.Second), Subject: "refimage",
+		ArtifactType: "application/spdx+json"}
+	// a signature pushed under a cosign tag, with no subject
+	cosign := database.Manifest{Digest: "refcosign", Pushed: pushTime, Metadata: []database.ArtifactMetadata{
+		{Type: "application/vnd.dev.cosign.simplesigning.v1+json", Name: "signed_digest", Value: "refother"},
+	}}
+	for _, manifest := range []*database.Manifest{&image, &other, &signature, &sbom, &cosign} {
+		err := db.PushManifest(manifest)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	referrers, err := db.Referrers("refimage", "")
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if len(referrers) != 2 || referrers[0].Digest != "refsig" || referrers[1].Digest != "refsbom" {
+		t.Error("unexpected referrers", referrers)
+	}
+	referrers, _ = db.Referrers("refimage", "application/spdx+json")
+	if len(referrers) != 1 || referrers[0].Digest != "refsbom" {
+		t.Error("unexpected sbom referrers", referrers)
+	}
+
+	db.PushTag(&database.Tag{Name: "refreg/refrep:1", Registry: "refreg", Repository: "refrep", Tag: "1", Manifest: image, Pushed: pushTime})
+	db.PushTag(&database.Tag{Name: "refreg/refrep:2", Registry: "refreg", Repository: "refrep", Tag: "2", Manifest: other, Pushed: pushTime})
+	// signatures and attestations are never reported as unsigned themselves
+	cosignTag := "sha256-" + strings.Repeat("ab", 32)
+	attestation := database.Manifest{Digest: "refatt", Pushed: pushTime}
+	db.PushManifest(&attestation)
+	db.PushTag(&database.Tag{Name: "refreg/refrep:" + cosignTag + ".sig", Registry: "refreg", Repository: "refrep", Tag: cosignTag + ".sig", Manifest: cosign, Pushed: pushTime})
+	db.PushTag(&database.Tag{Name: "refreg/refrep:" + cosignTag + ".att", Registry: "refreg", Repository: "refrep", Tag: cosignTag + ".att", Manifest: attestation, Pushed: pushTime})
+	db.PushTag(&database.Tag{Name: "refreg/refrep:sig", Registry: "refreg", Repository: "refrep", Tag: "sig", Manifest: signature, Pushed: pushTime})
+	tags, err := db.UnsignedTags("refreg", "refrep", []string{"application/vnd.cncf.notary.signature"})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if len(tags) != 0 {
+		t.Error("expected no unsigned tags", tags)
+	}
+	tags, _ = db.UnsignedTags("refreg", "refrep", []string{"application/vnd.example.sig"})
+	if len(tags) != 1 || tags[0].Tag != "1" {
+		t.Error("expected tag 1 to be unsigned", tags)
+	}
+
+	for _, name := range []string{"1", "2", cosignTag + ".sig", cosignTag + ".att", "sig"} {
+		db.DeleteTag("refreg/refrep:" + name)
+	}
+	for _, digest := range []string{"refsig", "refsbom", "refcosign", "refatt", "refimage", "refother"} {
+		db.DeleteManifest("", digest)
+	}
+}
+
+func TestPullManifestTags(t *testing.T) {
+	createTestDatabase()
+
+	pushTime := time.Now()
+	testManifest := database.Manifest{Digest: "digestman", Pushed: pushTime}
+	db.PushManifest(&testManifest)
+	// only the tags of drep count the pull, not those of similarly named repositories
+	for _, tag := range []struct{ repository, tag string }{{"drep", "1"}, {"drep", "latest"}, {"drep2", "1"}, {"dre_", "1"}} {
+		db.PushTag(&database.Tag{Name: "dreg/" + tag.repository + ":" + tag.tag, Registry: "dreg", Repository: tag.repository, Tag: tag.tag,
+			Manifest: testManifest, Pushed: pushTime})
+	}
+
+	err := db.PullManifestTags(&database.Tag{Name: "dreg/drep", Registry: "dreg", Repository: "drep", Manifest: testManifest, Pulled: pushTime})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	pulls, err := db.TagPulls("dreg", "", pushTime)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	for _, tagPulls := range pulls {
+		expected := int64(0)
+		if tagPulls.Repository == "drep" {
+			expected = 1
+		}
+		if tagPulls.PullCount != expected || tagPulls.RecentPulls != expected {
+			t.Error("unexpected tag pulls", tagPulls)
+		}
+	}
+
+	db.DeleteManifest("", "digestman")
+}
+
+func TestPendingEnrichments(t *testing.T) {
+	createTestDatabase()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	manifest := database.Manifest{Digest: "pendingmanifest", Pushed: now}
+	err := db.PushManifest(&manifest)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	pending := database.PendingEnrichment{Digest: "pendingmanifest", Repository: "hello",
+		MediaType: "application/vnd.oci.image.manifest.v1+json", URL: "http://hello", Pushed: now,
+		Attempts: 1, LastError: "oops", NextAttempt: now.Add(time.Minute)}
+	err = db.SavePendingEnrichment(&pending)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	pendings, err := db.PendingEnrichments(now)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if len(pendings) != 0 {
+		t.Error("expected no due enrichments", pendings)
+	}
+	pendings, _ = db.PendingEnrichments(time.Time{})
+	if len(pendings) != 1 || pendings[0].Attempts != 1 || pendings[0].URL != "http://hello" {
+		t.Error("unexpected pending enrichments", pendings)
+	}
+
+	pending.Attempts = 2
+	pending.LastError = "oops again"
+	pending.NextAttempt = now.Add(-time.Minute)
+	db.SavePendingEnrichment(&pending)
+	pendings, _ = db.PendingEnrichments(now)
+	if len(pendings) != 1 || pendings[0].Attempts != 2 || pendings[0].LastError != "oops again" {
+		t.Error("unexpected due enrichments", pendings)
+	}
+
+	err = db.DeleteManifest("", "pendingmanifest")
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	pendings, _ = db.PendingEnrichments(time.Time{})
+	if len(pendings) != 0 {
+		t.Error("expected pending enrichment to be deleted with its manifest", pendings)
+	}
+}
+
+func TestEnrichmentRetry(t *testing.T) {
+	createTestDatabase()
+	conn := db.GetConnection()
+
+	pushed := time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+	pulled := pushed.Add(30 * time.Minute)
+	blob := database.Blob{Digest: "retryblob", Repository: "hello", Pushed: pushed, Pulled: pulled}
+	err := db.PullBlob(&blob)
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	t.Run("pulled time kept", func(t *testing.T) {
+		// a retried enrichment records the blobs as pulled when the manifest
+		// was pushed, which is before the pull above
+		manifest := database.Manifest{Digest: "retrymanifest", Repository: "hello", Pushed: pushed,
+			Blobs: []database.Blob{{Digest: "retryblob", Repository: "hello", Pushed: pushed, Pulled: pushed}}}
+		err := db.PushManifest(&manifest)
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		var blobPulled, linkPulled time.Time
+		conn.QueryRow("SELECT pulled FROM regstat.blobs WHERE digest = $1", "retryblob").Scan(&blobPulled)
+		conn.QueryRow("SELECT pulled FROM regstat.repository_blobs WHERE repository = $1 AND digest = $2",
+			"hello", "retryblob").Scan(&linkPulled)
+		if !blobPulled.Equal(pulled) || !linkPulled.Equal(pulled) {
+			t.Error("expected pulled time not to go backwards", blobPulled, linkPulled)
+		}
+	})
+
+	t.Run("manifest locked", func(t *testing.T) {
+		deleted := make(chan error)
+		err := db.Transaction(func(txdb database.Database) error {
+			isManifest, err := txdb.IsManifest("retrymanifest")
+			if err != nil || !isManifest {
+				return fmt.Errorf("expected manifest; got %t %v", isManifest, err)
+			}
+			go func() {
+				deleted <- db.DeleteManifest("hello", "retrymanifest")
+			}()
+			select {
+			case err := <-deleted:
+				return fmt.Errorf("expected delete to wait for the transaction; got %v", err)
+			case <-time.After(100 * time.Millisecond):
+			}
+			manifest := database.Manifest{Digest: "retrymanifest", Repository: "hello", Pushed: pushed}
+			return txdb.PushManifest(&manifest)
+		})
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		err = <-deleted
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		isManifest, _ := db.IsManifest("retrymanifest")
+		if isManifest {
+			t.Error("expected manifest to be deleted once the transaction ended")
+		}
+	})
+
+	db.DeleteBlob("hello", "retryblob")
+}
@@ -0,0 +1,235 @@
+package postgres
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/vleurgat/regstat/internal/app/database"
+)
+
+// tagObjectsQuery lists the manifests and blobs used by each tag, including
+// the platform manifests of a manifest list or image index and their blobs.
+// Foreign layers aren't stored by the registry, and so aren't listed.
+const tagObjectsQuery = "WITH tag_manifests AS (" +
+	"SELECT t.name, t.registry, t.repository, COALESCE(t.tag, '') AS tag, t.manifest_digest AS digest " +
+	"FROM regstat.tags t " +
+	"UNION " +
+	"SELECT t.name, t.registry, t.repository, COALESCE(t.tag, ''), mc.child_digest " +
+	"FROM regstat.tags t " +
+	"JOIN regstat.manifest_children mc ON mc.parent_digest = t.manifest_digest" +
+	"), tag_objects AS (" +
+	"SELECT tm.name, tm.registry, tm.repository, tm.tag, m.digest, COALESCE(m.size, 0) AS size " +
+	"FROM tag_manifests tm " +
+	"JOIN regstat.manifests m ON m.digest = tm.digest " +
+	"UNION " +
+	"SELECT tm.name, tm.registry, tm.repository, tm.tag, b.digest, COALESCE(b.size, 0) " +
+	"FROM tag_manifests tm " +
+	"JOIN regstat.manifest_blob mb ON mb.manifest_digest = tm.digest " +
+	"JOIN regstat.blobs b ON b.digest = mb.blob_digest " +
+	"WHERE b.role IS DISTINCT FROM 'foreign'" +
+	") "
+
+// selectRows runs a query and scans the resulting rows into dest, within the
+// Database's transaction if it has one.
+func (db Database) selectRows(dest interface{}, query string, args ...interface{}) error {
+	if db.tx != nil {
+		return classify(db.tx.Select(dest, query, args...))
+	}
+	return classify(db.conn.Select(dest, query, args...))
+}
+
+// StorageTotals sums the sizes of all of the blobs and manifests. Foreign
+// layers are summed separately, as the registry doesn't store them.
+func (db Database) StorageTotals() (database.StorageTotals, error) {
+	var totals []database.StorageTotals
+	err := db.selectRows(&totals, "SELECT "+
+		"b.bytes + m.bytes AS bytes, "+
+		"b.bytes AS blob_bytes, "+
+		"m.bytes AS manifest_bytes, "+
+		"b.foreign_bytes, "+
+		"b.unknown + m.unknown AS unknown_sizes "+
+		"FROM "+
+		"(SELECT "+
+		"COALESCE(SUM(size) FILTER (WHERE role IS DISTINCT FROM 'foreign'), 0)::bigint AS bytes, "+
+		"COALESCE(SUM(size) FILTER (WHERE role = 'foreign'), 0)::bigint AS foreign_bytes, "+
+		"COUNT(*) FILTER (WHERE size IS NULL AND role IS DISTINCT FROM 'foreign') AS unknown "+
+		"FROM regstat.blobs) b, "+
+		"(SELECT COALESCE(SUM(size), 0)::bigint AS bytes, COUNT(*) - COUNT(size) AS unknown FROM regstat.manifests) m")
+	if err != nil || len(totals) == 0 {
+		return database.StorageTotals{}, err
+	}
+	return totals[0], nil
+}
+
+// linkedObjectsQuery lists the manifests and blobs that each repository links,
+// whether or not they're tagged, e.g. referrers, manifests pushed by digest
+// and mounted blobs. The links don't record the registry, so each object is
+// attributed to just one of the registries under which the repository has
+// tags, the first by name, or to none if it has no tags; an object linked by
+// a repository of the same name on another registry is attributed to it too.
+const linkedObjectsQuery = ", linked_objects AS (" +
+	"SELECT rm.repository, m.digest, COALESCE(m.size, 0) AS size " +
+	"FROM regstat.repository_manifests rm " +
+	"JOIN regstat.manifests m ON m.digest = rm.digest " +
+	"UNION " +
+	"SELECT rb.repository, b.digest, COALESCE(b.size, 0) " +
+	"FROM regstat.repository_blobs rb " +
+	"JOIN regstat.blobs b ON b.digest = rb.digest " +
+	"WHERE b.role IS DISTINCT FROM 'foreign'" +
+	"), repository_registries AS (" +
+	"SELECT repository, MIN(registry) AS registry FROM regstat.tags GROUP BY repository" +
+	"), repository_objects AS (" +
+	"SELECT registry, repository, digest, size FROM tag_objects " +
+	"UNION " +
+	"SELECT COALESCE(rr.registry, ''), lo.repository, lo.digest, lo.size " +
+	"FROM linked_objects lo " +
+	"LEFT JOIN repository_registries rr ON rr.repository = lo.repository" +
+	") "
+
+// RepositoryStorage returns the storage used by each repository, largest
+// first, counting everything that the repository links. An object is only
+// shared if more than one repository uses it; one that a repository uses
+// under more than one registry, e.g. because clients use different names for
+// the registry, is still exclusive to it.
+func (db Database) RepositoryStorage() ([]database.StorageUsage, error) {
+	usages := []database.StorageUsage{}
+	err := db.selectRows(&usages, tagObjectsQuery+linkedObjectsQuery+
+		", shared AS ("+
+		"SELECT digest FROM repository_objects GROUP BY digest HAVING COUNT(DISTINCT repository) > 1"+
+		") "+
+		"SELECT ro.registry, ro.repository, "+
+		"SUM(ro.size)::bigint AS bytes, "+
+		"SUM(CASE WHEN s.digest IS NULL THEN ro.size ELSE 0 END)::bigint AS exclusive_bytes "+
+		"FROM repository_objects ro "+
+		"LEFT JOIN shared s ON s.digest = ro.digest "+
+		"GROUP BY ro.registry, ro.repository "+
+		"ORDER BY bytes DESC, ro.registry, ro.repository")
+	return usages, err
+}
+
+// TagStorage returns the storage used by each tag, largest first, optionally
+// restricted to the tags of one registry and/or repository.
+func (db Database) TagStorage(registry string, repository string) ([]database.StorageUsage, error) {
+	usages := []database.StorageUsage{}
+	err := db.selectRows(&usages, tagObjectsQuery+
+		", shared AS ("+
+		"SELECT digest FROM tag_objects GROUP BY digest HAVING COUNT(*) > 1"+
+		") "+
+		"SELECT t.registry, t.repository, t.tag, "+
+		"SUM(t.size)::bigint AS bytes, "+
+		"SUM(CASE WHEN s.digest IS NULL THEN t.size ELSE 0 END)::bigint AS exclusive_bytes "+
+		"FROM tag_objects t "+
+		"LEFT JOIN shared s ON s.digest = t.digest "+
+		"WHERE ($1 = '' OR t.registry = $1) AND ($2 = '' OR t.repository = $2) "+
+		"GROUP BY t.name, t.registry, t.repository, t.tag "+
+		"ORDER BY bytes DESC, t.name",
+		registry, repository)
+	return usages, err
+}
+
+// TagImages lists the images of each tag, optionally restricted by registry
+// and repository, along with the details of their configs. Images whose
+// configs haven't been recorded aren't listed.
+func (db Database) TagImages(registry string, repository string) ([]database.TagImage, error) {
+	images := []database.TagImage{}
+	err := db.selectRows(&images, "SELECT t.registry, t.repository, COALESCE(t.tag, '') AS tag, "+
+		"ic.manifest_digest AS digest, ic.os, ic.architecture, ic.variant, "+
+		"COALESCE(mc.os, '') AS declared_os, "+
+		"COALESCE(mc.architecture, '') AS declared_architecture, "+
+		"COALESCE(mc.variant, '') AS declared_variant, "+
+		"(mc.child_digest IS NOT NULL AND ("+
+		"COALESCE(mc.os, '') <> ic.os OR "+
+		"COALESCE(mc.architecture, '') <> ic.architecture OR "+
+		"COALESCE(mc.variant, '') <> ic.variant"+
+		")) AS platform_mismatch, "+
+		"ic.created, t.pushed "+
+		"FROM regstat.tags t "+
+		"LEFT JOIN regstat.manifest_children mc ON mc.parent_digest = t.manifest_digest "+
+		"JOIN regstat.image_configs ic ON ic.manifest_digest = COALESCE(mc.child_digest, t.manifest_digest) "+
+		"WHERE ($1 = '' OR t.registry = $1) AND ($2 = '' OR t.repository = $2) "+
+		"ORDER BY t.name, ic.os, ic.architecture, ic.variant",
+		registry, repository)
+	return images, err
+}
+
+// MediaTypeStorage counts the blobs of each media type, and sums their sizes.
+// The largest are listed first.
+func (db Database) MediaTypeStorage() ([]database.MediaTypeUsage, error) {
+	usages := []database.MediaTypeUsage{}
+	err := db.selectRows(&usages, "SELECT "+
+		"COALESCE(media_type, '') AS media_type, "+
+		"COALESCE(role, '') AS role, "+
+		"COUNT(*) AS blobs, "+
+		"COALESCE(SUM(size), 0)::bigint AS bytes "+
+		"FROM regstat.blobs "+
+		"GROUP BY media_type, role "+
+		"ORDER BY bytes DESC, media_type")
+	return usages, err
+}
+
+// TagPulls counts the pulls of each tag, optionally restricted by registry and
+// repository, in total and since the given day. The most pulled tags since
+// that day are listed first.
+func (db Database) TagPulls(registry string, repository string, since time.Time) ([]database.TagPulls, error) {
+	pulls := []database.TagPulls{}
+	err := db.selectRows(&pulls, "SELECT t.registry, t.repository, COALESCE(t.tag, '') AS tag, "+
+		"t.pull_count, t.pulled AS last_pulled, "+
+		"COALESCE(SUM(tp.pulls), 0)::bigint AS recent_pulls, "+
+		"COUNT(tp.day) AS recent_days "+
+		"FROM regstat.tags t "+
+		"LEFT JOIN regstat.tag_pulls tp ON tp.name = t.name AND tp.day >= $3 "+
+		"WHERE ($1 = '' OR t.registry = $1) AND ($2 = '' OR t.repository = $2) "+
+		"GROUP BY t.name, t.registry, t.repository, t.tag, t.pull_count, t.pulled "+
+		"ORDER BY recent_pulls DESC, t.pull_count DESC, t.name",
+		registry, repository, day(since))
+	return pulls, err
+}
+
+// Referrers lists the manifests whose subject is the given manifest, oldest
+// first, optionally restricted to those of one artifact type.
+func (db Database) Referrers(digest string, artifactType string) ([]database.Referrer, error) {
+	referrers := []database.Referrer{}
+	err := db.selectRows(&referrers, "SELECT digest, "+
+		"COALESCE(artifact_type, '') AS artifact_type, "+
+		"COALESCE(size, 0) AS size, "+
+		"pushed "+
+		"FROM regstat.manifests "+
+		"WHERE subject_digest = $1 AND ($2 = '' OR artifact_type = $2) "+
+		"ORDER BY pushed, digest",
+		digest, artifactType)
+	return referrers, err
+}
+
+// UnsignedTags lists the tags, optionally restricted by registry and
+// repository, whose manifests have no signature: neither a referrer of one of
+// the given signature types, nor a signature, e.g. one pushed under a cosign
+// tag, whose signed payload names the manifest. Tags whose manifests are
+// themselves signatures or attestations aren't listed: those that are
+// referrers, have a signature type, or are signed payloads, and those under
+// the tags that cosign derives from the digest of the manifest they sign.
+func (db Database) UnsignedTags(registry string, repository string, signatureTypes []string) ([]database.UnsignedTag, error) {
+	tags := []database.UnsignedTag{}
+	err := db.selectRows(&tags, "SELECT t.registry, t.repository, COALESCE(t.tag, '') AS tag, "+
+		"t.manifest_digest AS digest, t.pushed "+
+		"FROM regstat.tags t "+
+		"JOIN regstat.manifests m ON m.digest = t.manifest_digest "+
+		"WHERE ($1 = '' OR t.registry = $1) AND ($2 = '' OR t.repository = $2) "+
+		"AND m.subject_digest IS NULL "+
+		"AND (m.artifact_type IS NULL OR m.artifact_type <> ALL($3)) "+
+		"AND COALESCE(t.tag, '') !~ '^sha256-[0-9a-f]{64}\\.(sig|att|sbom)$' "+
+		"AND NOT EXISTS ("+
+		"SELECT 1 FROM regstat.artifact_metadata am "+
+		"WHERE am.manifest_digest = t.manifest_digest AND am.name = 'signed_digest'"+
+		") "+
+		"AND NOT EXISTS ("+
+		"SELECT 1 FROM regstat.manifests r "+
+		"WHERE r.subject_digest = t.manifest_digest AND r.artifact_type = ANY($3)"+
+		") "+
+		"AND NOT EXISTS ("+
+		"SELECT 1 FROM regstat.artifact_metadata am "+
+		"WHERE am.name = 'signed_digest' AND am.value = t.manifest_digest"+
+		") "+
+		"ORDER BY t.name",
+		registry, repository, pq.Array(signatureTypes))
+	return tags, err
+}
@@ -104,3 +104,314 @@ ALTER TABLE regstat.tags
 	ON DELETE NO ACTION
 	ON UPDATE NO ACTION;
 `
+
+// schemaUpgrades holds the changes made to the schema since its first
+// version, i.e. postgresSchema; schemaUpgrades[n] upgrades the schema from
+// version n+1 to version n+2.
+var schemaUpgrades = []string{
+	// version 2: the IDs of processed events, used to skip redelivered events
+	`
+CREATE TABLE IF NOT EXISTS regstat.processed_events  (
+	id       	text NOT NULL,
+	processed	timestamp NOT NULL,
+	PRIMARY KEY(id)
+);
+
+CREATE INDEX IF NOT EXISTS processed_events_processed
+	ON regstat.processed_events USING btree (processed);
+`,
+	// version 3: the platform manifests of manifest lists and image indexes
+	`
+CREATE TABLE IF NOT EXISTS regstat.manifest_children  (
+	parent_digest	text NOT NULL,
+	child_digest 	text NOT NULL,
+	os           	text NULL,
+	architecture 	text NULL,
+	variant      	text NULL,
+	PRIMARY KEY(parent_digest,child_digest)
+);
+
+CREATE TABLE IF NOT EXISTS regstat.deleted_manifest_children  (
+	parent_digest	text NOT NULL,
+	child_digest 	text NOT NULL,
+	os           	text NULL,
+	architecture 	text NULL,
+	variant      	text NULL,
+	PRIMARY KEY(parent_digest,child_digest)
+);
+
+CREATE INDEX IF NOT EXISTS child_digest
+	ON regstat.manifest_children USING btree (child_digest);
+
+ALTER TABLE regstat.manifest_children
+	ADD CONSTRAINT parent_fkey
+	FOREIGN KEY(parent_digest)
+	REFERENCES regstat.manifests(digest)
+	ON DELETE NO ACTION
+	ON UPDATE NO ACTION;
+
+ALTER TABLE regstat.manifest_children
+	ADD CONSTRAINT child_fkey
+	FOREIGN KEY(child_digest)
+	REFERENCES regstat.manifests(digest)
+	ON DELETE NO ACTION
+	ON UPDATE NO ACTION;
+`,
+	// version 4: the sizes of blobs and manifests, in bytes
+	`
+ALTER TABLE regstat.blobs
+	ADD COLUMN IF NOT EXISTS size bigint NULL;
+
+ALTER TABLE regstat.deleted_blobs
+	ADD COLUMN IF NOT EXISTS size bigint NULL;
+
+ALTER TABLE regstat.manifests
+	ADD COLUMN IF NOT EXISTS size bigint NULL;
+
+ALTER TABLE regstat.deleted_manifests
+	ADD COLUMN IF NOT EXISTS size bigint NULL;
+`,
+	// version 5: blobs mounted into one repository from another
+	`
+CREATE TABLE IF NOT EXISTS regstat.blob_mounts  (
+	digest         	text NOT NULL,
+	repository     	text NOT NULL,
+	from_repository	text NOT NULL,
+	mounted        	timestamp NOT NULL,
+	PRIMARY KEY(digest,repository)
+);
+
+ALTER TABLE regstat.blob_mounts
+	ADD CONSTRAINT blobs_fkey
+	FOREIGN KEY(digest)
+	REFERENCES regstat.blobs(digest)
+	ON DELETE NO ACTION
+	ON UPDATE NO ACTION;
+`,
+	// version 6: the repositories that link each blob and manifest, initially
+	// those implied by the existing tags and mounts
+	`
+CREATE TABLE IF NOT EXISTS regstat.repository_blobs  (
+	repository	text NOT NULL,
+	digest    	text NOT NULL,
+	pushed    	timestamp NOT NULL,
+	pulled    	timestamp NULL,
+	PRIMARY KEY(repository,digest)
+);
+
+CREATE TABLE IF NOT EXISTS regstat.repository_manifests  (
+	repository	text NOT NULL,
+	digest    	text NOT NULL,
+	pushed    	timestamp NOT NULL,
+	pulled    	timestamp NULL,
+	PRIMARY KEY(repository,digest)
+);
+
+CREATE INDEX IF NOT EXISTS repository_blobs_digest
+	ON regstat.repository_blobs USING btree (digest);
+
+CREATE INDEX IF NOT EXISTS repository_manifests_digest
+	ON regstat.repository_manifests USING btree (digest);
+
+ALTER TABLE regstat.repository_blobs
+	ADD CONSTRAINT blobs_fkey
+	FOREIGN KEY(digest)
+	REFERENCES regstat.blobs(digest)
+	ON DELETE NO ACTION
+	ON UPDATE NO ACTION;
+
+ALTER TABLE regstat.repository_manifests
+	ADD CONSTRAINT manifests_fkey
+	FOREIGN KEY(digest)
+	REFERENCES regstat.manifests(digest)
+	ON DELETE NO ACTION
+	ON UPDATE NO ACTION;
+
+INSERT INTO regstat.repository_manifests
+	SELECT t.repository, m.digest, m.pushed, m.pulled
+	FROM regstat.tags t
+	JOIN regstat.manifests m ON m.digest = t.manifest_digest
+	UNION
+	SELECT t.repository, m.digest, m.pushed, m.pulled
+	FROM regstat.tags t
+	JOIN regstat.manifest_children mc ON mc.parent_digest = t.manifest_digest
+	JOIN regstat.manifests m ON m.digest = mc.child_digest
+	ON CONFLICT (repository, digest) DO NOTHING;
+
+INSERT INTO regstat.repository_blobs
+	SELECT rm.repository, b.digest, b.pushed, b.pulled
+	FROM regstat.repository_manifests rm
+	JOIN regstat.manifest_blob mb ON mb.manifest_digest = rm.digest
+	JOIN regstat.blobs b ON b.digest = mb.blob_digest
+	UNION
+	SELECT bm.repository, b.digest, b.pushed, b.pulled
+	FROM regstat.blob_mounts bm
+	JOIN regstat.blobs b ON b.digest = bm.digest
+	ON CONFLICT (repository, digest) DO NOTHING;
+`,
+	// version 7: the append-only audit log of processed events
+	`
+CREATE TABLE IF NOT EXISTS regstat.events  (
+	seq               	bigserial NOT NULL,
+	id                	text NOT NULL,
+	action            	text NOT NULL,
+	occurred          	timestamp NOT NULL,
+	registry          	text NOT NULL,
+	repository        	text NOT NULL,
+	from_repository   	text NOT NULL,
+	tag               	text NOT NULL,
+	digest            	text NOT NULL,
+	media_type        	text NOT NULL,
+	size              	bigint NULL,
+	url               	text NOT NULL,
+	actor             	text NOT NULL,
+	request_id        	text NOT NULL,
+	request_addr      	text NOT NULL,
+	request_method    	text NOT NULL,
+	request_user_agent	text NOT NULL,
+	source_instance_id	text NOT NULL,
+	source_addr       	text NOT NULL,
+	recorded          	timestamp NOT NULL,
+	PRIMARY KEY(seq)
+);
+
+CREATE INDEX IF NOT EXISTS events_occurred
+	ON regstat.events USING btree (occurred);
+
+CREATE INDEX IF NOT EXISTS events_actor
+	ON regstat.events USING btree (actor, occurred);
+
+CREATE INDEX IF NOT EXISTS events_repository
+	ON regstat.events USING btree (repository, occurred);
+`,
+	// version 8: the number of times that blobs, manifests and tags have been
+	// pulled, in total and, for tags, on each day
+	`
+ALTER TABLE regstat.blobs
+	ADD COLUMN IF NOT EXISTS pull_count bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE regstat.deleted_blobs
+	ADD COLUMN IF NOT EXISTS pull_count bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE regstat.manifests
+	ADD COLUMN IF NOT EXISTS pull_count bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE regstat.deleted_manifests
+	ADD COLUMN IF NOT EXISTS pull_count bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE regstat.tags
+	ADD COLUMN IF NOT EXISTS pull_count bigint NOT NULL DEFAULT 0;
+
+ALTER TABLE regstat.deleted_tags
+	ADD COLUMN IF NOT EXISTS pull_count bigint NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS regstat.tag_pulls  (
+	name 	text NOT NULL,
+	day  	date NOT NULL,
+	pulls	bigint NOT NULL,
+	PRIMARY KEY(name,day)
+);
+
+CREATE INDEX IF NOT EXISTS tag_pulls_day
+	ON regstat.tag_pulls USING btree (day);
+`,
+	// version 9: the media types of blobs, and the roles that they play
+	`
+ALTER TABLE regstat.blobs
+	ADD COLUMN IF NOT EXISTS media_type text NULL,
+	ADD COLUMN IF NOT EXISTS role text NULL;
+
+ALTER TABLE regstat.deleted_blobs
+	ADD COLUMN IF NOT EXISTS media_type text NULL,
+	ADD COLUMN IF NOT EXISTS role text NULL;
+`,
+	// version 10: the details of the config blobs of image manifests
+	`
+CREATE TABLE IF NOT EXISTS regstat.image_configs  (
+	manifest_digest	text NOT NULL,
+	config_digest  	text NOT NULL,
+	os             	text NOT NULL,
+	architecture   	text NOT NULL,
+	variant        	text NOT NULL,
+	created        	timestamp NULL,
+	author         	text NOT NULL,
+	entrypoint     	jsonb NULL,
+	cmd            	jsonb NULL,
+	exposed_ports  	jsonb NULL,
+	history_length 	integer NOT NULL,
+	PRIMARY KEY(manifest_digest)
+);
+
+ALTER TABLE regstat.image_configs
+	ADD CONSTRAINT manifests_fkey
+	FOREIGN KEY(manifest_digest)
+	REFERENCES regstat.manifests(digest)
+	ON DELETE NO ACTION
+	ON UPDATE NO ACTION;
+`,
+	// version 11: the types of OCI artifacts and the metadata extracted from them
+	`
+ALTER TABLE regstat.manifests
+	ADD COLUMN IF NOT EXISTS artifact_type text NULL;
+
+ALTER TABLE regstat.deleted_manifests
+	ADD COLUMN IF NOT EXISTS artifact_type text NULL;
+
+CREATE TABLE IF NOT EXISTS regstat.artifact_metadata  (
+	manifest_digest	text NOT NULL,
+	seq            	integer NOT NULL,
+	artifact_type  	text NOT NULL,
+	name           	text NOT NULL,
+	value          	text NOT NULL,
+	PRIMARY KEY(manifest_digest, seq)
+);
+
+ALTER TABLE regstat.artifact_metadata
+	ADD CONSTRAINT manifests_fkey
+	FOREIGN KEY(manifest_digest)
+	REFERENCES regstat.manifests(digest)
+	ON DELETE NO ACTION
+	ON UPDATE NO ACTION;
+`,
+	// version 12: the subjects of referrers, e.g. signatures and SBOMs
+	`
+ALTER TABLE regstat.manifests
+	ADD COLUMN IF NOT EXISTS subject_digest text NULL;
+
+ALTER TABLE regstat.deleted_manifests
+	ADD COLUMN IF NOT EXISTS subject_digest text NULL;
+
+CREATE INDEX IF NOT EXISTS manifests_subject_digest
+	ON regstat.manifests(subject_digest);
+`,
+	// version 13: manifests that couldn't be fetched when pushed, to be retried
+	`
+CREATE TABLE IF NOT EXISTS regstat.pending_enrichments  (
+	digest      	text NOT NULL,
+	repository  	text NOT NULL,
+	media_type  	text NOT NULL,
+	url         	text NOT NULL,
+	pushed      	timestamp NOT NULL,
+	attempts    	integer NOT NULL,
+	last_error  	text NOT NULL,
+	next_attempt	timestamp NOT NULL,
+	PRIMARY KEY(digest)
+);
+
+CREATE INDEX IF NOT EXISTS pending_enrichments_next_attempt
+	ON regstat.pending_enrichments USING btree (next_attempt);
+
+ALTER TABLE regstat.pending_enrichments
+	ADD CONSTRAINT manifests_fkey
+	FOREIGN KEY(digest)
+	REFERENCES regstat.manifests(digest)
+	ON DELETE NO ACTION
+	ON UPDATE NO ACTION;
+`,
+}
+
+// schemaVersion is the version of the schema expected by this code.
+var schemaVersion = len(schemaUpgrades) + 1
+
+// schemaLockID identifies the advisory lock held while upgrading the schema.
+const schemaLockID = 0x72656773
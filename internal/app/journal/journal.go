@@ -0,0 +1,330 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// compactAfter is the number of entries that must be marked as done before
+// the journal is automatically compacted.
+const compactAfter = 1000
+
+// Journal is an append-only, on-disk log of the notification bodies that have
+// been accepted but not yet fully processed. Each line of the file is a JSON
+// record that either adds an entry or marks an earlier one as done. Entries
+// that can never be processed are moved to a dead letter file alongside it.
+type Journal struct {
+	mutex       sync.Mutex
+	path        string
+	file        *os.File
+	size        int64
+	nextID      uint64
+	pending     map[uint64][]byte
+	doneRecords int
+	deadLetters int
+}
+
+// Entry is a notification body that has yet to be fully processed.
+type Entry struct {
+	ID   uint64
+	Body []byte
+}
+
+// Stats describes the current state of the journal. DeadLetters counts the
+// entries moved to the dead letter file since the journal was opened.
+type Stats struct {
+	Path        string `json:"path"`
+	Size        int64  `json:"size"`
+	Pending     int    `json:"pending"`
+	DeadLetters int    `json:"dead_letters"`
+}
+
+// record is a line of the journal file. Compaction starts the file with a
+// header record that holds only Next, the ID of the next entry, so that IDs
+// aren't reused even once every entry is done; the dead letter file relies on
+// them being unique.
+type record struct {
+	ID    uint64 `json:"id"`
+	Body  []byte `json:"body,omitempty"`
+	Done  bool   `json:"done,omitempty"`
+	Error string `json:"error,omitempty"`
+	Next  uint64 `json:"next,omitempty"`
+}
+
+// Open opens the journal at the given path, creating it if necessary. Any
+// entries that were not marked as done are retained and can be obtained
+// using Pending. The journal is compacted before being returned.
+func Open(path string) (*Journal, error) {
+	j := &Journal{path: path, pending: map[uint64][]byte{}}
+	err := j.load()
+	if err != nil {
+		return nil, err
+	}
+	err = j.Compact()
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			var r record
+			if jsonErr := json.Unmarshal(line, &r); jsonErr != nil {
+				// most likely a partial write cut short by a crash
+				log.Println("skipping corrupt journal record", jsonErr)
+			} else {
+				j.apply(r)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (j *Journal) apply(r record) {
+	if r.Next > 0 {
+		if r.Next > j.nextID {
+			j.nextID = r.Next
+		}
+		return
+	}
+	if r.Done {
+		delete(j.pending, r.ID)
+		j.doneRecords++
+	} else {
+		j.pending[r.ID] = r.Body
+	}
+	if r.ID >= j.nextID {
+		j.nextID = r.ID + 1
+	}
+}
+
+// write appends a record to the journal file, optionally waiting for it to
+// reach stable storage.
+func (j *Journal) write(r record, sync bool) error {
+	if j.file == nil {
+		return os.ErrClosed
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if sync {
+		return j.file.Sync()
+	}
+	return nil
+}
+
+// Append adds a notification body to the journal, returning once it has been
+// written to stable storage.
+func (j *Journal) Append(body []byte) (uint64, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	id := j.nextID
+	err := j.write(record{ID: id, Body: body}, true)
+	if err != nil {
+		return 0, err
+	}
+	j.nextID++
+	j.pending[id] = body
+	return id, nil
+}
+
+// Done marks the entry with the given ID as fully processed. The record isn't
+// synced to disk; if it's lost in a crash the entry is simply replayed.
+func (j *Journal) Done(id uint64) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.done(id)
+}
+
+func (j *Journal) done(id uint64) error {
+	if _, ok := j.pending[id]; !ok {
+		return nil
+	}
+	err := j.write(record{ID: id, Done: true}, false)
+	if err != nil {
+		return err
+	}
+	delete(j.pending, id)
+	j.doneRecords++
+	if j.doneRecords >= compactAfter {
+		return j.compact()
+	}
+	return nil
+}
+
+// DeadLetter moves the entry with the given ID, which failed with the given
+// error and would fail again if it were replayed, to the dead letter file,
+// i.e. the journal's path with a .dead suffix, and marks it as done.
+func (j *Journal) DeadLetter(id uint64, reason error) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	body, ok := j.pending[id]
+	if !ok {
+		return nil
+	}
+	if j.file == nil {
+		return os.ErrClosed
+	}
+	line, err := json.Marshal(record{ID: id, Body: body, Error: reason.Error()})
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(j.path+".dead", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	j.deadLetters++
+	return j.done(id)
+}
+
+// Pending returns the entries that have not been marked as done, in the order
+// in which they were appended.
+func (j *Journal) Pending() []Entry {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	entries := make([]Entry, 0, len(j.pending))
+	for id, body := range j.pending {
+		entries = append(entries, Entry{ID: id, Body: body})
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].ID < entries[b].ID })
+	return entries
+}
+
+// Stats returns the size of the journal file and the number of pending entries.
+func (j *Journal) Stats() Stats {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return Stats{Path: j.path, Size: j.size, Pending: len(j.pending), DeadLetters: j.deadLetters}
+}
+
+// Compact rewrites the journal so that it only contains the pending entries.
+func (j *Journal) Compact() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.compact()
+}
+
+func (j *Journal) compact() error {
+	ids := make([]uint64, 0, len(j.pending))
+	for id := range j.pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+
+	records := make([]record, 0, len(ids)+1)
+	if j.nextID > 0 {
+		records = append(records, record{Next: j.nextID})
+	}
+	for _, id := range ids {
+		records = append(records, record{ID: id, Body: j.pending[id]})
+	}
+
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	var size int64
+	writer := bufio.NewWriter(tmp)
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err == nil {
+			var n int
+			n, err = writer.Write(append(line, '\n'))
+			size += int64(n)
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		// the new file stays open, and becomes the journal once it's renamed,
+		// so a failure leaves the journal using the old file
+		err = os.Rename(tmpPath, j.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(j.path))
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = tmp
+	j.size = size
+	j.doneRecords = 0
+	return nil
+}
+
+// syncDir makes a rename within the given directory durable; failures are
+// ignored as not every platform supports syncing a directory.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Close syncs any unsynced records to disk and closes the journal file.
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Sync()
+	closeErr := j.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	j.file = nil
+	return err
+}
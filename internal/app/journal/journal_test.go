@@ -0,0 +1,209 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func createTempJournalPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "regstat-journal")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	return filepath.Join(dir, "journal"), func() { os.RemoveAll(dir) }
+}
+
+func TestJournal(t *testing.T) {
+	path, cleanup := createTempJournalPath(t)
+	defer cleanup()
+
+	t.Run("append and done", func(t *testing.T) {
+		j, err := Open(path)
+		if err != nil {
+			t.Fatal("failed to open journal", err)
+		}
+		id1, err := j.Append([]byte("one"))
+		if err != nil {
+			t.Fatal("failed to append", err)
+		}
+		id2, _ := j.Append([]byte("two"))
+		id3, _ := j.Append([]byte("three"))
+		if id1 == id2 || id2 == id3 {
+			t.Fatal("expected unique ids")
+		}
+		j.Done(id2)
+		pending := j.Pending()
+		if len(pending) != 2 || string(pending[0].Body) != "one" || string(pending[1].Body) != "three" {
+			t.Fatal("unexpected pending entries", pending)
+		}
+		stats := j.Stats()
+		if stats.Pending != 2 || stats.Size == 0 {
+			t.Error("unexpected stats", stats)
+		}
+		j.Close()
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		j, err := Open(path)
+		if err != nil {
+			t.Fatal("failed to open journal", err)
+		}
+		defer j.Close()
+		pending := j.Pending()
+		if len(pending) != 2 || string(pending[0].Body) != "one" || string(pending[1].Body) != "three" {
+			t.Fatal("unexpected pending entries", pending)
+		}
+		id, _ := j.Append([]byte("four"))
+		if id <= pending[1].ID {
+			t.Error("expected ids to keep increasing after reopening")
+		}
+	})
+
+	t.Run("torn record", func(t *testing.T) {
+		file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		file.Write([]byte("{\"id\":99,\"bo"))
+		file.Close()
+		j, err := Open(path)
+		if err != nil {
+			t.Fatal("failed to open journal", err)
+		}
+		defer j.Close()
+		if len(j.Pending()) != 3 {
+			t.Fatal("expected torn record to be skipped", j.Pending())
+		}
+	})
+}
+
+func TestCompact(t *testing.T) {
+	path, cleanup := createTempJournalPath(t)
+	defer cleanup()
+
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal("failed to open journal", err)
+	}
+	defer j.Close()
+	var ids []uint64
+	for i := 0; i < 10; i++ {
+		id, _ := j.Append([]byte("body"))
+		ids = append(ids, id)
+	}
+	for _, id := range ids[:9] {
+		j.Done(id)
+	}
+	before := j.Stats().Size
+	err = j.Compact()
+	if err != nil {
+		t.Fatal("failed to compact", err)
+	}
+	after := j.Stats()
+	if after.Size >= before || after.Pending != 1 {
+		t.Error("expected journal to shrink to one entry", before, after)
+	}
+	info, _ := os.Stat(path)
+	if info.Size() != after.Size {
+		t.Error("expected stats size to match file size", info.Size(), after.Size)
+	}
+	id, err := j.Append([]byte("more"))
+	if err != nil || id <= ids[9] {
+		t.Error("expected append to work after compaction", err)
+	}
+}
+
+func TestCompactKeepsNextID(t *testing.T) {
+	path, cleanup := createTempJournalPath(t)
+	defer cleanup()
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal("failed to open journal", err)
+	}
+	id1, _ := j.Append([]byte("one"))
+	id2, _ := j.Append([]byte("two"))
+	j.Done(id1)
+	j.Done(id2)
+	j.Close()
+	for i := 0; i < 2; i++ {
+		// reopening compacts the journal, leaving no entries
+		j, err = Open(path)
+		if err != nil {
+			t.Fatal("failed to reopen journal", err)
+		}
+		if len(j.Pending()) != 0 {
+			t.Error("unexpected pending entries", j.Pending())
+		}
+		id, _ := j.Append([]byte("three"))
+		if id <= id2 {
+			t.Error("expected ids not to be reused once the journal is empty", id, id2)
+		}
+		id2 = id
+		j.Done(id)
+		j.Close()
+	}
+}
+
+func TestCompactFailure(t *testing.T) {
+	path, cleanup := createTempJournalPath(t)
+	defer cleanup()
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal("failed to open journal", err)
+	}
+	defer j.Close()
+	// a directory in the journal's place makes the rename fail
+	os.Rename(path, path+".moved")
+	os.MkdirAll(filepath.Join(path, "x"), 0700)
+	if err := j.Compact(); err == nil {
+		t.Fatal("expected compaction to fail")
+	}
+	if _, err := j.Append([]byte("one")); err != nil {
+		t.Error("expected the journal to keep working after a failed compaction", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("expected the compacted file to be removed", err)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	path, cleanup := createTempJournalPath(t)
+	defer cleanup()
+	j, err := Open(path)
+	if err != nil {
+		t.Fatal("failed to open journal", err)
+	}
+	id1, _ := j.Append([]byte("one"))
+	id2, _ := j.Append([]byte("two"))
+	err = j.DeadLetter(id1, errors.New("oops"))
+	if err != nil {
+		t.Fatal("failed to dead letter", err)
+	}
+	pending := j.Pending()
+	if len(pending) != 1 || pending[0].ID != id2 {
+		t.Error("expected dead letter to be marked as done", pending)
+	}
+	if j.Stats().DeadLetters != 1 {
+		t.Error("expected dead letter to be counted", j.Stats())
+	}
+	j.Close()
+
+	dead, err := ioutil.ReadFile(path + ".dead")
+	if err != nil {
+		t.Fatal("failed to read dead letter file", err)
+	}
+	var r record
+	if err := json.Unmarshal(dead, &r); err != nil || r.ID != id1 || string(r.Body) != "one" || r.Error != "oops" {
+		t.Error("unexpected dead letter", string(dead), err)
+	}
+
+	j, err = Open(path)
+	if err != nil {
+		t.Fatal("failed to reopen journal", err)
+	}
+	defer j.Close()
+	if len(j.Pending()) != 1 {
+		t.Error("expected dead letter not to be replayed", j.Pending())
+	}
+}
@@ -0,0 +1,260 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/types"
+)
+
+// Media types of the manifests that RegStat understands.
+const (
+	MediaTypeDockerManifest              = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList          = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerSchema1Manifest       = "application/vnd.docker.distribution.manifest.v1+json"
+	MediaTypeDockerSchema1SignedManifest = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	MediaTypeOCIManifest                 = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex                    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIArtifactManifest         = "application/vnd.oci.artifact.manifest.v1+json"
+)
+
+// Media types of the image configs that RegStat understands.
+const (
+	MediaTypeDockerImageConfig = "application/vnd.docker.container.image.v1+json"
+	MediaTypeOCIImageConfig    = "application/vnd.oci.image.config.v1+json"
+)
+
+// MediaTypeDockerLayer is the media type of a Docker image layer, which
+// schema1 manifests imply rather than record.
+const MediaTypeDockerLayer = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+// acceptedMediaTypes are the manifest types requested from the registry. The
+// registry refuses to return a manifest whose type isn't listed, other than
+// the manifests of artifacts of any other type, which the wildcard accepts.
+var acceptedMediaTypes = []string{
+	MediaTypeOCIManifest,
+	MediaTypeOCIIndex,
+	MediaTypeOCIArtifactManifest,
+	MediaTypeDockerManifest,
+	MediaTypeDockerManifestList,
+	MediaTypeDockerSchema1SignedManifest,
+	MediaTypeDockerSchema1Manifest,
+	"*/*",
+}
+
+// UserAgent identifies the requests that RegStat makes to the registry, so
+// that the pull events they cause can be told apart from those of clients.
+const UserAgent = "regstat"
+
+// maxManifestSize is the largest manifest that will be read from the registry;
+// the registry itself refuses to store manifests larger than 4MiB.
+const maxManifestSize = 4 << 20
+
+// maxBlobSize is the largest blob that will be read from the registry. Only
+// small blobs, such as image configs, are fetched.
+const maxBlobSize = 4 << 20
+
+// HTTPClient is the subset of http.Client used to talk to the registry.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Fetcher retrieves content from a Docker registry.
+type Fetcher interface {
+	// GetManifest fetches the manifest at the given URL, as found in a
+	// notification event, returning its media type and raw body.
+	GetManifest(url string) (string, []byte, error)
+	// GetBlob fetches the blob at the given URL, returning its raw body.
+	GetBlob(url string) ([]byte, error)
+}
+
+// FetcherImpl is a Fetcher that authenticates with the registry using the
+// credentials in a Docker config.json file. It supports registries that
+// use either basic auth or token auth.
+type FetcherImpl struct {
+	httpClient HTTPClient
+	auths      map[string]types.AuthConfig
+}
+
+// CreateFetcher creates a fetcher that uses the given HTTP client and the
+// credentials, if any, of the given Docker config.
+func CreateFetcher(httpClient HTTPClient, dockerConfig *configfile.ConfigFile) FetcherImpl {
+	f := FetcherImpl{httpClient: httpClient}
+	if dockerConfig != nil {
+		f.auths = dockerConfig.AuthConfigs
+	}
+	return f
+}
+
+// GetManifest fetches a manifest, returning its media type and raw body.
+func (f FetcherImpl) GetManifest(manifestURL string) (string, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, manifestURL, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Accept", strings.Join(acceptedMediaTypes, ", "))
+	resp, err := f.do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("failed to fetch %s: %s", manifestURL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(body) > maxManifestSize {
+		return "", nil, fmt.Errorf("manifest %s is larger than %d bytes", manifestURL, maxManifestSize)
+	}
+	mediaType := resp.Header.Get("Content-Type")
+	if i := strings.Index(mediaType, ";"); i >= 0 {
+		mediaType = strings.TrimSpace(mediaType[:i])
+	}
+	return mediaType, body, nil
+}
+
+// GetBlob fetches a blob, returning its raw body. A blob larger than
+// maxBlobSize is refused rather than truncated.
+func (f FetcherImpl) GetBlob(blobURL string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, blobURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: %s", blobURL, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBlobSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBlobSize {
+		return nil, fmt.Errorf("blob %s is larger than %d bytes", blobURL, maxBlobSize)
+	}
+	return body, nil
+}
+
+// do sends the request and, if the registry challenges it, sends it again
+// with the credentials that the challenge asks for.
+func (f FetcherImpl) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("User-Agent", UserAgent)
+	resp, err := f.httpClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	user, password, ok := f.credentials(req.URL.Host)
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !ok {
+			return nil, fmt.Errorf("no credentials for %s", req.URL.Host)
+		}
+		req.SetBasicAuth(user, password)
+	case "bearer":
+		token, err := f.getToken(params, user, password, ok)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	default:
+		return nil, fmt.Errorf("unsupported auth challenge from %s: %q", req.URL.Host, scheme)
+	}
+	return f.httpClient.Do(req)
+}
+
+// getToken obtains a bearer token from the registry's token service.
+func (f FetcherImpl) getToken(params map[string]string, user string, password string, hasCredentials bool) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid token realm %q", params["realm"])
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if hasCredentials {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := f.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get token from %s: %s", realm.Host, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	if token.AccessToken != "" {
+		return token.AccessToken, nil
+	}
+	return "", fmt.Errorf("no token in response from %s", realm.Host)
+}
+
+// credentials finds the user name and password for a registry host in the
+// Docker config, which may key them by host name or by URL.
+func (f FetcherImpl) credentials(host string) (string, string, bool) {
+	for _, key := range []string{host, "https://" + host, "http://" + host} {
+		auth, ok := f.auths[key]
+		if !ok {
+			continue
+		}
+		if auth.Username != "" {
+			return auth.Username, auth.Password, true
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err == nil {
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) == 2 {
+				return parts[0], parts[1], true
+			}
+		}
+	}
+	return "", "", false
+}
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// parseChallenge splits a WWW-Authenticate header into its scheme and
+// parameters, e.g. Bearer realm="https://auth.example.com/token",service="registry".
+func parseChallenge(header string) (string, map[string]string) {
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	params := map[string]string{}
+	if len(parts) == 2 {
+		for _, match := range challengeParam.FindAllStringSubmatch(parts[1], -1) {
+			params[strings.ToLower(match[1])] = match[2]
+		}
+	}
+	return parts[0], params
+}
@@ -0,0 +1,191 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/docker/cli/cli/config/types"
+)
+
+const testManifest = "{\"schemaVersion\":2}"
+
+func serveManifest(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Accept"), MediaTypeOCIManifest) {
+		http.Error(w, "OCI manifest found, but accept header does not support OCI manifests", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", MediaTypeOCIManifest)
+	fmt.Fprint(w, testManifest)
+}
+
+func createDockerConfig(server *httptest.Server, auth types.AuthConfig) *configfile.ConfigFile {
+	host, _ := url.Parse(server.URL)
+	return &configfile.ConfigFile{AuthConfigs: map[string]types.AuthConfig{host.Host: auth}}
+}
+
+func TestGetManifest(t *testing.T) {
+	t.Run("anonymous", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(serveManifest))
+		defer server.Close()
+		f := CreateFetcher(server.Client(), nil)
+		mediaType, body, err := f.GetManifest(server.URL + "/v2/hello/manifests/sha256:boo")
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if mediaType != MediaTypeOCIManifest || string(body) != testManifest {
+			t.Error("unexpected manifest", mediaType, string(body))
+		}
+	})
+
+	t.Run("user agent", func(t *testing.T) {
+		var userAgent string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userAgent = r.Header.Get("User-Agent")
+			serveManifest(w, r)
+		}))
+		defer server.Close()
+		f := CreateFetcher(server.Client(), nil)
+		f.GetManifest(server.URL + "/v2/hello/manifests/sha256:boo")
+		if userAgent != UserAgent {
+			t.Errorf("expected user agent %q; got %q", UserAgent, userAgent)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		defer server.Close()
+		f := CreateFetcher(server.Client(), nil)
+		_, _, err := f.GetManifest(server.URL + "/v2/hello/manifests/sha256:boo")
+		if err == nil || !strings.Contains(err.Error(), "404") {
+			t.Errorf("expected 404 error; got %v", err)
+		}
+	})
+
+	t.Run("basic auth", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, password, ok := r.BasicAuth()
+			if !ok || user != "joe" || password != "secret" {
+				w.Header().Set("WWW-Authenticate", "Basic realm=\"registry\"")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			serveManifest(w, r)
+		}))
+		defer server.Close()
+		// credentials as written by docker login
+		f := CreateFetcher(server.Client(), createDockerConfig(server, types.AuthConfig{Auth: "am9lOnNlY3JldA=="}))
+		_, body, err := f.GetManifest(server.URL + "/v2/hello/manifests/sha256:boo")
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if string(body) != testManifest {
+			t.Error("unexpected manifest", string(body))
+		}
+
+		f = CreateFetcher(server.Client(), nil)
+		_, _, err = f.GetManifest(server.URL + "/v2/hello/manifests/sha256:boo")
+		if err == nil || !strings.Contains(err.Error(), "no credentials") {
+			t.Errorf("expected no credentials error; got %v", err)
+		}
+	})
+
+	t.Run("token auth", func(t *testing.T) {
+		var server *httptest.Server
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				user, password, ok := r.BasicAuth()
+				if !ok || user != "joe" || password != "secret" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if r.URL.Query().Get("service") != "registry" || r.URL.Query().Get("scope") != "repository:hello:pull" {
+					t.Error("unexpected token request", r.URL.RawQuery)
+				}
+				fmt.Fprint(w, "{\"token\":\"t0k3n\"}")
+				return
+			}
+			if r.Header.Get("Authorization") != "Bearer t0k3n" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(
+					"Bearer realm=\"%s/token\",service=\"registry\",scope=\"repository:hello:pull\"", server.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			serveManifest(w, r)
+		}))
+		defer server.Close()
+		f := CreateFetcher(server.Client(), createDockerConfig(server, types.AuthConfig{Username: "joe", Password: "secret"}))
+		_, body, err := f.GetManifest(server.URL + "/v2/hello/manifests/sha256:boo")
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if string(body) != testManifest {
+			t.Error("unexpected manifest", string(body))
+		}
+
+		f = CreateFetcher(server.Client(), createDockerConfig(server, types.AuthConfig{Username: "joe", Password: "wrong"}))
+		_, _, err = f.GetManifest(server.URL + "/v2/hello/manifests/sha256:boo")
+		if err == nil || !strings.Contains(err.Error(), "failed to get token") {
+			t.Errorf("expected token error; got %v", err)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(make([]byte, maxManifestSize+1))
+		}))
+		defer server.Close()
+		f := CreateFetcher(server.Client(), nil)
+		_, _, err := f.GetManifest(server.URL + "/v2/hello/manifests/sha256:boo")
+		if err == nil || !strings.Contains(err.Error(), "larger than") {
+			t.Errorf("expected too large error; got %v", err)
+		}
+	})
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge("Bearer realm=\"https://auth.example.com/token\",service=\"registry.example.com\",scope=\"repository:a/b:pull\"")
+	if scheme != "Bearer" {
+		t.Errorf("expected Bearer; got %s", scheme)
+	}
+	if params["realm"] != "https://auth.example.com/token" || params["service"] != "registry.example.com" || params["scope"] != "repository:a/b:pull" {
+		t.Error("unexpected params", params)
+	}
+}
+
+func TestGetBlob(t *testing.T) {
+	t.Run("config", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/v2/hello/blobs/sha256:c0ffee" {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, "{\"os\":\"linux\"}")
+		}))
+		defer server.Close()
+		f := CreateFetcher(server.Client(), nil)
+		body, err := f.GetBlob(server.URL + "/v2/hello/blobs/sha256:c0ffee")
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if string(body) != "{\"os\":\"linux\"}" {
+			t.Error("unexpected blob", string(body))
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(make([]byte, maxBlobSize+1))
+		}))
+		defer server.Close()
+		f := CreateFetcher(server.Client(), nil)
+		_, err := f.GetBlob(server.URL + "/v2/hello/blobs/sha256:c0ffee")
+		if err == nil || !strings.Contains(err.Error(), "larger than") {
+			t.Errorf("expected too large error; got %v", err)
+		}
+	})
+}
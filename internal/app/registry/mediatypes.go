@@ -0,0 +1,95 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// The roles that registry content plays in an image.
+const (
+	// RoleManifest is an image manifest, manifest list or image index.
+	RoleManifest = "manifest"
+	// RoleConfig is the config blob of an image.
+	RoleConfig = "config"
+	// RoleLayer is a layer blob of an image.
+	RoleLayer = "layer"
+	// RoleForeign is a layer blob that is normally fetched from elsewhere,
+	// e.g. a Windows base layer, rather than from the registry.
+	RoleForeign = "foreign"
+)
+
+// defaultRoles classifies the media types in common use.
+var defaultRoles = map[string]string{
+	MediaTypeDockerManifest:                                        RoleManifest,
+	MediaTypeDockerManifestList:                                    RoleManifest,
+	MediaTypeDockerSchema1Manifest:                                 RoleManifest,
+	MediaTypeDockerSchema1SignedManifest:                           RoleManifest,
+	MediaTypeOCIManifest:                                           RoleManifest,
+	MediaTypeOCIIndex:                                              RoleManifest,
+	MediaTypeOCIArtifactManifest:                                   RoleManifest,
+	MediaTypeDockerImageConfig:                                     RoleConfig,
+	"application/vnd.docker.plugin.v1+json":                        RoleConfig,
+	MediaTypeOCIImageConfig:                                        RoleConfig,
+	"application/octet-stream":                                     RoleLayer,
+	"application/vnd.docker.image.rootfs.diff.tar.gzip":            RoleLayer,
+	"application/vnd.oci.image.layer.v1.tar":                       RoleLayer,
+	"application/vnd.oci.image.layer.v1.tar+gzip":                  RoleLayer,
+	"application/vnd.oci.image.layer.v1.tar+zstd":                  RoleLayer,
+	"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    RoleForeign,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar":      RoleForeign,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip": RoleForeign,
+	"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd": RoleForeign,
+}
+
+// MediaTypes classifies media types by the role that content of that type
+// plays in an image. The media types in common use are classified by
+// default; Roles adds to, or overrides, those defaults.
+//
+// e.g. media-types.json ...
+//
+//	{
+//	  "application/vnd.example.layer.v1.tar+lz4": "layer",
+//	  "application/vnd.example.config.v1+json": "config"
+//	}
+type MediaTypes struct {
+	Roles map[string]string
+}
+
+// Role returns the role of content of the given media type, or an empty
+// string if the media type isn't known.
+func (m *MediaTypes) Role(mediaType string) string {
+	if m != nil {
+		if role, ok := m.Roles[mediaType]; ok {
+			return role
+		}
+	}
+	return defaultRoles[mediaType]
+}
+
+// CreateMediaTypes creates a media types object from a JSON config file, or
+// one that holds just the defaults if no file is given.
+func CreateMediaTypes(mediaTypesFile string) (*MediaTypes, error) {
+	mediaTypes := &MediaTypes{}
+	if mediaTypesFile == "" {
+		return mediaTypes, nil
+	}
+	file, err := os.Open(mediaTypesFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	err = json.NewDecoder(bufio.NewReader(file)).Decode(&mediaTypes.Roles)
+	if err != nil {
+		return nil, err
+	}
+	for mediaType, role := range mediaTypes.Roles {
+		switch role {
+		case RoleManifest, RoleConfig, RoleLayer, RoleForeign:
+		default:
+			return nil, fmt.Errorf("unknown role %q for media type %s", role, mediaType)
+		}
+	}
+	return mediaTypes, nil
+}
@@ -0,0 +1,72 @@
+package registry
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRole(t *testing.T) {
+	mediaTypes := &MediaTypes{Roles: map[string]string{
+		"application/vnd.example.layer.v1.tar+lz4": RoleLayer,
+		"application/octet-stream":                 RoleConfig,
+	}}
+	tests := []struct {
+		mediaType string
+		role      string
+	}{
+		{MediaTypeOCIIndex, RoleManifest},
+		{"application/vnd.docker.container.image.v1+json", RoleConfig},
+		{"application/vnd.oci.image.layer.v1.tar+zstd", RoleLayer},
+		{"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", RoleForeign},
+		{"application/vnd.example.layer.v1.tar+lz4", RoleLayer},
+		{"application/octet-stream", RoleConfig},
+		{"text/plain", ""},
+	}
+	for _, test := range tests {
+		if role := mediaTypes.Role(test.mediaType); role != test.role {
+			t.Errorf("expected %s -> %q; got %q", test.mediaType, test.role, role)
+		}
+	}
+	var defaults *MediaTypes
+	if defaults.Role("application/octet-stream") != RoleLayer {
+		t.Error("expected nil media types to use the defaults")
+	}
+}
+
+func TestCreateMediaTypes(t *testing.T) {
+	t.Run("no file", func(t *testing.T) {
+		mediaTypes, err := CreateMediaTypes("")
+		if mediaTypes == nil || err != nil {
+			t.Fatalf("expected media types and nil error; got %s", err)
+		}
+		mediaTypes, err = CreateMediaTypes("no-such-file")
+		if err == nil || mediaTypes != nil {
+			t.Fatal("expected error and nil media types")
+		}
+	})
+	t.Run("unknown role", func(t *testing.T) {
+		file := createTempFile(t)
+		defer os.Remove(file.Name())
+		file.Write([]byte("{\"text/plain\":\"document\"}"))
+		mediaTypes, err := CreateMediaTypes(file.Name())
+		if err == nil || mediaTypes != nil {
+			t.Fatal("expected error and nil media types")
+		}
+		if !strings.Contains(err.Error(), "unknown role") {
+			t.Errorf("expected unknown role error; got %s", err)
+		}
+	})
+	t.Run("valid json", func(t *testing.T) {
+		file := createTempFile(t)
+		defer os.Remove(file.Name())
+		file.Write([]byte("{\"application/vnd.example.layer.v1.tar+lz4\":\"layer\"}"))
+		mediaTypes, err := CreateMediaTypes(file.Name())
+		if mediaTypes == nil || err != nil {
+			t.Fatalf("expected media types and nil error; got %s", err)
+		}
+		if mediaTypes.Role("application/vnd.example.layer.v1.tar+lz4") != RoleLayer {
+			t.Error("expected lz4 layer")
+		}
+	})
+}
@@ -0,0 +1,47 @@
+package mock
+
+import (
+	"fmt"
+)
+
+// Content is a canned response of the mock Fetcher.
+type Content struct {
+	MediaType string
+	Body      string
+}
+
+// Fetcher is a mock implementation of registry.Fetcher
+type Fetcher struct {
+	Manifests map[string]Content
+	Blobs     map[string]string
+	Err       error
+}
+
+// CreateFetcher creates a mock Fetcher implementation
+func CreateFetcher() Fetcher {
+	return Fetcher{Manifests: map[string]Content{}, Blobs: map[string]string{}}
+}
+
+// GetManifest returns the canned manifest for the URL, or the mock error.
+func (f Fetcher) GetManifest(url string) (string, []byte, error) {
+	if f.Err != nil {
+		return "", nil, f.Err
+	}
+	content, ok := f.Manifests[url]
+	if !ok {
+		return "", nil, fmt.Errorf("failed to fetch %s: 404 Not Found", url)
+	}
+	return content.MediaType, []byte(content.Body), nil
+}
+
+// GetBlob returns the canned blob for the URL, or the mock error.
+func (f Fetcher) GetBlob(url string) ([]byte, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	body, ok := f.Blobs[url]
+	if !ok {
+		return nil, fmt.Errorf("failed to fetch %s: 404 Not Found", url)
+	}
+	return []byte(body), nil
+}
@@ -0,0 +1,253 @@
+package regstat
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// AuthConfig holds the settings for authenticating registry notification
+// requests. Every configured method must succeed for a request to be
+// accepted; leaving all of them empty disables authentication. AdminToken is
+// instead the bearer token of the report endpoints, which are refused if it
+// is empty.
+type AuthConfig struct {
+	AdminToken    string
+	Token         string
+	BasicUser     string
+	BasicPassword string
+	HMACSecret    string
+	HMACHeader    string
+	AllowedCIDRs  string
+}
+
+// Authenticator decides whether a registry notification request may be
+// processed. Those that don't need the request body are applied before it's
+// read, so that an unauthenticated client can't make RegStat read one.
+type Authenticator interface {
+	authenticate(r *http.Request, body []byte) error
+	needsBody() bool
+}
+
+// authError is returned by an Authenticator when a request is rejected.
+type authError struct {
+	status    int
+	reason    string
+	challenge string
+}
+
+func (e *authError) Error() string {
+	return fmt.Sprintf("%s: %s", http.StatusText(e.status), e.reason)
+}
+
+func unauthorized(reason string, challenge string) error {
+	return &authError{status: http.StatusUnauthorized, reason: reason, challenge: challenge}
+}
+
+func forbidden(reason string) error {
+	return &authError{status: http.StatusForbidden, reason: reason}
+}
+
+// tokenAuthenticator expects a static bearer token, as sent by the registry
+// when the notification endpoint has an "Authorization: Bearer ..." header.
+type tokenAuthenticator struct {
+	token string
+}
+
+func (a tokenAuthenticator) authenticate(r *http.Request, body []byte) error {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return unauthorized("missing bearer token", "Bearer")
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+		return unauthorized("invalid bearer token", "Bearer")
+	}
+	return nil
+}
+
+func (a tokenAuthenticator) needsBody() bool {
+	return false
+}
+
+// basicAuthenticator expects HTTP basic auth credentials.
+type basicAuthenticator struct {
+	user     string
+	password string
+}
+
+func (a basicAuthenticator) authenticate(r *http.Request, body []byte) error {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return unauthorized("missing basic auth credentials", "Basic realm=\"regstat\"")
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1
+	if !userOK || !passwordOK {
+		return unauthorized("invalid basic auth credentials", "Basic realm=\"regstat\"")
+	}
+	return nil
+}
+
+func (a basicAuthenticator) needsBody() bool {
+	return false
+}
+
+// hmacAuthenticator expects a hex encoded HMAC-SHA256 signature of the
+// request body in the given header, optionally prefixed with "sha256=".
+type hmacAuthenticator struct {
+	secret []byte
+	header string
+}
+
+func (a hmacAuthenticator) authenticate(r *http.Request, body []byte) error {
+	signature := strings.TrimPrefix(r.Header.Get(a.header), "sha256=")
+	if signature == "" {
+		return unauthorized("missing body signature", "")
+	}
+	received, err := hex.DecodeString(signature)
+	if err != nil {
+		return unauthorized("malformed body signature", "")
+	}
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(body)
+	if !hmac.Equal(received, mac.Sum(nil)) {
+		return unauthorized("invalid body signature", "")
+	}
+	return nil
+}
+
+func (a hmacAuthenticator) needsBody() bool {
+	return true
+}
+
+// cidrAuthenticator only accepts requests whose source address lies within
+// one of the allowed networks.
+type cidrAuthenticator struct {
+	networks []*net.IPNet
+}
+
+func (a cidrAuthenticator) authenticate(r *http.Request, body []byte) error {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil {
+		for _, network := range a.networks {
+			if network.Contains(ip) {
+				return nil
+			}
+		}
+	}
+	return forbidden("source address " + host + " not allowed")
+}
+
+func (a cidrAuthenticator) needsBody() bool {
+	return false
+}
+
+// authenticators is an Authenticator that requires all of its members to succeed.
+type authenticators []Authenticator
+
+func (as authenticators) authenticate(r *http.Request, body []byte) error {
+	for _, a := range as {
+		if err := a.authenticate(r, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (as authenticators) needsBody() bool {
+	for _, a := range as {
+		if a.needsBody() {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateHeaders applies those of the given authenticators that only
+// need the request's headers, so that a request can be refused before its
+// body is read. A nil Authenticator accepts every request.
+func authenticateHeaders(a Authenticator, r *http.Request) error {
+	return authenticateEach(a, r, nil, false)
+}
+
+// authenticateBody applies those of the given authenticators that need the
+// request body.
+func authenticateBody(a Authenticator, r *http.Request, body []byte) error {
+	return authenticateEach(a, r, body, true)
+}
+
+func authenticateEach(a Authenticator, r *http.Request, body []byte, needsBody bool) error {
+	if a == nil {
+		return nil
+	}
+	as, ok := a.(authenticators)
+	if !ok {
+		as = authenticators{a}
+	}
+	for _, a := range as {
+		if a.needsBody() != needsBody {
+			continue
+		}
+		if err := a.authenticate(r, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createAuthenticator creates an Authenticator from the given config, or
+// returns nil if no authentication has been configured.
+func createAuthenticator(config AuthConfig) (Authenticator, error) {
+	var as authenticators
+	if config.AllowedCIDRs != "" {
+		a := cidrAuthenticator{}
+		for _, cidr := range strings.Split(config.AllowedCIDRs, ",") {
+			_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				return nil, err
+			}
+			a.networks = append(a.networks, network)
+		}
+		as = append(as, a)
+	}
+	if config.Token != "" && (config.BasicUser != "" || config.BasicPassword != "") {
+		return nil, errors.New("bearer token and basic auth cannot both be used")
+	}
+	if config.Token != "" {
+		as = append(as, tokenAuthenticator{token: config.Token})
+	}
+	if config.BasicUser != "" || config.BasicPassword != "" {
+		as = append(as, basicAuthenticator{user: config.BasicUser, password: config.BasicPassword})
+	}
+	if config.HMACSecret != "" {
+		header := config.HMACHeader
+		if header == "" {
+			header = "X-Regstat-Signature"
+		}
+		as = append(as, hmacAuthenticator{secret: []byte(config.HMACSecret), header: header})
+	}
+	if len(as) == 0 {
+		return nil, nil
+	}
+	return as, nil
+}
+
+// createAdminAuthenticator creates the Authenticator of the report endpoints
+// from the given config, or returns nil if no admin token has been configured.
+func createAdminAuthenticator(config AuthConfig) Authenticator {
+	if config.AdminToken == "" {
+		return nil
+	}
+	return tokenAuthenticator{token: config.AdminToken}
+}
@@ -0,0 +1,156 @@
+package regstat
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func createAuthRequest(body string) *http.Request {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.RemoteAddr = "10.1.2.3:4567"
+	return r
+}
+
+func expectAuthStatus(t *testing.T, err error, status int) {
+	t.Helper()
+	if status == 0 {
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		return
+	}
+	authErr, ok := err.(*authError)
+	if !ok {
+		t.Fatalf("expected auth error; got %v", err)
+	}
+	if authErr.status != status {
+		t.Errorf("expected status %d; got %d", status, authErr.status)
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	a := tokenAuthenticator{token: "secret"}
+
+	r := createAuthRequest("")
+	expectAuthStatus(t, a.authenticate(r, nil), http.StatusUnauthorized)
+
+	r.Header.Set("Authorization", "Bearer wrong")
+	expectAuthStatus(t, a.authenticate(r, nil), http.StatusUnauthorized)
+
+	r.Header.Set("Authorization", "Bearer secret")
+	expectAuthStatus(t, a.authenticate(r, nil), 0)
+}
+
+func TestBasicAuthenticator(t *testing.T) {
+	a := basicAuthenticator{user: "registry", password: "pw"}
+
+	r := createAuthRequest("")
+	expectAuthStatus(t, a.authenticate(r, nil), http.StatusUnauthorized)
+
+	r.SetBasicAuth("registry", "wrong")
+	expectAuthStatus(t, a.authenticate(r, nil), http.StatusUnauthorized)
+
+	r.SetBasicAuth("registry", "pw")
+	expectAuthStatus(t, a.authenticate(r, nil), 0)
+}
+
+func TestHMACAuthenticator(t *testing.T) {
+	a := hmacAuthenticator{secret: []byte("secret"), header: "X-Regstat-Signature"}
+	body := []byte("{\"events\":[]}")
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	signature := hex.EncodeToString(mac.Sum(nil))
+
+	r := createAuthRequest("")
+	expectAuthStatus(t, a.authenticate(r, body), http.StatusUnauthorized)
+
+	r.Header.Set("X-Regstat-Signature", "zzz")
+	expectAuthStatus(t, a.authenticate(r, body), http.StatusUnauthorized)
+
+	r.Header.Set("X-Regstat-Signature", signature)
+	expectAuthStatus(t, a.authenticate(r, []byte("tampered")), http.StatusUnauthorized)
+	expectAuthStatus(t, a.authenticate(r, body), 0)
+
+	r.Header.Set("X-Regstat-Signature", "sha256="+signature)
+	expectAuthStatus(t, a.authenticate(r, body), 0)
+}
+
+func TestCIDRAuthenticator(t *testing.T) {
+	a, err := createAuthenticator(AuthConfig{AllowedCIDRs: "192.168.0.0/16, 10.1.0.0/16"})
+	if err != nil {
+		t.Fatal("failed to create authenticator", err)
+	}
+
+	r := createAuthRequest("")
+	expectAuthStatus(t, a.authenticate(r, nil), 0)
+
+	r.RemoteAddr = "172.16.0.1:1234"
+	expectAuthStatus(t, a.authenticate(r, nil), http.StatusForbidden)
+}
+
+func TestCreateAuthenticator(t *testing.T) {
+	t.Run("none", func(t *testing.T) {
+		a, err := createAuthenticator(AuthConfig{})
+		if err != nil || a != nil {
+			t.Fatal("expected nil authenticator and nil err")
+		}
+	})
+
+	t.Run("bad cidr", func(t *testing.T) {
+		_, err := createAuthenticator(AuthConfig{AllowedCIDRs: "rubbish"})
+		if err == nil {
+			t.Fatal("expected non nil err")
+		}
+	})
+
+	t.Run("token and basic", func(t *testing.T) {
+		_, err := createAuthenticator(AuthConfig{Token: "a", BasicUser: "b"})
+		if err == nil {
+			t.Fatal("expected non nil err")
+		}
+	})
+
+	t.Run("combined", func(t *testing.T) {
+		a, err := createAuthenticator(AuthConfig{Token: "secret", AllowedCIDRs: "10.0.0.0/8"})
+		if err != nil {
+			t.Fatal("failed to create authenticator", err)
+		}
+		r := createAuthRequest("")
+		r.Header.Set("Authorization", "Bearer secret")
+		expectAuthStatus(t, a.authenticate(r, nil), 0)
+		r.RemoteAddr = "192.168.0.1:1234"
+		expectAuthStatus(t, a.authenticate(r, nil), http.StatusForbidden)
+	})
+}
+
+func TestAuthenticateHeadersAndBody(t *testing.T) {
+	a, err := createAuthenticator(AuthConfig{Token: "secret", HMACSecret: "secret"})
+	if err != nil {
+		t.Fatal("failed to create authenticator", err)
+	}
+	r := createAuthRequest("")
+	r.Header.Set("Authorization", "Bearer secret")
+	expectAuthStatus(t, authenticateHeaders(a, r), 0)
+	expectAuthStatus(t, authenticateBody(a, r, []byte("{}")), http.StatusUnauthorized)
+
+	r.Header.Set("Authorization", "Bearer wrong")
+	expectAuthStatus(t, authenticateHeaders(a, r), http.StatusUnauthorized)
+
+	expectAuthStatus(t, authenticateHeaders(nil, r), 0)
+	expectAuthStatus(t, authenticateBody(nil, r, nil), 0)
+}
+
+func TestCreateAdminAuthenticator(t *testing.T) {
+	if createAdminAuthenticator(AuthConfig{Token: "secret"}) != nil {
+		t.Error("expected no admin authenticator without an admin token")
+	}
+	a := createAdminAuthenticator(AuthConfig{AdminToken: "admin"})
+	r := createAuthRequest("")
+	r.Header.Set("Authorization", "Bearer admin")
+	expectAuthStatus(t, a.authenticate(r, nil), 0)
+}
@@ -0,0 +1,43 @@
+package regstat
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// handleHealthz reports that the server is alive. It doesn't check any of the
+// server's dependencies, so a failing database doesn't get the server killed.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the server is ready to process notifications:
+// it must not be shutting down, and the database must be reachable and have
+// the expected schema version.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.pool.isStopped() {
+		http.Error(w, errStopped.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	err := s.db.Ping()
+	if err == nil {
+		err = s.db.CheckSchema()
+	}
+	if err != nil {
+		log.Println("not ready", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+// handleDebugVars serves the expvar counters and gauges, which count the
+// rejected requests and describe the journal, to requests that provide the
+// admin credentials.
+func (s *server) handleDebugVars(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	expvar.Handler().ServeHTTP(w, r)
+}
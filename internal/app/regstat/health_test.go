@@ -0,0 +1,92 @@
+package regstat
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vleurgat/regstat/internal/app/database/mock"
+)
+
+// adminToken is the admin token of the test servers, which serveRequest sends
+// with every request.
+const adminToken = "admin"
+
+func serveRequest(s *server, method string, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(""))
+	r.Header.Set("Authorization", "Bearer "+adminToken)
+	s.routes().ServeHTTP(w, r)
+	return w
+}
+
+func TestRoutes(t *testing.T) {
+	s := &server{db: mock.CreateDatabase(), workflow: createMockWorkflow(), adminAuth: tokenAuthenticator{token: adminToken}}
+	startPool(s, 1)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"POST", "/v1/events", http.StatusOK},
+		{"GET", "/v1/events", http.StatusMethodNotAllowed},
+		{"POST", "/", http.StatusNotFound},
+		{"GET", "/healthz", http.StatusOK},
+		{"GET", "/readyz", http.StatusOK},
+		{"GET", "/debug/vars", http.StatusOK},
+		{"GET", "/v1/reports/storage", http.StatusOK},
+		{"GET", "/v1/reports/storage/tags", http.StatusOK},
+		{"GET", "/v1/reports/storage/media-types", http.StatusOK},
+		{"GET", "/v1/reports/pulls", http.StatusOK},
+		{"GET", "/v1/reports/images", http.StatusOK},
+		{"GET", "/v1/reports/referrers?digest=sha256:b00", http.StatusOK},
+		{"GET", "/v1/reports/unsigned-tags", http.StatusOK},
+		{"GET", "/v1/reports/events", http.StatusOK},
+		{"GET", "/v1/reports/pending-enrichments", http.StatusOK},
+		{"POST", "/v1/reports/storage", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		w := serveRequest(s, test.method, test.path)
+		if w.Code != test.status {
+			t.Errorf("%s %s: expected %d; got %d", test.method, test.path, test.status, w.Code)
+		}
+	}
+	if w := serveRequest(s, "GET", "/v1/events"); w.Header().Get("Allow") != "POST" {
+		t.Error("expected Allow header")
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	t.Run("database error", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		db.Err = errors.New("oops")
+		s := &server{db: db, workflow: createMockWorkflow()}
+		startPool(s, 1)
+		if w := serveRequest(s, "GET", "/readyz"); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503; got %d", w.Code)
+		}
+		if w := serveRequest(s, "GET", "/healthz"); w.Code != http.StatusOK {
+			t.Errorf("expected 200; got %d", w.Code)
+		}
+	})
+
+	t.Run("shutting down", func(t *testing.T) {
+		s := &server{db: mock.CreateDatabase(), workflow: createMockWorkflow()}
+		startPool(s, 1)
+		s.pool.stop(context.Background())
+		if w := serveRequest(s, "GET", "/readyz"); w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503; got %d", w.Code)
+		}
+	})
+}
+
+func TestDebugVars(t *testing.T) {
+	s := &server{db: mock.CreateDatabase(), workflow: createMockWorkflow()}
+	if w := serveRequest(s, "GET", "/debug/vars"); w.Code != http.StatusForbidden {
+		t.Errorf("expected counters to be refused without admin credentials; got %d", w.Code)
+	}
+}
@@ -0,0 +1,10 @@
+package regstat
+
+import "expvar"
+
+// counters published via expvar
+var (
+	rejectedRequests = expvar.NewMap("regstat_rejected_requests")
+	workerStats      = expvar.NewMap("regstat_workers")
+	duplicateEvents  = expvar.NewInt("regstat_duplicate_events")
+)
@@ -0,0 +1,265 @@
+package regstat
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/distribution/notifications"
+	"github.com/vleurgat/regstat/internal/app/database"
+)
+
+// retryBackoff is how long a worker waits before retrying an event that
+// failed with a transient error, doubling after each failure up to
+// maxRetryBackoff.
+const (
+	retryBackoff    = 100 * time.Millisecond
+	maxRetryBackoff = 10 * time.Second
+)
+
+var (
+	errQueueFull     = errors.New("notification queue is full")
+	errStopped       = errors.New("server is shutting down")
+	errTooManyEvents = errors.New("notification has more events than the queue can hold")
+)
+
+// envelope tracks the processing of the events of one notification, which
+// may be spread across several workers. If result is not nil then the
+// outcome of the processing is sent to it. If retry is set then its events
+// are retried in place after a transient failure even if the pool's aren't,
+// as for a notification replayed from the journal, which nothing else would
+// retry.
+type envelope struct {
+	id        uint64
+	remaining int64
+	result    chan error
+	retry     bool
+	mutex     sync.Mutex
+	err       error
+}
+
+func (env *envelope) fail(err error) {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	if env.err == nil {
+		env.err = err
+	}
+}
+
+func (env *envelope) error() error {
+	env.mutex.Lock()
+	defer env.mutex.Unlock()
+	return env.err
+}
+
+// task is an event waiting to be processed by the worker pool.
+type task struct {
+	event    *notifications.Event
+	envelope *envelope
+}
+
+// workerPool processes events using a fixed number of goroutines. Each worker
+// has its own queue and events are assigned to a worker by repository, so the
+// events for a repository are processed one at a time in the order they were
+// received, while those for other repositories are processed in parallel.
+// The total number of queued events is bounded. If retry is set then an event
+// that fails with a transient error is retried in place, holding up the events
+// queued behind it, so that a later notification for the same repository can't
+// overtake it. In sync mode it isn't set, as the registry waits for each
+// notification's outcome and retries a failed one itself.
+type workerPool struct {
+	shards   []chan *task
+	capacity int64
+	queued   int64
+	busy     int64
+	retries  int64
+	backoff  time.Duration
+	retry    bool
+	mutex    sync.Mutex
+	stopped  bool
+	quit     chan struct{}
+	quitOnce sync.Once
+	process  func(event *notifications.Event) error
+	complete func(env *envelope)
+	wg       sync.WaitGroup
+}
+
+// createWorkerPool creates a pool that calls process for each event, and
+// complete once all of an envelope's events have been processed.
+func createWorkerPool(workers int, queueSize int, process func(event *notifications.Event) error, complete func(env *envelope)) *workerPool {
+	p := &workerPool{
+		shards:   make([]chan *task, workers),
+		capacity: int64(queueSize),
+		backoff:  retryBackoff,
+		quit:     make(chan struct{}),
+		process:  process,
+		complete: complete,
+	}
+	for i := range p.shards {
+		p.shards[i] = make(chan *task, queueSize)
+	}
+	workerStats.Set("workers", expvar.Func(func() interface{} { return len(p.shards) }))
+	workerStats.Set("busy", expvar.Func(func() interface{} { return atomic.LoadInt64(&p.busy) }))
+	workerStats.Set("queue_depth", expvar.Func(func() interface{} { return atomic.LoadInt64(&p.queued) }))
+	workerStats.Set("queue_capacity", expvar.Func(func() interface{} { return p.capacity }))
+	workerStats.Set("retries", expvar.Func(func() interface{} { return atomic.LoadInt64(&p.retries) }))
+	return p
+}
+
+func (p *workerPool) start() {
+	for _, shard := range p.shards {
+		p.wg.Add(1)
+		go p.work(shard)
+	}
+}
+
+func (p *workerPool) work(shard chan *task) {
+	defer p.wg.Done()
+	// once the worker gives up retrying an event, every event queued behind it
+	// fails too, so that none of them is applied before it; likewise once the
+	// pool has failed to stop in time, the events still queued fail without
+	// being processed
+	var abandoned error
+	for t := range shard {
+		atomic.AddInt64(&p.queued, -1)
+		atomic.AddInt64(&p.busy, 1)
+		if abandoned == nil && p.quitting() {
+			abandoned = errStopped
+		}
+		// once one of an envelope's events has failed its remaining events are
+		// skipped, so that they're applied in order when the envelope is retried
+		if abandoned != nil {
+			t.envelope.fail(abandoned)
+		} else if t.envelope.error() == nil {
+			retry := p.retry || t.envelope.retry
+			err := p.processWithRetry(t.event, retry)
+			if err != nil {
+				t.envelope.fail(err)
+				if retry && database.IsTransient(err) {
+					abandoned = err
+				}
+			}
+		}
+		atomic.AddInt64(&p.busy, -1)
+		if atomic.AddInt64(&t.envelope.remaining, -1) == 0 {
+			p.complete(t.envelope)
+		}
+	}
+}
+
+// processWithRetry processes an event and, if retry is set, retries it with an
+// increasing backoff for as long as it fails with a transient error. It gives
+// up, returning the last error, once the pool has failed to stop in time.
+func (p *workerPool) processWithRetry(event *notifications.Event, retry bool) error {
+	backoff := p.backoff
+	for {
+		err := p.process(event)
+		if err == nil || !retry || !database.IsTransient(err) {
+			return err
+		}
+		atomic.AddInt64(&p.retries, 1)
+		select {
+		case <-p.quit:
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// shardFor chooses the worker for an event, using its repository or, failing
+// that, its digest.
+func (p *workerPool) shardFor(event *notifications.Event) chan *task {
+	key := event.Target.Repository
+	if key == "" {
+		key = event.Target.Digest.String()
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return p.shards[h.Sum32()%uint32(len(p.shards))]
+}
+
+// submit queues the events of an envelope, without waiting for space to become
+// free. Either all of the events are queued, or none of them are. An envelope
+// with more events than the queue can hold is refused outright, as its events
+// could all belong to one worker, and queueing them would then block while
+// holding the mutex.
+func (p *workerPool) submit(env *envelope, events []notifications.Event) error {
+	n := int64(len(events))
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.stopped {
+		return errStopped
+	}
+	if n > p.capacity {
+		return errTooManyEvents
+	}
+	// each worker's queue holds up to capacity events, so none of them can
+	// fill up while the total stays within capacity
+	if atomic.LoadInt64(&p.queued)+n > p.capacity {
+		return errQueueFull
+	}
+	if n == 0 {
+		p.complete(env)
+		return nil
+	}
+	env.remaining = n
+	atomic.AddInt64(&p.queued, n)
+	for i := range events {
+		p.shardFor(&events[i]) <- &task{event: &events[i], envelope: env}
+	}
+	return nil
+}
+
+// stop stops the pool accepting events, and waits for the workers to finish
+// processing those already queued. It returns false if they didn't finish
+// before the context expired, in which case any worker that is retrying an
+// event gives up, the events still queued are failed, and stop waits for the
+// events that are being processed, so that nothing uses the journal or the
+// database once it returns.
+func (p *workerPool) stop(ctx context.Context) bool {
+	p.mutex.Lock()
+	if !p.stopped {
+		p.stopped = true
+		for _, shard := range p.shards {
+			close(shard)
+		}
+	}
+	p.mutex.Unlock()
+	finished := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-ctx.Done():
+		p.quitOnce.Do(func() { close(p.quit) })
+		<-finished
+		return false
+	}
+}
+
+// quitting reports whether the pool has failed to stop in time.
+func (p *workerPool) quitting() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *workerPool) isStopped() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.stopped
+}
@@ -0,0 +1,266 @@
+package regstat
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/notifications"
+	"github.com/vleurgat/regstat/internal/app/database"
+)
+
+func createPoolEvents(t *testing.T, repositories ...string) []notifications.Event {
+	var events []notifications.Event
+	for i, repository := range repositories {
+		event := createEvent(t, "{\"target\":{\"repository\":\""+repository+"\"}}")
+		event.ID = repository + string(rune('0'+i))
+		events = append(events, *event)
+	}
+	return events
+}
+
+func TestWorkerPool(t *testing.T) {
+	t.Run("per repository order", func(t *testing.T) {
+		var mutex sync.Mutex
+		var processed []string
+		completed := make(chan *envelope, 10)
+		p := createWorkerPool(4, 100, func(event *notifications.Event) error {
+			if event.Target.Repository == "slow" {
+				time.Sleep(time.Millisecond)
+			}
+			mutex.Lock()
+			processed = append(processed, event.ID)
+			mutex.Unlock()
+			return nil
+		}, func(env *envelope) { completed <- env })
+		p.start()
+		p.submit(&envelope{id: 1}, createPoolEvents(t, "slow", "fast", "slow"))
+		p.submit(&envelope{id: 2}, createPoolEvents(t, "slow", "fast"))
+		for i := 0; i < 2; i++ {
+			select {
+			case <-completed:
+			case <-time.After(time.Second):
+				t.Fatal("expected envelopes to complete")
+			}
+		}
+		var slow []string
+		for _, id := range processed {
+			if id[0] == 's' {
+				slow = append(slow, id)
+			}
+		}
+		if len(processed) != 5 || slow[0] != "slow0" || slow[1] != "slow2" || slow[2] != "slow0" {
+			t.Error("expected slow events to be processed in order", processed)
+		}
+	})
+
+	t.Run("unrelated repositories in parallel", func(t *testing.T) {
+		release := make(chan struct{})
+		completed := make(chan *envelope, 10)
+		p := createWorkerPool(2, 100, func(event *notifications.Event) error {
+			if event.Target.Repository == "blocked" {
+				<-release
+			}
+			return nil
+		}, func(env *envelope) { completed <- env })
+		p.start()
+		defer close(release)
+		blocked := createPoolEvents(t, "blocked")
+		// find a repository that is handled by the other worker
+		other := "other"
+		for i := 0; p.shardFor(&createPoolEvents(t, other)[0]) == p.shardFor(&blocked[0]); i++ {
+			other = "other" + string(rune('a'+i))
+		}
+		p.submit(&envelope{id: 1}, blocked)
+		p.submit(&envelope{id: 2}, createPoolEvents(t, other))
+		select {
+		case env := <-completed:
+			if env.id != 2 {
+				t.Error("expected unblocked envelope to complete first")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("expected unrelated repository to be processed")
+		}
+	})
+
+	t.Run("failed event", func(t *testing.T) {
+		completed := make(chan *envelope, 10)
+		var processed []string
+		p := createWorkerPool(1, 100, func(event *notifications.Event) error {
+			processed = append(processed, event.ID)
+			if event.Target.Repository == "bad" {
+				return errQueueFull
+			}
+			return nil
+		}, func(env *envelope) { completed <- env })
+		p.start()
+		p.submit(&envelope{}, createPoolEvents(t, "bad", "good"))
+		env := <-completed
+		if env.error() != errQueueFull {
+			t.Error("expected envelope to have failed", env.error())
+		}
+		if len(processed) != 1 {
+			t.Error("expected events after the failure to be skipped", processed)
+		}
+	})
+
+	t.Run("transient failure in an earlier envelope", func(t *testing.T) {
+		completed := make(chan *envelope, 10)
+		var processed []string
+		failures := 2
+		p := createWorkerPool(1, 100, func(event *notifications.Event) error {
+			processed = append(processed, event.ID)
+			if event.ID == "a0" && failures > 0 {
+				failures--
+				return &database.TransientError{Err: errors.New("oops")}
+			}
+			return nil
+		}, func(env *envelope) { completed <- env })
+		p.retry = true
+		p.backoff = time.Millisecond
+		p.start()
+		before := workerStats.Get("retries").String()
+		p.submit(&envelope{id: 1}, createPoolEvents(t, "a"))
+		p.submit(&envelope{id: 2}, createPoolEvents(t, "b", "a"))
+		for i := 0; i < 2; i++ {
+			select {
+			case env := <-completed:
+				if env.error() != nil {
+					t.Error("expected envelope to succeed once retried", env.id, env.error())
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected envelopes to complete")
+			}
+		}
+		if len(processed) != 5 || processed[2] != "a0" || processed[3] != "b0" || processed[4] != "a1" {
+			t.Error("expected failed event to be retried before the later envelope", processed)
+		}
+		if workerStats.Get("retries").String() != "2" || before != "0" {
+			t.Error("expected retries to be counted", before, workerStats.Get("retries").String())
+		}
+	})
+
+	t.Run("no events", func(t *testing.T) {
+		completed := make(chan *envelope, 10)
+		p := createWorkerPool(1, 1, nil, func(env *envelope) { completed <- env })
+		p.submit(&envelope{}, nil)
+		select {
+		case <-completed:
+		default:
+			t.Error("expected empty envelope to complete immediately")
+		}
+	})
+
+	t.Run("bounded queue", func(t *testing.T) {
+		// a pool that is never started, so nothing is taken from its queues
+		p := createWorkerPool(2, 3, nil, nil)
+		if err := p.submit(&envelope{}, createPoolEvents(t, "a", "b", "a", "b")); err != errTooManyEvents {
+			t.Fatalf("expected envelope larger than the queue to be refused; got %v", err)
+		}
+		// all of the events belong to one worker, which must not block
+		if err := p.submit(&envelope{}, createPoolEvents(t, "a", "a", "a")); err != nil {
+			t.Fatal("expected envelope to be accepted", err)
+		}
+		if err := p.submit(&envelope{}, createPoolEvents(t, "d")); err != errQueueFull {
+			t.Fatalf("expected queue full; got %v", err)
+		}
+		if workerStats.Get("queue_depth").String() != "3" || workerStats.Get("workers").String() != "2" {
+			t.Error("unexpected worker stats", workerStats.String())
+		}
+	})
+}
+
+func TestWorkerPoolStop(t *testing.T) {
+	t.Run("drained", func(t *testing.T) {
+		completed := make(chan *envelope, 10)
+		p := createWorkerPool(2, 100, func(event *notifications.Event) error {
+			time.Sleep(time.Millisecond)
+			return nil
+		}, func(env *envelope) { completed <- env })
+		p.start()
+		p.submit(&envelope{}, createPoolEvents(t, "a", "b", "a", "b"))
+		if !p.stop(context.Background()) {
+			t.Fatal("expected pool to drain")
+		}
+		if len(completed) != 1 {
+			t.Error("expected queued envelope to have been completed")
+		}
+		if err := p.submit(&envelope{}, createPoolEvents(t, "a")); err != errStopped {
+			t.Errorf("expected stopped; got %v", err)
+		}
+	})
+
+	t.Run("abandoned retry", func(t *testing.T) {
+		completed := make(chan *envelope, 10)
+		var processed []string
+		p := createWorkerPool(1, 100, func(event *notifications.Event) error {
+			processed = append(processed, event.ID)
+			if event.Target.Repository == "a" {
+				return &database.TransientError{Err: errors.New("oops")}
+			}
+			return nil
+		}, func(env *envelope) { completed <- env })
+		p.retry = true
+		p.start()
+		p.submit(&envelope{id: 1}, createPoolEvents(t, "a"))
+		p.submit(&envelope{id: 2}, createPoolEvents(t, "b"))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if p.stop(ctx) {
+			t.Fatal("expected pool to not drain")
+		}
+		for i := 0; i < 2; i++ {
+			select {
+			case env := <-completed:
+				if env.error() == nil {
+					t.Error("expected envelope to fail", env.id)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected envelopes to complete")
+			}
+		}
+		for _, id := range processed {
+			if id == "b0" {
+				t.Error("expected event queued behind the abandoned one to be skipped", processed)
+			}
+		}
+	})
+
+	t.Run("timed out", func(t *testing.T) {
+		release := make(chan struct{})
+		completed := make(chan *envelope, 10)
+		var processed []string
+		p := createWorkerPool(1, 100, func(event *notifications.Event) error {
+			<-release
+			processed = append(processed, event.ID)
+			return nil
+		}, func(env *envelope) { completed <- env })
+		p.start()
+		p.submit(&envelope{id: 1}, createPoolEvents(t, "a"))
+		p.submit(&envelope{id: 2}, createPoolEvents(t, "b"))
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+		}()
+		if p.stop(ctx) {
+			t.Fatal("expected pool to not drain")
+		}
+		// stop waits for the event in flight, but not for those still queued
+		if len(processed) != 1 || processed[0] != "a0" {
+			t.Error("expected only the event in flight to be processed", processed)
+		}
+		if len(completed) != 2 {
+			t.Fatal("expected both envelopes to have completed", len(completed))
+		}
+		if env := <-completed; env.id != 1 || env.error() != nil {
+			t.Error("expected envelope in flight to succeed", env.id, env.error())
+		}
+		if env := <-completed; env.id != 2 || env.error() != errStopped {
+			t.Error("expected queued envelope to fail", env.id, env.error())
+		}
+	})
+}
@@ -1,98 +1,616 @@
 package regstat
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/docker/cli/cli/config/configfile"
 	"github.com/docker/distribution/notifications"
-	"github.com/vleurgat/dockerclient/pkg/client"
 	"github.com/vleurgat/dockerclient/pkg/config"
+	"github.com/vleurgat/regstat/internal/app/artifact"
+	"github.com/vleurgat/regstat/internal/app/database"
 	"github.com/vleurgat/regstat/internal/app/database/postgres"
+	"github.com/vleurgat/regstat/internal/app/journal"
 	"github.com/vleurgat/regstat/internal/app/registry"
 )
 
+// Config holds the settings of the RegStat server, as provided on the command line.
+type Config struct {
+	Port                    string
+	PgConnStr               string
+	DockerConfigFile        string
+	EquivRegistriesFile     string
+	MediaTypesFile          string
+	IgnorePullUserAgents    string
+	IgnorePullActors        string
+	DigestPullTags          bool
+	EnrichmentRetryInterval time.Duration
+	Auth                    AuthConfig
+	TLS                     TLSConfig
+	Sync                    bool
+	JournalFile             string
+	Workers                 int
+	QueueSize               int
+	EventIDTTL              time.Duration
+	ShutdownTimeout         time.Duration
+	MaxBodySize             int64
+	CheckContentType        bool
+}
+
+// eventsMediaType is the content type of the notifications sent by the registry.
+const eventsMediaType = "application/vnd.docker.distribution.events.v1+json"
+
+var errTooLarge = errors.New("notification body is too large")
+
+// fetchTimeout bounds each request made to the registry for a manifest.
+const fetchTimeout = 30 * time.Second
+
+// replayBackoff is how long the replay of the journal waits for the queue to
+// make room for a notification.
+const replayBackoff = 100 * time.Millisecond
+
 type server struct {
-	httpServer *http.Server
-	workflow   Workflow
+	httpServer       *http.Server
+	db               database.Database
+	workflow         Workflow
+	auth             Authenticator
+	adminAuth        Authenticator
+	certs            *certReloader
+	sync             bool
+	journal          *journal.Journal
+	pool             *workerPool
+	maxBodySize      int64
+	checkContentType bool
+	// done is closed when the server starts to shut down, which stops the
+	// background tasks counted by background
+	done       chan struct{}
+	background sync.WaitGroup
+}
+
+// envelopeError is returned when a notification body can't be parsed.
+type envelopeError struct {
+	err error
+}
+
+func (e *envelopeError) Error() string {
+	return e.err.Error()
+}
+
+func isEnvelopeError(err error) bool {
+	_, ok := err.(*envelopeError)
+	return ok
 }
 
-func newServer(port string, pgConnStr string, dockerConfig *configfile.ConfigFile, equivRegistries *registry.EquivRegistries) *server {
-	s := server{}
-	s.httpServer = &http.Server{Addr: ":" + port, Handler: http.HandlerFunc(s.handle)}
-	db := postgres.CreateDatabase(pgConnStr)
-	db.CreateSchemaIfNecessary()
-	client := client.CreateClient(dockerConfig)
-	s.workflow = WorkflowImpl{db: db, client: client, eqr: equivRegistries}
+func newServer(config Config, auth Authenticator, adminAuth Authenticator, certs *certReloader, jnl *journal.Journal, dockerConfig *configfile.ConfigFile, equivRegistries *registry.EquivRegistries, mediaTypes *registry.MediaTypes, ignorePulls *pullFilter) *server {
+	s := server{auth: auth, adminAuth: adminAuth, certs: certs, sync: config.Sync, journal: jnl, maxBodySize: config.MaxBodySize, checkContentType: config.CheckContentType,
+		done: make(chan struct{})}
+	s.pool = createWorkerPool(config.Workers, config.QueueSize, s.processEvent, s.completeEnvelope)
+	s.pool.retry = !config.Sync
+	s.httpServer = &http.Server{Addr: ":" + config.Port, Handler: s.routes()}
+	s.db = postgres.CreateDatabase(config.PgConnStr)
+	s.db.CreateSchemaIfNecessary()
+	fetcher := registry.CreateFetcher(&http.Client{Timeout: fetchTimeout}, dockerConfig)
+	s.workflow = WorkflowImpl{db: s.db, fetcher: fetcher, eqr: equivRegistries, mediaTypes: mediaTypes,
+		artifacts: artifact.Default(), ignorePulls: ignorePulls, digestPullTags: config.DigestPullTags,
+		retryInterval: config.EnrichmentRetryInterval}
 	return &s
 }
 
+// routes returns the handler for all of the server's endpoints.
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/events", s.handle)
+	mux.HandleFunc("/v1/reports/storage", s.handleStorageReport)
+	mux.HandleFunc("/v1/reports/storage/tags", s.handleTagStorageReport)
+	mux.HandleFunc("/v1/reports/storage/media-types", s.handleMediaTypeStorageReport)
+	mux.HandleFunc("/v1/reports/pulls", s.handleTagPullsReport)
+	mux.HandleFunc("/v1/reports/images", s.handleTagImagesReport)
+	mux.HandleFunc("/v1/reports/referrers", s.handleReferrersReport)
+	mux.HandleFunc("/v1/reports/unsigned-tags", s.handleUnsignedTagsReport)
+	mux.HandleFunc("/v1/reports/events", s.handleEventsReport)
+	mux.HandleFunc("/v1/reports/pending-enrichments", s.handlePendingEnrichmentsReport)
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/debug/vars", s.handleDebugVars)
+	return mux
+}
+
+// expireProcessedEvents periodically forgets the IDs of events processed more
+// than ttl ago; redeliveries of those events will no longer be detected.
+func (s *server) expireProcessedEvents(ttl time.Duration) {
+	interval := time.Hour
+	if ttl < interval {
+		interval = ttl
+	}
+	s.every(interval, func() {
+		_, err := s.db.ExpireProcessedEvents(ttl)
+		if err != nil {
+			log.Println("failed to expire processed events", err)
+		}
+	})
+}
+
+// retryEnrichments periodically retries the fetches of the pushed manifests
+// that couldn't be fetched at the time.
+func (s *server) retryEnrichments(interval time.Duration) {
+	s.every(interval, func() {
+		err := s.workflow.retryEnrichments(s.done)
+		if err != nil {
+			log.Println("failed to retry pending enrichments", err)
+		}
+	})
+}
+
+// every calls fn at the given interval in the background, until the server
+// shuts down, which waits for any call in progress.
+func (s *server) every(interval time.Duration, fn func()) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				// a tick may be ready at the same time as done
+				select {
+				case <-s.done:
+					return
+				default:
+				}
+				fn()
+			}
+		}
+	}()
+}
+
 func (s *server) listenAndServe() error {
 	listener, err := net.Listen("tcp", s.httpServer.Addr)
 	if err != nil {
 		return err
 	}
-	log.Println("Server now listening on", s.httpServer.Addr)
-	s.httpServer.Serve(listener)
-	return nil
+	if s.certs != nil {
+		listener = tls.NewListener(listener, s.certs.serverConfig())
+		s.certs.reloadOnSignal()
+		log.Println("Server now listening with TLS on", s.httpServer.Addr)
+	} else {
+		log.Println("Server now listening on", s.httpServer.Addr)
+	}
+	return s.httpServer.Serve(listener)
+}
+
+// shutdown stops the server accepting notifications, waits for the events
+// that have already been accepted to be processed, and then closes the
+// journal and the database. It returns false if the events weren't all
+// processed within the timeout; those left unprocessed remain in the journal.
+// Either way the journal and database are only closed once no event is being
+// processed, and the background tasks have stopped.
+func (s *server) shutdown(timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if s.done != nil {
+		close(s.done)
+	}
+	drained := true
+	err := s.httpServer.Shutdown(ctx)
+	if err != nil {
+		log.Println("failed to wait for in-flight requests", err)
+		drained = false
+	}
+	if !s.pool.stop(ctx) {
+		log.Println("timed out waiting for queued events to be processed")
+		drained = false
+	}
+	s.background.Wait()
+	if s.journal != nil {
+		err = s.journal.Close()
+		if err != nil {
+			log.Println("failed to close journal", err)
+			drained = false
+		}
+	}
+	err = s.db.Close()
+	if err != nil {
+		log.Println("failed to close database", err)
+	}
+	return drained
 }
 
 func (s *server) handle(w http.ResponseWriter, r *http.Request) {
-	body, err := ioutil.ReadAll(r.Body)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	err := s.certs.verifyClient(r)
+	if err == nil {
+		err = authenticateHeaders(s.auth, r)
+	}
+	if err != nil {
+		rejectUnauthenticated(w, r, err)
+		return
+	}
+	if s.checkContentType && !isEventsMediaType(r.Header.Get("Content-Type")) {
+		reject(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type",
+			fmt.Errorf("content type must be %s", eventsMediaType))
+		return
+	}
+	body, err := s.readBody(r)
+	if err == errTooLarge {
+		reject(w, r, http.StatusRequestEntityTooLarge, "too_large", err)
+		return
+	}
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "unreadable", err)
+		return
+	}
+	err = authenticateBody(s.auth, r, body)
 	if err != nil {
-		log.Println("error reading request body", err)
+		rejectUnauthenticated(w, r, err)
 		return
 	}
-	go s.processRegistryRequest(body)
+	request, err := parseEnvelope(body)
+	if err != nil {
+		reject(w, r, http.StatusBadRequest, "bad_envelope", err)
+		return
+	}
+	// checked before journalling, as the journal is closed once the pool has
+	// stopped; submit checks again in case the pool stops in the meantime
+	if s.pool.isStopped() {
+		reject(w, r, http.StatusServiceUnavailable, "shutting_down", errStopped)
+		return
+	}
+	env := &envelope{}
+	if s.journal != nil {
+		env.id, err = s.journal.Append(body)
+		if err != nil {
+			log.Println("failed to write to journal", err)
+			http.Error(w, "failed to write to journal", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if s.sync {
+		env.result = make(chan error, 1)
+	}
+	err = s.pool.submit(env, request.Events)
+	if err != nil {
+		if s.journal != nil {
+			s.journal.Done(env.id)
+		}
+		if err == errStopped {
+			reject(w, r, http.StatusServiceUnavailable, "shutting_down", err)
+			return
+		}
+		if err == errTooManyEvents {
+			reject(w, r, http.StatusRequestEntityTooLarge, "too_many_events", err)
+			return
+		}
+		w.Header().Set("Retry-After", "1")
+		reject(w, r, http.StatusTooManyRequests, "queue_full", err)
+		return
+	}
+	if !s.sync {
+		return
+	}
+	err = <-env.result
+	if err != nil {
+		status := statusFor(err)
+		http.Error(w, err.Error(), status)
+	}
 }
 
-func (s *server) processRegistryRequest(body []byte) error {
+// isEventsMediaType reports whether a Content-Type header value is that of
+// registry notifications, ignoring any parameters such as the charset.
+func isEventsMediaType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == eventsMediaType
+}
+
+// readBody reads the request body, returning errTooLarge rather than reading
+// more than maxBodySize bytes of it. A maxBodySize of 0 means no limit.
+func (s *server) readBody(r *http.Request) ([]byte, error) {
+	if s.maxBodySize <= 0 {
+		return ioutil.ReadAll(r.Body)
+	}
+	if r.ContentLength > s.maxBodySize {
+		return nil, errTooLarge
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, s.maxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > s.maxBodySize {
+		return nil, errTooLarge
+	}
+	return body, nil
+}
+
+// statusFor determines the HTTP status to return to the registry when the
+// processing of its notification failed. The registry retries any delivery
+// that gets an error status, the different codes just aid diagnosis; a
+// notification abandoned at shutdown gets a 503, like a transient failure.
+func statusFor(err error) int {
+	if isEnvelopeError(err) {
+		return http.StatusBadRequest
+	}
+	if database.IsTransient(err) || err == errStopped {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// reject responds to a notification request that won't be processed, counting
+// the rejection by reason.
+func reject(w http.ResponseWriter, r *http.Request, status int, reason string, err error) {
+	log.Println("rejecting request from", r.RemoteAddr, err)
+	rejectedRequests.Add(reason, 1)
+	http.Error(w, err.Error(), status)
+}
+
+// rejectUnauthenticated is like reject, but doesn't tell the client why it
+// failed to authenticate. An error that isn't an authError gets a 401.
+func rejectUnauthenticated(w http.ResponseWriter, r *http.Request, err error) {
+	log.Println("rejecting request from", r.RemoteAddr, err)
+	var authErr *authError
+	if !errors.As(err, &authErr) {
+		authErr = &authError{status: http.StatusUnauthorized, reason: err.Error()}
+	}
+	if authErr.status == http.StatusForbidden {
+		rejectedRequests.Add("forbidden", 1)
+	} else {
+		rejectedRequests.Add("unauthorized", 1)
+	}
+	if authErr.challenge != "" {
+		w.Header().Set("WWW-Authenticate", authErr.challenge)
+	}
+	http.Error(w, http.StatusText(authErr.status), authErr.status)
+}
+
+// completeEnvelope is called once all the events of an accepted notification
+// have been processed. The notification's journal entry is marked as done if
+// the processing succeeded, or if the registry is waiting for the outcome, as
+// it then retries a failed notification itself. Otherwise a transient failure,
+// which only ends the processing when the workers give up at shutdown, leaves
+// the entry to be replayed on the next start up, as does an event left
+// unprocessed at shutdown, while any other failure would only fail again, so
+// the entry is moved to the journal's dead letters.
+func (s *server) completeEnvelope(env *envelope) {
+	err := env.error()
+	if s.journal != nil {
+		var journalErr error
+		switch {
+		case err == nil || env.result != nil:
+			journalErr = s.journal.Done(env.id)
+		case !database.IsTransient(err) && err != errStopped:
+			log.Println("moving failed notification to the dead letters", env.id, err)
+			journalErr = s.journal.DeadLetter(env.id, err)
+		}
+		if journalErr != nil {
+			log.Println("failed to update journal", journalErr)
+		}
+	}
+	if env.result != nil {
+		env.result <- err
+	}
+}
+
+// replayJournal queues the notifications left unfinished by a previous run, so
+// that the workers process them, retrying any transient failures even in sync
+// mode, ahead of the notifications that arrive once the server is listening.
+// A notification that can't be parsed, or has more events than the queue can
+// hold, is moved to the journal's dead letters.
+func (s *server) replayJournal() {
+	entries := s.journal.Pending()
+	if len(entries) > 0 {
+		log.Println("replaying", len(entries), "journal entries")
+	}
+	for _, entry := range entries {
+		request, err := parseEnvelope(entry.Body)
+		if err == nil {
+			env := &envelope{id: entry.ID, retry: true}
+			err = s.pool.submit(env, request.Events)
+			for err == errQueueFull {
+				select {
+				case <-s.done:
+					return
+				case <-time.After(replayBackoff):
+				}
+				err = s.pool.submit(env, request.Events)
+			}
+		}
+		if err == errStopped {
+			return
+		}
+		if err != nil {
+			log.Println("moving unreplayable notification to the dead letters", entry.ID, err)
+			if deadErr := s.journal.DeadLetter(entry.ID, err); deadErr != nil {
+				log.Println("failed to update journal", deadErr)
+			}
+		}
+	}
+}
+
+func parseEnvelope(body []byte) (notifications.Envelope, error) {
+	var request notifications.Envelope
 	if len(body) == 0 {
-		return nil
+		return request, nil
 	}
 	//log.Println("request body is", string(body))
-	var request notifications.Envelope
 	err := json.Unmarshal(body, &request)
 	if err != nil {
 		log.Println("json unmarshal error", err)
+		return request, &envelopeError{err: err}
+	}
+	return request, nil
+}
+
+// processRegistryRequest processes the events of a notification one after the
+// other, stopping at the first that fails.
+func (s *server) processRegistryRequest(body []byte) error {
+	request, err := parseEnvelope(body)
+	if err != nil {
 		return err
 	}
-	for _, event := range request.Events {
-		log.Printf("event: %s\n", event.Action)
-		switch event.Action {
-		case "delete":
-			s.workflow.processDelete(&event)
-		case "pull":
-			s.workflow.processPull(&event)
-		case "push":
-			s.workflow.processPush(&event)
-		default:
-			log.Println("unknown event action", event.Action)
+	for i := range request.Events {
+		err = s.processEvent(&request.Events[i])
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+func (s *server) processEvent(event *notifications.Event) error {
+	log.Printf("event: %s\n", event.Action)
+	var err error
+	switch event.Action {
+	case "delete":
+		err = s.workflow.processDelete(event)
+	case "pull":
+		err = s.workflow.processPull(event)
+	case "push":
+		err = s.workflow.processPush(event)
+	case "mount":
+		err = s.workflow.processMount(event)
+	default:
+		log.Println("unknown event action", event.Action)
+	}
+	if err != nil {
+		log.Println("failed to process event", event.ID, err)
+	}
+	return err
+}
+
 // Regstat is the main entry point to the "registry statistics" server. Calling this
 // function will start the server listening on the given port for notifications from
 // a Docker registry and persisting details of those notifications to the configured
 // Postgres database.
-func Regstat(port string, pgConnStr string, dockerConfigFile string, equivRegistriesFile string) {
+//
+// The server runs until it receives a SIGTERM or SIGINT, at which point it stops
+// accepting notifications and drains those already accepted. The returned exit
+// status is 0 if the drain completed and 1 otherwise.
+func Regstat(cfg Config) int {
 	log.Println("start regstat")
 
-	dockerConfig, err := config.CreateConfig(dockerConfigFile)
+	dockerConfig, err := config.CreateConfig(cfg.DockerConfigFile)
+	if err != nil {
+		log.Fatalln("failed to process docker config file", cfg.DockerConfigFile)
+	}
+
+	equivRegistries, err := registry.CreateEquivRegistries(cfg.EquivRegistriesFile)
+	if err != nil {
+		log.Fatalln("failed to process equivalent registries file", cfg.EquivRegistriesFile)
+	}
+
+	mediaTypes, err := registry.CreateMediaTypes(cfg.MediaTypesFile)
 	if err != nil {
-		log.Fatalln("failed to process docker config file", dockerConfigFile)
+		log.Fatalln("failed to process media types file", cfg.MediaTypesFile, err)
 	}
 
-	equivRegistries, err := registry.CreateEquivRegistries(equivRegistriesFile)
+	ignorePulls, err := createPullFilter(cfg.IgnorePullUserAgents, cfg.IgnorePullActors)
 	if err != nil {
-		log.Fatalln("failed to process equivalent registries file", equivRegistriesFile)
+		log.Fatalln("failed to process pull filter options", err)
 	}
 
-	server := newServer(port, pgConnStr, dockerConfig, equivRegistries)
-	server.listenAndServe()
+	if cfg.Workers < 1 || cfg.QueueSize < 1 {
+		log.Fatalln("the number of workers and the queue size must both be at least 1")
+	}
+	if cfg.MaxBodySize < 0 {
+		log.Fatalln("the maximum body size must not be negative")
+	}
+	if cfg.EventIDTTL <= 0 {
+		log.Fatalln("the event ID TTL must be positive")
+	}
+	if cfg.EnrichmentRetryInterval <= 0 {
+		log.Fatalln("the enrichment retry interval must be positive")
+	}
+
+	auth, err := createAuthenticator(cfg.Auth)
+	if err != nil {
+		log.Fatalln("failed to process authentication options", err)
+	}
+
+	var certs *certReloader
+	if cfg.TLS != (TLSConfig{}) {
+		certs, err = createCertReloader(cfg.TLS)
+		if err != nil {
+			log.Fatalln("failed to load TLS certificates", err)
+		}
+	}
+
+	var jnl *journal.Journal
+	if cfg.JournalFile != "" {
+		jnl, err = journal.Open(cfg.JournalFile)
+		if err != nil {
+			log.Fatalln("failed to open journal", cfg.JournalFile, err)
+		}
+		expvar.Publish("regstat_journal", expvar.Func(func() interface{} { return jnl.Stats() }))
+		stats := jnl.Stats()
+		log.Printf("journal %s contains %d pending entries, %d bytes\n", stats.Path, stats.Pending, stats.Size)
+	}
+
+	adminAuth := createAdminAuthenticator(cfg.Auth)
+	if adminAuth == nil {
+		log.Println("no admin token configured, so the reports are disabled")
+	}
+
+	server := newServer(cfg, auth, adminAuth, certs, jnl, dockerConfig, equivRegistries, mediaTypes, ignorePulls)
+	// signals are handled from the start, so that one received during the
+	// replay of the journal still shuts the server down cleanly
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	server.pool.start()
+	server.expireProcessedEvents(cfg.EventIDTTL)
+	server.retryEnrichments(cfg.EnrichmentRetryInterval)
+	// the replayed notifications are queued before the server starts
+	// listening, so that they're processed ahead of any new ones
+	replayed := make(chan struct{})
+	server.background.Add(1)
+	go func() {
+		defer server.background.Done()
+		if jnl != nil {
+			server.replayJournal()
+		}
+		close(replayed)
+	}()
+
+	exitStatus := 0
+	select {
+	case sig := <-signals:
+		log.Println("received", sig, "signal while replaying the journal, shutting down")
+	case <-replayed:
+		serveErrs := make(chan error, 1)
+		go func() {
+			serveErrs <- server.listenAndServe()
+		}()
+		select {
+		case sig := <-signals:
+			log.Println("received", sig, "signal, shutting down")
+		case err := <-serveErrs:
+			log.Println("server failed", err)
+			exitStatus = 1
+		}
+	}
+	if !server.shutdown(cfg.ShutdownTimeout) {
+		exitStatus = 1
+	}
+	log.Println("stop regstat")
+	return exitStatus
 }
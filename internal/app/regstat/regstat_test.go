@@ -1,10 +1,51 @@
 package regstat
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/docker/distribution/notifications"
+	"github.com/vleurgat/regstat/internal/app/database"
+	"github.com/vleurgat/regstat/internal/app/database/mock"
+	"github.com/vleurgat/regstat/internal/app/journal"
 )
 
+func counterValue(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// failingAuthenticator fails every request with an error that isn't an
+// authError.
+type failingAuthenticator struct {
+	err error
+}
+
+func (a failingAuthenticator) authenticate(r *http.Request, body []byte) error {
+	return a.err
+}
+
+func (a failingAuthenticator) needsBody() bool {
+	return false
+}
+
+func startPool(s *server, queueSize int) {
+	s.pool = createWorkerPool(1, queueSize, s.processEvent, s.completeEnvelope)
+	s.pool.start()
+}
+
 func TestProcessRegistryRequest(t *testing.T) {
 	t.Run("empty body", func(t *testing.T) {
 		wf := createMockWorkflow()
@@ -69,6 +110,31 @@ func TestProcessRegistryRequest(t *testing.T) {
 		}
 	})
 
+	t.Run("failed event", func(t *testing.T) {
+		wf := createMockWorkflow()
+		wf.err = errors.New("oops")
+		s := server{workflow: wf}
+		err := s.processRegistryRequest([]byte("{\"events\":[{\"action\":\"push\"},{\"action\":\"pull\"}]}"))
+		if err == nil || err.Error() != "oops" {
+			t.Errorf("expected oops; got %v", err)
+		}
+		if len(*wf.receivedEvents) != 1 {
+			t.Error("expected processing to stop after the failed event", wf.receivedEvents)
+		}
+	})
+
+	t.Run("mount event", func(t *testing.T) {
+		wf := createMockWorkflow()
+		s := server{workflow: wf}
+		err := s.processRegistryRequest([]byte("{\"events\":[{\"action\":\"mount\"}]}"))
+		if err != nil {
+			t.Errorf("expected nil err; got %s", err)
+		}
+		if len(*wf.receivedEvents) != 1 {
+			t.Error("expected one event", wf.receivedEvents)
+		}
+	})
+
 	t.Run("pull event", func(t *testing.T) {
 		wf := createMockWorkflow()
 		s := server{workflow: wf}
@@ -81,3 +147,494 @@ func TestProcessRegistryRequest(t *testing.T) {
 		}
 	})
 }
+
+func TestHandle(t *testing.T) {
+	t.Run("unauthorized", func(t *testing.T) {
+		wf := createMockWorkflow()
+		s := server{workflow: wf, auth: tokenAuthenticator{token: "secret"}}
+		before := counterValue(rejectedRequests, "unauthorized")
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader("{\"events\":[{\"action\":\"push\"}]}"))
+		s.handle(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401; got %d", w.Code)
+		}
+		if w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Error("expected bearer challenge")
+		}
+		if counterValue(rejectedRequests, "unauthorized") != before+1 {
+			t.Error("expected unauthorized counter to be incremented")
+		}
+		if len(*wf.receivedEvents) > 0 {
+			t.Error("expected no events", wf.receivedEvents)
+		}
+	})
+
+	t.Run("forbidden", func(t *testing.T) {
+		wf := createMockWorkflow()
+		auth, _ := createAuthenticator(AuthConfig{AllowedCIDRs: "10.0.0.0/8"})
+		s := server{workflow: wf, auth: auth}
+		before := counterValue(rejectedRequests, "forbidden")
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader("{\"events\":[{\"action\":\"push\"}]}"))
+		s.handle(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected 403; got %d", w.Code)
+		}
+		if counterValue(rejectedRequests, "forbidden") != before+1 {
+			t.Error("expected forbidden counter to be incremented")
+		}
+		if len(*wf.receivedEvents) > 0 {
+			t.Error("expected no events", wf.receivedEvents)
+		}
+	})
+
+	t.Run("authenticator error", func(t *testing.T) {
+		wf := createMockWorkflow()
+		s := server{workflow: wf, auth: failingAuthenticator{err: errors.New("oops")}}
+		before := counterValue(rejectedRequests, "unauthorized")
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader("{\"events\":[{\"action\":\"push\"}]}"))
+		s.handle(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401; got %d", w.Code)
+		}
+		if counterValue(rejectedRequests, "unauthorized") != before+1 {
+			t.Error("expected unauthorized counter to be incremented")
+		}
+		if len(*wf.receivedEvents) > 0 {
+			t.Error("expected no events", wf.receivedEvents)
+		}
+	})
+
+	t.Run("unauthorized before validation", func(t *testing.T) {
+		wf := createMockWorkflow()
+		s := server{workflow: wf, auth: tokenAuthenticator{token: "secret"}, checkContentType: true, maxBodySize: 10}
+		before := counterValue(rejectedRequests, "unauthorized")
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader("{\"events\":[{\"action\":\"push\"}]}"))
+		r.Header.Set("Content-Type", "text/plain")
+		s.handle(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401; got %d", w.Code)
+		}
+		if counterValue(rejectedRequests, "unauthorized") != before+1 {
+			t.Error("expected unauthorized counter to be incremented")
+		}
+	})
+
+	t.Run("bad body signature", func(t *testing.T) {
+		wf := createMockWorkflow()
+		auth, _ := createAuthenticator(AuthConfig{HMACSecret: "secret"})
+		s := server{workflow: wf, auth: auth}
+		before := counterValue(rejectedRequests, "unauthorized")
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader("{\"events\":[{\"action\":\"push\"}]}"))
+		r.Header.Set("X-Regstat-Signature", "c0ffee")
+		s.handle(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401; got %d", w.Code)
+		}
+		if counterValue(rejectedRequests, "unauthorized") != before+1 {
+			t.Error("expected unauthorized counter to be incremented")
+		}
+		if len(*wf.receivedEvents) > 0 {
+			t.Error("expected no events", wf.receivedEvents)
+		}
+	})
+}
+
+func TestHandleValidation(t *testing.T) {
+	body := "{\"events\":[{\"action\":\"push\"}]}"
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		reason      string
+	}{
+		{"valid", eventsMediaType, body, http.StatusOK, ""},
+		{"with parameters", eventsMediaType + "; charset=utf-8", body, http.StatusOK, ""},
+		{"wrong content type", "application/json", body, http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{"missing content type", "", body, http.StatusUnsupportedMediaType, "unsupported_media_type"},
+		{"too large", eventsMediaType, "{\"events\":[" + strings.Repeat("{},", 64) + "{}]}", http.StatusRequestEntityTooLarge, "too_large"},
+		{"bad json", eventsMediaType, "abc", http.StatusBadRequest, "bad_envelope"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wf := createMockWorkflow()
+			s := &server{workflow: wf, sync: true, maxBodySize: 64, checkContentType: true}
+			startPool(s, 1)
+			before := counterValue(rejectedRequests, test.reason)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			s.handle(w, r)
+			if w.Code != test.status {
+				t.Errorf("expected %d; got %d", test.status, w.Code)
+			}
+			if test.reason != "" {
+				if counterValue(rejectedRequests, test.reason) != before+1 {
+					t.Errorf("expected %s counter to be incremented", test.reason)
+				}
+				if len(*wf.receivedEvents) > 0 {
+					t.Error("expected no events", wf.receivedEvents)
+				}
+			}
+		})
+	}
+
+	t.Run("too large without content length", func(t *testing.T) {
+		s := &server{workflow: createMockWorkflow(), maxBodySize: 8}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		r.ContentLength = -1
+		s.handle(w, r)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected 413; got %d", w.Code)
+		}
+	})
+}
+
+func TestHandleSync(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		err    error
+		status int
+	}{
+		{"success", "{\"events\":[{\"action\":\"push\"}]}", nil, http.StatusOK},
+		{"bad json", "abc", nil, http.StatusBadRequest},
+		{"transient", "{\"events\":[{\"action\":\"push\"}]}", &database.TransientError{Err: errors.New("oops")}, http.StatusServiceUnavailable},
+		{"permanent", "{\"events\":[{\"action\":\"push\"}]}", errors.New("oops"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wf := createMockWorkflow()
+			wf.err = test.err
+			s := &server{workflow: wf, sync: true}
+			startPool(s, 1)
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/", strings.NewReader(test.body))
+			s.handle(w, r)
+			if w.Code != test.status {
+				t.Errorf("expected %d; got %d", test.status, w.Code)
+			}
+		})
+	}
+}
+
+func TestStatusFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{"bad envelope", &envelopeError{err: errors.New("oops")}, http.StatusBadRequest},
+		{"transient", &database.TransientError{Err: errors.New("oops")}, http.StatusServiceUnavailable},
+		{"stopped", errStopped, http.StatusServiceUnavailable},
+		{"permanent", errors.New("oops"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := statusFor(test.err); status != test.status {
+				t.Errorf("expected %d; got %d", test.status, status)
+			}
+		})
+	}
+}
+
+func TestJournalling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regstat-journal")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	jnl, err := journal.Open(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal("failed to open journal", err)
+	}
+	defer jnl.Close()
+	body := "{\"events\":[{\"action\":\"push\"}]}"
+
+	t.Run("sync failure", func(t *testing.T) {
+		wf := createMockWorkflow()
+		wf.err = &database.TransientError{Err: errors.New("oops")}
+		s := &server{workflow: wf, sync: true, journal: jnl}
+		startPool(s, 1)
+		w := httptest.NewRecorder()
+		s.handle(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503; got %d", w.Code)
+		}
+		if len(jnl.Pending()) != 0 {
+			t.Error("expected the registry to be left to retry the notification", jnl.Pending())
+		}
+	})
+
+	t.Run("async transient failure and replay", func(t *testing.T) {
+		wf := createMockWorkflow()
+		wf.err = &database.TransientError{Err: errors.New("oops")}
+		s := &server{workflow: wf, journal: jnl}
+		// a pool that doesn't retry, as though its workers had given up at
+		// shutdown
+		startPool(s, 1)
+		w := httptest.NewRecorder()
+		s.handle(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		s.pool.stop(context.Background())
+		if len(jnl.Pending()) != 1 {
+			t.Fatal("expected failed notification to remain in the journal")
+		}
+		wf = createMockWorkflow()
+		s.workflow = wf
+		startPool(s, 1)
+		s.replayJournal()
+		s.pool.stop(context.Background())
+		if len(*wf.receivedEvents) != 1 {
+			t.Error("expected journalled event to be replayed", wf.receivedEvents)
+		}
+		if len(jnl.Pending()) != 0 {
+			t.Error("expected replayed notification to be marked as done", jnl.Pending())
+		}
+	})
+
+	t.Run("sync transient failure on replay", func(t *testing.T) {
+		failures := 2
+		s := &server{workflow: createMockWorkflow(), sync: true, journal: jnl}
+		s.pool = createWorkerPool(1, 1, func(event *notifications.Event) error {
+			if failures > 0 {
+				failures--
+				return &database.TransientError{Err: errors.New("oops")}
+			}
+			return s.processEvent(event)
+		}, s.completeEnvelope)
+		s.pool.backoff = time.Millisecond
+		s.pool.start()
+		jnl.Append([]byte(body))
+		s.replayJournal()
+		s.pool.stop(context.Background())
+		if failures != 0 {
+			t.Error("expected replayed notification to be retried", failures)
+		}
+		if len(jnl.Pending()) != 0 {
+			t.Error("expected replayed notification to be marked as done once retried", jnl.Pending())
+		}
+	})
+
+	t.Run("async permanent failure", func(t *testing.T) {
+		wf := createMockWorkflow()
+		wf.err = errors.New("oops")
+		s := &server{workflow: wf, journal: jnl}
+		startPool(s, 1)
+		w := httptest.NewRecorder()
+		s.handle(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		s.pool.stop(context.Background())
+		if len(jnl.Pending()) != 0 {
+			t.Error("expected failed notification to be moved to the dead letters", jnl.Pending())
+		}
+		if jnl.Stats().DeadLetters != 1 {
+			t.Error("expected dead letter to be counted", jnl.Stats())
+		}
+	})
+
+	t.Run("bad json", func(t *testing.T) {
+		s := &server{workflow: createMockWorkflow(), journal: jnl}
+		startPool(s, 1)
+		w := httptest.NewRecorder()
+		s.handle(w, httptest.NewRequest("POST", "/", strings.NewReader("abc")))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400; got %d", w.Code)
+		}
+		if len(jnl.Pending()) != 0 {
+			t.Error("expected unparseable notification to not be journalled", jnl.Pending())
+		}
+		s.journal.Append([]byte("abc"))
+		s.replayJournal()
+		if len(jnl.Pending()) != 0 {
+			t.Error("expected unparseable notification to be dropped on replay", jnl.Pending())
+		}
+		if jnl.Stats().DeadLetters != 2 {
+			t.Error("expected unparseable notification to be moved to the dead letters", jnl.Stats())
+		}
+	})
+}
+
+func TestHandleQueueFull(t *testing.T) {
+	wf := createMockWorkflow()
+	s := &server{workflow: wf}
+	// a pool that is never started, so nothing is taken from its queue
+	s.pool = createWorkerPool(1, 1, s.processEvent, s.completeEnvelope)
+	body := "{\"events\":[{\"action\":\"push\"}]}"
+	before := counterValue(rejectedRequests, "queue_full")
+
+	w := httptest.NewRecorder()
+	s.handle(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200; got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.handle(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected 429; got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header")
+	}
+	if counterValue(rejectedRequests, "queue_full") != before+1 {
+		t.Error("expected queue_full counter to be incremented")
+	}
+
+	before = counterValue(rejectedRequests, "too_many_events")
+	w = httptest.NewRecorder()
+	s.handle(w, httptest.NewRequest("POST", "/", strings.NewReader("{\"events\":[{\"action\":\"push\"},{\"action\":\"push\"}]}")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413; got %d", w.Code)
+	}
+	if counterValue(rejectedRequests, "too_many_events") != before+1 {
+		t.Error("expected too_many_events counter to be incremented")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regstat-journal")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	jnl, err := journal.Open(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal("failed to open journal", err)
+	}
+	wf := createMockWorkflow()
+	s := &server{httpServer: &http.Server{}, db: mock.CreateDatabase(), workflow: wf, journal: jnl}
+	startPool(s, 10)
+	w := httptest.NewRecorder()
+	s.handle(w, httptest.NewRequest("POST", "/", strings.NewReader("{\"events\":[{\"action\":\"push\"}]}")))
+	if !s.shutdown(time.Second) {
+		t.Fatal("expected shutdown to drain")
+	}
+	if len(*wf.receivedEvents) != 1 {
+		t.Error("expected accepted event to have been processed", wf.receivedEvents)
+	}
+	before := counterValue(rejectedRequests, "shutting_down")
+	w = httptest.NewRecorder()
+	s.handle(w, httptest.NewRequest("POST", "/", strings.NewReader("{\"events\":[{\"action\":\"push\"}]}")))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after shutdown; got %d", w.Code)
+	}
+	if counterValue(rejectedRequests, "shutting_down") != before+1 {
+		t.Error("expected request to be rejected as the server is shutting down", w.Body.String())
+	}
+	jnl, err = journal.Open(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal("failed to reopen journal", err)
+	}
+	defer jnl.Close()
+	if len(jnl.Pending()) != 0 {
+		t.Error("expected no pending journal entries", jnl.Pending())
+	}
+}
+
+func TestShutdownTimedOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regstat-journal")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	jnl, err := journal.Open(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal("failed to open journal", err)
+	}
+	release := make(chan struct{})
+	s := &server{httpServer: &http.Server{}, db: mock.CreateDatabase(), journal: jnl}
+	s.pool = createWorkerPool(1, 10, func(event *notifications.Event) error {
+		<-release
+		return nil
+	}, s.completeEnvelope)
+	s.pool.start()
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		s.handle(w, httptest.NewRequest("POST", "/", strings.NewReader("{\"events\":[{\"action\":\"push\"}]}")))
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	if s.shutdown(10 * time.Millisecond) {
+		t.Fatal("expected shutdown to time out")
+	}
+	jnl, err = journal.Open(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal("failed to reopen journal", err)
+	}
+	defer jnl.Close()
+	// the journal stays open until the event in flight has been processed,
+	// while the queued event is left to be replayed
+	if len(jnl.Pending()) != 1 {
+		t.Error("expected only the queued notification to be pending", jnl.Pending())
+	}
+}
+
+func TestShutdownStopsBackgroundTasks(t *testing.T) {
+	s := &server{httpServer: &http.Server{}, db: mock.CreateDatabase(), workflow: createMockWorkflow(), done: make(chan struct{})}
+	startPool(s, 1)
+	release := make(chan struct{})
+	var calls int64
+	s.every(time.Millisecond, func() {
+		if atomic.AddInt64(&calls, 1) == 1 {
+			<-release
+		}
+	})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if !s.shutdown(time.Second) {
+		t.Fatal("expected shutdown to drain")
+	}
+	select {
+	case <-release:
+	default:
+		t.Fatal("expected shutdown to wait for the call in progress")
+	}
+	calledBefore := atomic.LoadInt64(&calls)
+	time.Sleep(10 * time.Millisecond)
+	if atomic.LoadInt64(&calls) != calledBefore {
+		t.Error("expected background task to stop", calledBefore, atomic.LoadInt64(&calls))
+	}
+}
+
+func TestReplayInterrupted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regstat-journal")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	jnl, err := journal.Open(filepath.Join(dir, "journal"))
+	if err != nil {
+		t.Fatal("failed to open journal", err)
+	}
+	defer jnl.Close()
+	jnl.Append([]byte("{\"events\":[{\"action\":\"push\"}]}"))
+	jnl.Append([]byte("{\"events\":[{\"action\":\"push\"}]}"))
+	s := &server{workflow: createMockWorkflow(), journal: jnl, done: make(chan struct{})}
+	// a pool that is never started, so the second notification waits for room
+	s.pool = createWorkerPool(1, 1, s.processEvent, s.completeEnvelope)
+	replayed := make(chan struct{})
+	go func() {
+		s.replayJournal()
+		close(replayed)
+	}()
+	close(s.done)
+	select {
+	case <-replayed:
+	case <-time.After(time.Second):
+		t.Fatal("expected replay to stop once the server shuts down")
+	}
+	if len(jnl.Pending()) != 2 {
+		t.Error("expected notifications to remain in the journal", jnl.Pending())
+	}
+}
@@ -0,0 +1,301 @@
+package regstat
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vleurgat/regstat/internal/app/artifact"
+	"github.com/vleurgat/regstat/internal/app/database"
+)
+
+// storageReport is the response of the storage report endpoint.
+type storageReport struct {
+	Totals       database.StorageTotals  `json:"totals"`
+	Repositories []database.StorageUsage `json:"repositories"`
+}
+
+// tagStorageReport is the response of the tag storage report endpoint.
+type tagStorageReport struct {
+	Tags []database.StorageUsage `json:"tags"`
+}
+
+// tagImagesReport is the response of the tag images report endpoint.
+type tagImagesReport struct {
+	Images []database.TagImage `json:"images"`
+}
+
+// referrersReport is the response of the referrers report endpoint.
+type referrersReport struct {
+	Digest    string              `json:"digest"`
+	Referrers []database.Referrer `json:"referrers"`
+}
+
+// unsignedTagsReport is the response of the unsigned tags report endpoint.
+type unsignedTagsReport struct {
+	SignatureTypes []string               `json:"signature_types"`
+	Tags           []database.UnsignedTag `json:"tags"`
+}
+
+// mediaTypeStorageReport is the response of the media type storage report endpoint.
+type mediaTypeStorageReport struct {
+	MediaTypes []database.MediaTypeUsage `json:"media_types"`
+}
+
+// tagPullsReport is the response of the tag pulls report endpoint.
+type tagPullsReport struct {
+	Since time.Time           `json:"since"`
+	Tags  []database.TagPulls `json:"tags"`
+}
+
+// The number of days, including today, counted as recent by the tag pulls
+// report, unless the days query parameter says otherwise.
+const (
+	defaultPullDays = 30
+	maxPullDays     = 366
+)
+
+// eventsReport is the response of the events audit log endpoint.
+type eventsReport struct {
+	Events []database.Event `json:"events"`
+}
+
+// The number of events returned by the events audit log endpoint, unless the
+// limit query parameter asks for fewer or more.
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+// pendingEnrichmentsReport is the response of the pending enrichments endpoint.
+type pendingEnrichmentsReport struct {
+	Manifests []database.PendingEnrichment `json:"manifests"`
+}
+
+// authorizeReport checks that a report request uses GET and provides the
+// admin credentials, responding to it if not.
+func (s *server) authorizeReport(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	return s.authorizeAdmin(w, r)
+}
+
+// authorizeAdmin checks that a request provides the admin credentials, and a
+// client certificate if those are required, responding to it if not. The
+// reports and counters expose who pulled what from where, so they're refused
+// if no admin credentials are configured.
+func (s *server) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	err := s.certs.verifyClient(r)
+	if err != nil {
+		rejectUnauthenticated(w, r, err)
+		return false
+	}
+	if s.adminAuth == nil {
+		rejectUnauthenticated(w, r, forbidden("no admin credentials configured"))
+		return false
+	}
+	err = s.adminAuth.authenticate(r, nil)
+	if err != nil {
+		rejectUnauthenticated(w, r, err)
+		return false
+	}
+	return true
+}
+
+// writeReport responds with the report as JSON or, if the report couldn't be
+// produced, with the error.
+func writeReport(w http.ResponseWriter, report interface{}, err error) {
+	if err != nil {
+		log.Println("failed to produce report", err)
+		http.Error(w, err.Error(), statusFor(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleStorageReport reports the total storage used by the registry and the
+// storage used by each of its repositories.
+func (s *server) handleStorageReport(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeReport(w, r) {
+		return
+	}
+	var report storageReport
+	var err error
+	report.Totals, err = s.db.StorageTotals()
+	if err == nil {
+		report.Repositories, err = s.db.RepositoryStorage()
+	}
+	writeReport(w, report, err)
+}
+
+// handleTagStorageReport reports the storage used by each tag, optionally
+// restricted by the registry and repository query parameters.
+func (s *server) handleTagStorageReport(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeReport(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	var report tagStorageReport
+	var err error
+	report.Tags, err = s.db.TagStorage(query.Get("registry"), query.Get("repository"))
+	writeReport(w, report, err)
+}
+
+// handleTagImagesReport reports the platform, build time and push time of the
+// images of each tag, optionally restricted by the registry and repository
+// query parameters.
+func (s *server) handleTagImagesReport(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeReport(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	var report tagImagesReport
+	var err error
+	report.Images, err = s.db.TagImages(query.Get("registry"), query.Get("repository"))
+	writeReport(w, report, err)
+}
+
+// handleReferrersReport reports the referrers, e.g. signatures and SBOMs, of
+// the manifest given by the digest query parameter, optionally restricted by
+// the artifact_type query parameter.
+func (s *server) handleReferrersReport(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeReport(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	report := referrersReport{Digest: query.Get("digest")}
+	if report.Digest == "" {
+		http.Error(w, "missing digest", http.StatusBadRequest)
+		return
+	}
+	var err error
+	report.Referrers, err = s.db.Referrers(report.Digest, query.Get("artifact_type"))
+	writeReport(w, report, err)
+}
+
+// handleUnsignedTagsReport reports the tags whose manifests have no signature,
+// optionally restricted by the registry and repository query parameters. A
+// referrer is a signature if its artifact type is one of those given by the
+// artifact_type query parameters, or one of the known signature types if
+// there are none.
+func (s *server) handleUnsignedTagsReport(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeReport(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	report := unsignedTagsReport{SignatureTypes: query["artifact_type"]}
+	if len(report.SignatureTypes) == 0 {
+		report.SignatureTypes = artifact.SignatureTypes
+	}
+	var err error
+	report.Tags, err = s.db.UnsignedTags(query.Get("registry"), query.Get("repository"), report.SignatureTypes)
+	writeReport(w, report, err)
+}
+
+// handleMediaTypeStorageReport reports the number and size of the blobs of
+// each media type.
+func (s *server) handleMediaTypeStorageReport(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeReport(w, r) {
+		return
+	}
+	var report mediaTypeStorageReport
+	var err error
+	report.MediaTypes, err = s.db.MediaTypeStorage()
+	writeReport(w, report, err)
+}
+
+// handleTagPullsReport reports the number of pulls of each tag, in total and
+// over the recent number of days given by the days query parameter,
+// optionally restricted by the registry and repository query parameters.
+func (s *server) handleTagPullsReport(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeReport(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	days := defaultPullDays
+	if param := query.Get("days"); param != "" {
+		var err error
+		days, err = strconv.Atoi(param)
+		if err != nil || days < 1 || days > maxPullDays {
+			http.Error(w, fmt.Sprintf("invalid days %q: must be between 1 and %d", param, maxPullDays), http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now().UTC()
+	report := tagPullsReport{Since: time.Date(now.Year(), now.Month(), now.Day()-days+1, 0, 0, 0, 0, time.UTC)}
+	var err error
+	report.Tags, err = s.db.TagPulls(query.Get("registry"), query.Get("repository"), report.Since)
+	writeReport(w, report, err)
+}
+
+// handleEventsReport reports the audited events, most recent first, optionally
+// restricted by the actor, repository, tag, digest and action query
+// parameters, and by the since and until query parameters, which are RFC 3339
+// times.
+func (s *server) handleEventsReport(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeReport(w, r) {
+		return
+	}
+	query, err := parseEventQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var report eventsReport
+	report.Events, err = s.db.Events(query)
+	writeReport(w, report, err)
+}
+
+// parseEventQuery reads an events query from a request's query parameters.
+func parseEventQuery(r *http.Request) (database.EventQuery, error) {
+	params := r.URL.Query()
+	query := database.EventQuery{
+		Actor:      params.Get("actor"),
+		Repository: params.Get("repository"),
+		Tag:        params.Get("tag"),
+		Digest:     params.Get("digest"),
+		Action:     params.Get("action"),
+		Limit:      defaultEventsLimit,
+	}
+	var err error
+	if since := params.Get("since"); since != "" {
+		query.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			return query, fmt.Errorf("invalid since %q: %s", since, err)
+		}
+	}
+	if until := params.Get("until"); until != "" {
+		query.Until, err = time.Parse(time.RFC3339, until)
+		if err != nil {
+			return query, fmt.Errorf("invalid until %q: %s", until, err)
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 || query.Limit > maxEventsLimit {
+			return query, fmt.Errorf("invalid limit %q: must be between 1 and %d", limit, maxEventsLimit)
+		}
+	}
+	return query, nil
+}
+
+// handlePendingEnrichmentsReport reports the pushed manifests that couldn't be
+// fetched from the registry, and so still lack links to their blobs or
+// children, along with the number of attempts made, the last error, and when
+// the next attempt is due.
+func (s *server) handlePendingEnrichmentsReport(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeReport(w, r) {
+		return
+	}
+	var report pendingEnrichmentsReport
+	var err error
+	report.Manifests, err = s.db.PendingEnrichments(time.Time{})
+	writeReport(w, report, err)
+}
@@ -0,0 +1,338 @@
+package regstat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vleurgat/regstat/internal/app/database"
+	"github.com/vleurgat/regstat/internal/app/database/mock"
+)
+
+// createReportServer creates a server that serves reports from db to requests
+// that provide the admin token.
+func createReportServer(db database.Database) *server {
+	return &server{db: db, adminAuth: tokenAuthenticator{token: adminToken}}
+}
+
+func createReportDatabase() mock.Database {
+	db := mock.CreateDatabase()
+	db.StorageTotalsRetValue = database.StorageTotals{Bytes: 300, BlobBytes: 290, ManifestBytes: 10}
+	db.StorageUsages = []database.StorageUsage{
+		{Registry: "reg", Repository: "a", Bytes: 200, ExclusiveBytes: 150},
+		{Registry: "reg", Repository: "b", Bytes: 100, ExclusiveBytes: 50},
+		{Registry: "reg", Repository: "a", Tag: "1", Bytes: 200, ExclusiveBytes: 100},
+		{Registry: "reg", Repository: "b", Tag: "1", Bytes: 100, ExclusiveBytes: 50},
+	}
+	return db
+}
+
+func TestStorageReport(t *testing.T) {
+	t.Run("repositories", func(t *testing.T) {
+		s := createReportServer(createReportDatabase())
+		w := serveRequest(s, "GET", "/v1/reports/storage")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200; got %d", w.Code)
+		}
+		var report storageReport
+		err := json.NewDecoder(w.Body).Decode(&report)
+		if err != nil {
+			t.Fatal("failed to decode report", err)
+		}
+		if report.Totals.Bytes != 300 || len(report.Repositories) != 2 {
+			t.Error("unexpected report", report)
+		}
+		if report.Repositories[0].ExclusiveBytes != 150 {
+			t.Error("unexpected exclusive bytes", report.Repositories[0])
+		}
+	})
+
+	t.Run("tags", func(t *testing.T) {
+		s := createReportServer(createReportDatabase())
+		w := serveRequest(s, "GET", "/v1/reports/storage/tags?repository=b")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200; got %d", w.Code)
+		}
+		var report tagStorageReport
+		json.NewDecoder(w.Body).Decode(&report)
+		if len(report.Tags) != 1 || report.Tags[0].Repository != "b" || report.Tags[0].Tag != "1" {
+			t.Error("unexpected report", report)
+		}
+	})
+
+	t.Run("unauthorized", func(t *testing.T) {
+		s := createReportServer(createReportDatabase())
+		s.auth = tokenAuthenticator{token: "secret"}
+		for _, test := range []struct {
+			authorization string
+			status        int
+		}{
+			{"", http.StatusUnauthorized},
+			// the notification credentials don't grant access to the reports
+			{"Bearer secret", http.StatusUnauthorized},
+			{"Bearer " + adminToken, http.StatusOK},
+		} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/v1/reports/storage", nil)
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			s.routes().ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Errorf("%q: expected %d; got %d", test.authorization, test.status, w.Code)
+			}
+		}
+	})
+
+	t.Run("no admin credentials", func(t *testing.T) {
+		s := &server{db: createReportDatabase()}
+		w := serveRequest(s, "GET", "/v1/reports/storage")
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected 403; got %d", w.Code)
+		}
+	})
+
+	t.Run("database error", func(t *testing.T) {
+		db := createReportDatabase()
+		db.Err = &database.TransientError{Err: errors.New("oops")}
+		s := createReportServer(db)
+		w := serveRequest(s, "GET", "/v1/reports/storage")
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503; got %d", w.Code)
+		}
+	})
+}
+
+func TestMediaTypeStorageReport(t *testing.T) {
+	db := mock.CreateDatabase()
+	db.MediaTypeUsages = []database.MediaTypeUsage{
+		{MediaType: "application/vnd.oci.image.layer.v1.tar+zstd", Role: "layer", Blobs: 2, Bytes: 2000},
+		{MediaType: "application/vnd.oci.image.config.v1+json", Role: "config", Blobs: 2, Bytes: 20},
+	}
+	s := createReportServer(db)
+	w := serveRequest(s, "GET", "/v1/reports/storage/media-types")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200; got %d", w.Code)
+	}
+	var report mediaTypeStorageReport
+	json.NewDecoder(w.Body).Decode(&report)
+	if len(report.MediaTypes) != 2 || report.MediaTypes[0].Role != "layer" || report.MediaTypes[0].Bytes != 2000 {
+		t.Error("unexpected report", report)
+	}
+}
+
+func TestPendingEnrichmentsReport(t *testing.T) {
+	db := mock.CreateDatabase()
+	db.PendingEnrichmentsRetValue = []database.PendingEnrichment{
+		{Digest: "sha256:b00", Repository: "hello", Attempts: 3, LastError: "oops", NextAttempt: time.Now().Add(time.Hour)},
+	}
+	s := createReportServer(db)
+	w := serveRequest(s, "GET", "/v1/reports/pending-enrichments")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200; got %d", w.Code)
+	}
+	var report pendingEnrichmentsReport
+	json.NewDecoder(w.Body).Decode(&report)
+	if len(report.Manifests) != 1 || report.Manifests[0].Attempts != 3 || report.Manifests[0].LastError != "oops" {
+		t.Error("unexpected report", report)
+	}
+}
+
+func TestTagImagesReport(t *testing.T) {
+	db := mock.CreateDatabase()
+	db.TagImagesRetValue = []database.TagImage{
+		{Registry: "reg", Repository: "a", Tag: "1", Digest: "amd", OS: "linux", Architecture: "amd64"},
+		{Registry: "reg", Repository: "a", Tag: "1", Digest: "arm", OS: "linux", Architecture: "amd64",
+			DeclaredOS: "linux", DeclaredArchitecture: "arm64", PlatformMismatch: true},
+		{Registry: "reg", Repository: "b", Tag: "1", Digest: "other", OS: "linux", Architecture: "amd64"},
+	}
+	s := createReportServer(db)
+	w := serveRequest(s, "GET", "/v1/reports/images?repository=a")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200; got %d", w.Code)
+	}
+	var report tagImagesReport
+	json.NewDecoder(w.Body).Decode(&report)
+	if len(report.Images) != 2 || !report.Images[1].PlatformMismatch {
+		t.Error("unexpected report", report)
+	}
+}
+
+func TestReferrersReport(t *testing.T) {
+	db := mock.CreateDatabase()
+	db.ReferrersRetValue = map[string][]database.Referrer{
+		"sha256:b00": {
+			{Digest: "sig", ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json"},
+			{Digest: "sbom", ArtifactType: "application/spdx+json"},
+		},
+	}
+
+	t.Run("referrers", func(t *testing.T) {
+		s := createReportServer(db)
+		w := serveRequest(s, "GET", "/v1/reports/referrers?digest=sha256:b00&artifact_type=application/spdx%2Bjson")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200; got %d", w.Code)
+		}
+		var report referrersReport
+		json.NewDecoder(w.Body).Decode(&report)
+		if report.Digest != "sha256:b00" || len(report.Referrers) != 1 || report.Referrers[0].Digest != "sbom" {
+			t.Error("unexpected report", report)
+		}
+	})
+
+	t.Run("missing digest", func(t *testing.T) {
+		s := createReportServer(db)
+		w := serveRequest(s, "GET", "/v1/reports/referrers")
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400; got %d", w.Code)
+		}
+	})
+}
+
+func TestUnsignedTagsReport(t *testing.T) {
+	db := mock.CreateDatabase()
+	db.UnsignedTagsRetValue = []database.UnsignedTag{
+		{Registry: "reg", Repository: "a", Tag: "1", Digest: "sha256:a1"},
+		{Registry: "reg", Repository: "b", Tag: "1", Digest: "sha256:b1"},
+	}
+
+	t.Run("default signature types", func(t *testing.T) {
+		s := createReportServer(db)
+		w := serveRequest(s, "GET", "/v1/reports/unsigned-tags?repository=a")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200; got %d", w.Code)
+		}
+		var report unsignedTagsReport
+		json.NewDecoder(w.Body).Decode(&report)
+		if len(report.Tags) != 1 || report.Tags[0].Digest != "sha256:a1" {
+			t.Error("unexpected report", report)
+		}
+		if len(report.SignatureTypes) != 2 {
+			t.Error("expected the known signature types", report.SignatureTypes)
+		}
+	})
+
+	t.Run("given signature types", func(t *testing.T) {
+		s := createReportServer(db)
+		w := serveRequest(s, "GET", "/v1/reports/unsigned-tags?artifact_type=application/vnd.example.sig")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200; got %d", w.Code)
+		}
+		var report unsignedTagsReport
+		json.NewDecoder(w.Body).Decode(&report)
+		if len(report.Tags) != 2 || fmt.Sprint(report.SignatureTypes) != "[application/vnd.example.sig]" {
+			t.Error("unexpected report", report)
+		}
+	})
+}
+
+func TestTagPullsReport(t *testing.T) {
+	db := mock.CreateDatabase()
+	db.TagPullsRetValue = []database.TagPulls{
+		{Registry: "reg", Repository: "a", Tag: "1", PullCount: 100, RecentPulls: 40, RecentDays: 20},
+		{Registry: "reg", Repository: "b", Tag: "1", PullCount: 1, RecentPulls: 1, RecentDays: 1},
+	}
+
+	t.Run("tags", func(t *testing.T) {
+		s := createReportServer(db)
+		w := serveRequest(s, "GET", "/v1/reports/pulls?repository=a&days=7")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200; got %d", w.Code)
+		}
+		var report tagPullsReport
+		json.NewDecoder(w.Body).Decode(&report)
+		if len(report.Tags) != 1 || report.Tags[0].RecentPulls != 40 {
+			t.Error("unexpected report", report)
+		}
+		since := time.Now().UTC().AddDate(0, 0, -6).Format("2006-01-02")
+		if report.Since.Format("2006-01-02") != since {
+			t.Errorf("expected since %s; got %s", since, report.Since)
+		}
+	})
+
+	t.Run("invalid days", func(t *testing.T) {
+		s := createReportServer(db)
+		for _, query := range []string{"?days=0", "?days=367", "?days=week"} {
+			w := serveRequest(s, "GET", "/v1/reports/pulls"+query)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected 400 for %s; got %d", query, w.Code)
+			}
+		}
+	})
+}
+
+func TestEventsReport(t *testing.T) {
+	db := mock.CreateDatabase()
+	lastWeek := time.Date(2019, 3, 4, 12, 0, 0, 0, time.UTC)
+	*db.RecordedEvents = []*database.Event{
+		{ID: "1", Action: "pull", Repository: "hello", Tag: "1", Actor: "joe", Timestamp: lastWeek},
+		{ID: "2", Action: "pull", Repository: "hello", Tag: "1", Actor: "ann", Timestamp: lastWeek.Add(time.Hour)},
+		{ID: "3", Action: "delete", Repository: "hello", Tag: "1", Actor: "joe", Timestamp: lastWeek.Add(7 * 24 * time.Hour)},
+	}
+
+	tests := []struct {
+		name  string
+		query string
+		ids   []string
+	}{
+		{"all", "", []string{"3", "2", "1"}},
+		{"actor", "?actor=joe", []string{"3", "1"}},
+		{"who deleted", "?repository=hello&tag=1&action=delete", []string{"3"}},
+		{"time range", "?action=pull&since=2019-03-04T12:30:00Z&until=2019-03-11T00:00:00Z", []string{"2"}},
+		{"limit", "?limit=1", []string{"3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := createReportServer(db)
+			w := serveRequest(s, "GET", "/v1/reports/events"+test.query)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200; got %d", w.Code)
+			}
+			var report eventsReport
+			json.NewDecoder(w.Body).Decode(&report)
+			var ids []string
+			for _, event := range report.Events {
+				ids = append(ids, event.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(test.ids) {
+				t.Errorf("expected events %v; got %v", test.ids, ids)
+			}
+		})
+	}
+
+	t.Run("none", func(t *testing.T) {
+		s := createReportServer(db)
+		w := serveRequest(s, "GET", "/v1/reports/events?actor=nobody")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200; got %d", w.Code)
+		}
+		if body := strings.TrimSpace(w.Body.String()); body != `{"events":[]}` {
+			t.Error("expected an empty list of events", body)
+		}
+	})
+
+	t.Run("no admin credentials", func(t *testing.T) {
+		// the audit log names the actors, and their addresses, so it is never
+		// served without the admin token
+		s := &server{db: db}
+		w := serveRequest(s, "GET", "/v1/reports/events")
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected 403; got %d", w.Code)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		s := createReportServer(db)
+		for _, query := range []string{"?since=yesterday", "?until=2019-03-11", "?limit=0", "?limit=1001"} {
+			w := serveRequest(s, "GET", "/v1/reports/events"+query)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected 400 for %s; got %d", query, w.Code)
+			}
+		}
+	})
+}
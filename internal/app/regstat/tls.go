@@ -0,0 +1,115 @@
+package regstat
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// TLSConfig holds the settings for serving notifications over HTTPS. If
+// ClientCAFile is set then notification and admin requests must present a
+// certificate signed by one of the CAs in that bundle; the health probes
+// needn't, as kubelets and load balancers don't present one.
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// certReloader owns the server's certificate and client CA pool, and allows
+// them to be replaced while the server is running.
+type certReloader struct {
+	config    TLSConfig
+	mutex     sync.RWMutex
+	tlsConfig *tls.Config
+}
+
+func createCertReloader(config TLSConfig) (*certReloader, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("both a TLS certificate and key must be provided")
+	}
+	cr := &certReloader{config: config}
+	err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload reads the certificate, key and client CA files again. The current
+// settings are left in place if any of them can't be loaded.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.config.CertFile, cr.config.KeyFile)
+	if err != nil {
+		return err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cr.config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(cr.config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + cr.config.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		// a certificate is verified if given, and then required by
+		// verifyClient for the endpoints that need one
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	cr.mutex.Lock()
+	cr.tlsConfig = tlsConfig
+	cr.mutex.Unlock()
+	return nil
+}
+
+func (cr *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	return cr.tlsConfig, nil
+}
+
+// serverConfig returns a TLS config that always uses the most recently
+// loaded certificates.
+func (cr *certReloader) serverConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: cr.getConfigForClient}
+}
+
+// verifyClient returns an error if client certificates are required, but the
+// request's connection didn't present a verified one.
+func (cr *certReloader) verifyClient(r *http.Request) error {
+	if cr == nil || cr.config.ClientCAFile == "" {
+		return nil
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return unauthorized("missing client certificate", "")
+	}
+	return nil
+}
+
+// reloadOnSignal reloads the certificates whenever the process receives a SIGHUP.
+func (cr *certReloader) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			err := cr.reload()
+			if err != nil {
+				log.Println("failed to reload TLS certificates", err)
+			} else {
+				log.Println("reloaded TLS certificates")
+			}
+		}
+	}()
+}
@@ -0,0 +1,173 @@
+package regstat
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vleurgat/regstat/internal/app/database/mock"
+)
+
+// writeSelfSignedCert writes a self signed certificate and key, with the given
+// common name, to files in dir and returns their paths.
+func writeSelfSignedCert(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("failed to generate key", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("failed to create certificate", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal("failed to marshal key", err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func currentCertName(t *testing.T, cr *certReloader) string {
+	config, err := cr.serverConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal("failed to get config", err)
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal("failed to parse certificate", err)
+	}
+	return cert.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regstat-tls")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("missing key", func(t *testing.T) {
+		_, err := createCertReloader(TLSConfig{CertFile: "cert.pem"})
+		if err == nil {
+			t.Fatal("expected non nil err")
+		}
+	})
+
+	t.Run("no such file", func(t *testing.T) {
+		_, err := createCertReloader(TLSConfig{CertFile: "no-such-file", KeyFile: "no-such-file"})
+		if err == nil {
+			t.Fatal("expected non nil err")
+		}
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		certFile, keyFile := writeSelfSignedCert(t, dir, "first")
+		cr, err := createCertReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile})
+		if err != nil {
+			t.Fatal("failed to create cert reloader", err)
+		}
+		if currentCertName(t, cr) != "first" {
+			t.Error("expected first certificate")
+		}
+		writeSelfSignedCert(t, dir, "second")
+		err = cr.reload()
+		if err != nil {
+			t.Fatal("failed to reload", err)
+		}
+		if currentCertName(t, cr) != "second" {
+			t.Error("expected second certificate")
+		}
+		ioutil.WriteFile(keyFile, []byte("rubbish"), 0600)
+		err = cr.reload()
+		if err == nil {
+			t.Fatal("expected non nil err")
+		}
+		if currentCertName(t, cr) != "second" {
+			t.Error("expected second certificate to be retained")
+		}
+	})
+
+	t.Run("client ca", func(t *testing.T) {
+		certFile, keyFile := writeSelfSignedCert(t, dir, "mtls")
+		cr, err := createCertReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile})
+		if err != nil {
+			t.Fatal("failed to create cert reloader", err)
+		}
+		config, _ := cr.serverConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+		if config.ClientAuth != tls.VerifyClientCertIfGiven || config.ClientCAs == nil {
+			t.Error("expected client certificates to be verified")
+		}
+		_, err = createCertReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile})
+		if err == nil {
+			t.Fatal("expected non nil err for CA bundle with no certificates")
+		}
+	})
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "regstat-tls")
+	if err != nil {
+		t.Fatal("failed to create temp dir", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeSelfSignedCert(t, dir, "mtls")
+	cr, err := createCertReloader(TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: certFile})
+	if err != nil {
+		t.Fatal("failed to create cert reloader", err)
+	}
+	s := &server{db: mock.CreateDatabase(), workflow: createMockWorkflow(), certs: cr, adminAuth: tokenAuthenticator{token: adminToken}}
+	startPool(s, 1)
+
+	// the probes are served without a client certificate, but nothing else is
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/healthz", http.StatusOK},
+		{"GET", "/readyz", http.StatusOK},
+		{"POST", "/v1/events", http.StatusUnauthorized},
+		{"GET", "/v1/reports/storage", http.StatusUnauthorized},
+		{"GET", "/debug/vars", http.StatusUnauthorized},
+	} {
+		w := serveRequest(s, test.method, test.path)
+		if w.Code != test.status {
+			t.Errorf("%s %s: expected %d; got %d", test.method, test.path, test.status, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}
+	if err := cr.verifyClient(r); err != nil {
+		t.Error("expected verified client certificate to be accepted", err)
+	}
+	var none *certReloader
+	if err := none.verifyClient(httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Error("expected no client certificate to be needed without TLS", err)
+	}
+}
@@ -1,58 +1,185 @@
 package regstat
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/distribution/manifest/schema2"
 	"github.com/docker/distribution/notifications"
-	"github.com/vleurgat/dockerclient/pkg/client"
+	"github.com/vleurgat/regstat/internal/app/artifact"
 	"github.com/vleurgat/regstat/internal/app/database"
 	"github.com/vleurgat/regstat/internal/app/registry"
 )
 
 // Workflow defines the main registry notification event processing methods.
+//
+// Each method returns an error if the event could not be persisted.
 type Workflow interface {
-	processDelete(event *notifications.Event)
-	processPush(event *notifications.Event)
-	processPull(event *notifications.Event)
+	processDelete(event *notifications.Event) error
+	processPush(event *notifications.Event) error
+	processPull(event *notifications.Event) error
+	processMount(event *notifications.Event) error
+	retryEnrichments(quit <-chan struct{}) error
 }
 
 // WorkflowImpl encapsulates the business logic of how Docker registry
 // notifications of tag, manifest and blob pulls, pushes and deletes
 // should be intrepreted and persisted. It implements the Workflow interface.
+//
+// Pulls selected by ignorePulls are only audited. A pull of a manifest by
+// digest is attributed to the tags that refer to the manifest if
+// digestPullTags is set. A manifest that can't be fetched when it's pushed is
+// fetched again later, backing off from retryInterval.
 type WorkflowImpl struct {
-	db     database.Database
-	client client.Client
-	eqr    *registry.EquivRegistries
+	db             database.Database
+	fetcher        registry.Fetcher
+	eqr            *registry.EquivRegistries
+	mediaTypes     *registry.MediaTypes
+	artifacts      *artifact.Registry
+	ignorePulls    *pullFilter
+	digestPullTags bool
+	retryInterval  time.Duration
 }
 
+// pullFilter selects the pulls that are recorded in the events audit log
+// alone, because they discover what the registry holds rather than use it,
+// e.g. the fetches that RegStat itself makes when a manifest is pushed.
+type pullFilter struct {
+	userAgents *regexp.Regexp
+	actors     *regexp.Regexp
+}
+
+// createPullFilter creates a filter that selects the pulls whose user agent,
+// or actor, matches the given regular expression. An empty expression matches
+// nothing.
+func createPullFilter(userAgents string, actors string) (*pullFilter, error) {
+	filter := &pullFilter{}
+	var err error
+	if userAgents != "" {
+		filter.userAgents, err = regexp.Compile(userAgents)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user agent expression: %s", err)
+		}
+	}
+	if actors != "" {
+		filter.actors, err = regexp.Compile(actors)
+		if err != nil {
+			return nil, fmt.Errorf("invalid actor expression: %s", err)
+		}
+	}
+	return filter, nil
+}
+
+// matches determines whether the filter selects the event's pull.
+func (f *pullFilter) matches(event *notifications.Event) bool {
+	if f == nil {
+		return false
+	}
+	return (f.userAgents != nil && f.userAgents.MatchString(event.Request.UserAgent)) ||
+		(f.actors != nil && f.actors.MatchString(event.Actor.Name))
+}
+
+// genericMediaType is the media type that the registry gives blobs when it
+// doesn't know what they hold, e.g. in the events for blob pulls.
+const genericMediaType = "application/octet-stream"
+
 func createBlob(event *notifications.Event) database.Blob {
-	return database.Blob{
-		Digest: event.Target.Digest.String(),
-		Pushed: event.Timestamp,
-		Pulled: event.Timestamp,
+	blob := database.Blob{
+		Digest:     event.Target.Digest.String(),
+		Repository: event.Target.Repository,
+		Size:       event.Target.Size,
+		Pushed:     event.Timestamp,
+		Pulled:     event.Timestamp,
 	}
+	if event.Target.MediaType != genericMediaType {
+		blob.MediaType = event.Target.MediaType
+	}
+	return blob
 }
 
 func createManifest(event *notifications.Event) database.Manifest {
 	manifest := database.Manifest{
-		Digest: event.Target.Digest.String(),
-		Pushed: event.Timestamp,
-		Pulled: event.Timestamp,
+		Digest:     event.Target.Digest.String(),
+		Repository: event.Target.Repository,
+		Size:       event.Target.Size,
+		Pushed:     event.Timestamp,
+		Pulled:     event.Timestamp,
 	}
 	return manifest
 }
 
-func appendBlob(manifest *database.Manifest, digest string, timestamp time.Time) {
+func appendBlob(manifest *database.Manifest, digest string, mediaType string, size int64, timestamp time.Time) {
 	manifest.Blobs = append(manifest.Blobs,
 		database.Blob{
-			Digest: digest,
-			Pushed: timestamp,
-			Pulled: timestamp,
+			Digest:     digest,
+			Repository: manifest.Repository,
+			MediaType:  mediaType,
+			Size:       size,
+			Pushed:     timestamp,
+			Pulled:     timestamp,
 		})
 }
 
+// classify sets the role of a blob from its media type, if known.
+func (wf WorkflowImpl) classify(blob *database.Blob) {
+	if blob.MediaType != "" {
+		blob.Role = wf.mediaTypes.Role(blob.MediaType)
+	}
+}
+
+// eventRole returns the role of the content that an event refers to, which
+// decides how the event is processed. Content of a media type that isn't
+// known, e.g. the manifest or blob of an OCI artifact, is recognised by its
+// URL instead, and its blob is processed as a layer would be.
+func (wf WorkflowImpl) eventRole(event *notifications.Event) string {
+	role := wf.mediaTypes.Role(event.Target.MediaType)
+	if role == "" {
+		switch {
+		case strings.Contains(event.Target.URL, "/manifests/"):
+			role = registry.RoleManifest
+		case strings.Contains(event.Target.URL, "/blobs/"):
+			role = registry.RoleLayer
+		}
+	}
+	return role
+}
+
+// isBlobRole determines whether content with the given role is a blob.
+func isBlobRole(role string) bool {
+	return role == registry.RoleConfig || role == registry.RoleLayer || role == registry.RoleForeign
+}
+
+// createAuditEvent records who did what, and from where, for the events audit log.
+func createAuditEvent(event *notifications.Event) database.Event {
+	return database.Event{
+		ID:               event.ID,
+		Action:           event.Action,
+		Timestamp:        event.Timestamp,
+		Registry:         event.Request.Host,
+		Repository:       event.Target.Repository,
+		FromRepository:   event.Target.FromRepository,
+		Tag:              event.Target.Tag,
+		Digest:           event.Target.Digest.String(),
+		MediaType:        event.Target.MediaType,
+		Size:             event.Target.Size,
+		URL:              event.Target.URL,
+		Actor:            event.Actor.Name,
+		RequestID:        event.Request.ID,
+		RequestAddr:      event.Request.Addr,
+		RequestMethod:    event.Request.Method,
+		RequestUserAgent: event.Request.UserAgent,
+		SourceInstanceID: event.Source.InstanceID,
+		SourceAddr:       event.Source.Addr,
+	}
+}
+
 func createTag(event *notifications.Event, manifest *database.Manifest, eqr *registry.EquivRegistries) database.Tag {
 	name := eqr.FindEquivalent(event.Request.Host) + "/" + event.Target.Repository
 	if event.Target.Tag != "" {
@@ -71,68 +198,537 @@ func createTag(event *notifications.Event, manifest *database.Manifest, eqr *reg
 
 func enrichManifest(manifest *database.Manifest, v2Manifest *schema2.Manifest, timestamp time.Time) {
 	if v2Manifest.Config.Digest != "" {
-		appendBlob(manifest, v2Manifest.Config.Digest.String(), timestamp)
+		appendBlob(manifest, v2Manifest.Config.Digest.String(), v2Manifest.Config.MediaType, v2Manifest.Config.Size, timestamp)
 	}
 	for _, layer := range v2Manifest.Layers {
-		appendBlob(manifest, layer.Digest.String(), timestamp)
+		appendBlob(manifest, layer.Digest.String(), layer.MediaType, layer.Size, timestamp)
 	}
 }
 
-func (wf WorkflowImpl) processDelete(event *notifications.Event) {
-	// for delete events we need to lookup whether the digest refers to a blob or a manifest
-	if wf.db.IsManifest(event.Target.Digest.String()) {
-		wf.db.DeleteManifest(event.Target.Digest.String())
-	} else if wf.db.IsBlob(event.Target.Digest.String()) {
-		wf.db.DeleteBlob(event.Target.Digest.String())
-	} else {
-		log.Println("unknown delete event", event)
+// imageConfig is the part of an image config blob that RegStat records.
+type imageConfig struct {
+	Architecture string     `json:"architecture"`
+	OS           string     `json:"os"`
+	Variant      string     `json:"variant"`
+	Created      *time.Time `json:"created"`
+	Author       string     `json:"author"`
+	Config       struct {
+		Entrypoint   []string            `json:"Entrypoint"`
+		Cmd          []string            `json:"Cmd"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	} `json:"config"`
+	History []json.RawMessage `json:"history"`
+}
+
+// enrichImageConfig adds the details of an image's config, given its media
+// type and digest, which it fetches from the registry. The configs of other
+// kinds of artifact, e.g. Helm charts, are ignored. A config that can't be
+// fetched is logged rather than failing the push of its manifest.
+func (wf WorkflowImpl) enrichImageConfig(manifest *database.Manifest, manifestURL string, mediaType string, digest string) {
+	if mediaType != registry.MediaTypeDockerImageConfig && mediaType != registry.MediaTypeOCIImageConfig {
+		return
+	}
+	var parsed imageConfig
+	url, err := blobURL(manifestURL, digest)
+	if err == nil {
+		var body []byte
+		body, err = wf.fetcher.GetBlob(url)
+		if err == nil {
+			err = json.Unmarshal(body, &parsed)
+		}
+	}
+	if err != nil {
+		log.Println("failed to fetch image config", digest, err)
+		return
+	}
+	manifest.Config = createImageConfig(digest, &parsed)
+}
+
+// createImageConfig converts a parsed image config, with the given digest, to
+// the details that are recorded.
+func createImageConfig(digest string, parsed *imageConfig) *database.ImageConfig {
+	config := &database.ImageConfig{
+		Digest: digest,
+		Platform: database.Platform{
+			OS:           parsed.OS,
+			Architecture: parsed.Architecture,
+			Variant:      parsed.Variant,
+		},
+		Author:        parsed.Author,
+		Entrypoint:    parsed.Config.Entrypoint,
+		Cmd:           parsed.Config.Cmd,
+		HistoryLength: len(parsed.History),
+	}
+	if parsed.Created != nil {
+		config.Created = *parsed.Created
+	}
+	for port := range parsed.Config.ExposedPorts {
+		config.ExposedPorts = append(config.ExposedPorts, port)
+	}
+	sort.Strings(config.ExposedPorts)
+	return config
+}
+
+// enrichArtifact adds the blobs of an OCI image or artifact manifest, i.e. its
+// config and layers or, for an artifact manifest, its blobs, along with the
+// details of an image's config. An artifact's type, and the subject of a
+// referrer, are recorded, and if a handler is registered for the artifact then
+// the metadata that the handler extracts is too; a handler that fails is
+// logged rather than failing the push of its manifest.
+func (wf WorkflowImpl) enrichArtifact(manifest *database.Manifest, manifestURL string, ociManifest *artifact.Manifest, timestamp time.Time) {
+	if ociManifest.Config != nil && ociManifest.Config.Digest != "" {
+		appendBlob(manifest, ociManifest.Config.Digest, ociManifest.Config.MediaType, ociManifest.Config.Size, timestamp)
+		wf.enrichImageConfig(manifest, manifestURL, ociManifest.Config.MediaType, ociManifest.Config.Digest)
+	}
+	for _, layer := range append(ociManifest.Layers, ociManifest.Blobs...) {
+		appendBlob(manifest, layer.Digest, layer.MediaType, layer.Size, timestamp)
+	}
+	manifest.ArtifactType = ociManifest.Type()
+	if ociManifest.Subject != nil {
+		manifest.Subject = ociManifest.Subject.Digest
+	}
+	key, handler := wf.artifacts.Handler(ociManifest)
+	if handler == nil {
+		return
+	}
+	getBlob := func(digest string) ([]byte, error) {
+		url, err := blobURL(manifestURL, digest)
+		if err != nil {
+			return nil, err
+		}
+		return wf.fetcher.GetBlob(url)
+	}
+	metadata, err := handler.Extract(artifact.CreateArtifact(manifest.Digest, manifest.Repository, ociManifest, getBlob))
+	if err != nil {
+		log.Println("failed to extract artifact metadata", manifest.Digest, key, err)
+		return
+	}
+	// an empty, rather than nil, list replaces the metadata of an earlier push
+	manifest.Metadata = []database.ArtifactMetadata{}
+	for _, item := range metadata {
+		if item.Type == "" {
+			item.Type = key
+		}
+		manifest.Metadata = append(manifest.Metadata, item)
+	}
+}
+
+// blobURL derives the URL of a blob from that of a manifest in the same
+// repository, e.g. https://my.registry.com/v2/hello/manifests/sha256:... gives
+// https://my.registry.com/v2/hello/blobs/<digest>.
+func blobURL(manifestURL string, digest string) (string, error) {
+	i := strings.LastIndex(manifestURL, "/manifests/")
+	if i < 0 {
+		return "", fmt.Errorf("unexpected manifest URL %s", manifestURL)
+	}
+	return manifestURL[:i] + "/blobs/" + digest, nil
+}
+
+// enrichSchema1Manifest adds the blobs of a legacy schema1 manifest. Its
+// fsLayers, like its history, run from the top layer down, and the same blob
+// may appear more than once, e.g. the empty layer recorded for each
+// instruction that only changes metadata. Each history entry describes the
+// corresponding layer, so a manifest with a different number of history
+// entries is considered malformed. Schema1 manifests don't record the sizes
+// of their layers, and have no config blob; instead the top history entry
+// holds the image's config, which is recorded without a config digest.
+func enrichSchema1Manifest(manifest *database.Manifest, v1Manifest *schema1.Manifest, timestamp time.Time) error {
+	if len(v1Manifest.History) != len(v1Manifest.FSLayers) {
+		return fmt.Errorf("schema1 manifest has %d fsLayers but %d history entries", len(v1Manifest.FSLayers), len(v1Manifest.History))
+	}
+	if len(v1Manifest.History) > 0 {
+		var parsed imageConfig
+		err := json.Unmarshal([]byte(v1Manifest.History[0].V1Compatibility), &parsed)
+		if err != nil {
+			return fmt.Errorf("invalid schema1 history entry: %s", err)
+		}
+		manifest.Config = createImageConfig("", &parsed)
+		manifest.Config.HistoryLength = len(v1Manifest.History)
+	}
+	seen := map[string]bool{}
+	for i := len(v1Manifest.FSLayers) - 1; i >= 0; i-- {
+		digest := v1Manifest.FSLayers[i].BlobSum.String()
+		if !seen[digest] {
+			seen[digest] = true
+			appendBlob(manifest, digest, registry.MediaTypeDockerLayer, 0, timestamp)
+		}
+	}
+	return nil
+}
+
+// getManifest fetches a manifest of the given media type and parses it into v.
+func (wf WorkflowImpl) getManifest(url string, mediaType string, v interface{}) error {
+	actualMediaType, body, err := wf.fetcher.GetManifest(url)
+	if err != nil {
+		return err
+	}
+	if actualMediaType != mediaType {
+		return fmt.Errorf("expected %s from %s; got %s", mediaType, url, actualMediaType)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// imageIndex is a manifest list or OCI image index, along with the subject of
+// an index that is itself a referrer, e.g. a multi-platform attestation.
+type imageIndex struct {
+	manifestlist.ManifestList
+	Subject *artifact.Descriptor `json:"subject,omitempty"`
+}
+
+func enrichManifestList(manifest *database.Manifest, manifestList *manifestlist.ManifestList) {
+	for _, child := range manifestList.Manifests {
+		manifest.Children = append(manifest.Children,
+			database.ChildManifest{
+				Digest: child.Digest.String(),
+				Size:   child.Size,
+				Platform: database.Platform{
+					OS:           child.Platform.OS,
+					Architecture: child.Platform.Architecture,
+					Variant:      child.Platform.Variant,
+				},
+			})
 	}
 }
 
-func (wf WorkflowImpl) processPull(event *notifications.Event) {
-	switch event.Target.MediaType {
-	case "application/octet-stream",
-		"application/vnd.docker.image.rootfs.diff.tar.gzip":
+// once calls fn, passing a copy of the workflow whose database operations all
+// take place in a single transaction, unless the event has already been
+// processed. The event's ID, and its audit record, are written in that same
+// transaction, so a redelivered event is skipped only if its earlier changes
+// were committed.
+func (wf WorkflowImpl) once(event *notifications.Event, fn func(wf WorkflowImpl) error) error {
+	return wf.db.Transaction(func(db database.Database) error {
+		if event.ID != "" {
+			isNew, err := db.MarkEventProcessed(event.ID)
+			if err != nil {
+				return err
+			}
+			if !isNew {
+				log.Println("skipping duplicate event", event.ID)
+				duplicateEvents.Add(1)
+				return nil
+			}
+		}
+		audit := createAuditEvent(event)
+		err := db.RecordEvent(&audit)
+		if err != nil {
+			return err
+		}
+		txwf := wf
+		txwf.db = db
+		return fn(txwf)
+	})
+}
+
+func (wf WorkflowImpl) processDelete(event *notifications.Event) error {
+	return wf.once(event, func(wf WorkflowImpl) error {
+		if event.Target.Tag != "" {
+			// the tag has been untagged, leaving its manifest in place
+			tag := createTag(event, &database.Manifest{}, wf.eqr)
+			return wf.db.DeleteTag(tag.Name)
+		}
+		// for delete events we need to lookup whether the digest refers to a blob or a manifest
+		digest := event.Target.Digest.String()
+		isManifest, err := wf.db.IsManifest(digest)
+		if err != nil {
+			return err
+		}
+		if isManifest {
+			return wf.db.DeleteManifest(event.Target.Repository, digest)
+		}
+		isBlob, err := wf.db.IsBlob(digest)
+		if err != nil {
+			return err
+		}
+		if isBlob {
+			return wf.db.DeleteBlob(event.Target.Repository, digest)
+		}
+		log.Println("unknown delete event", event)
+		return nil
+	})
+}
+
+// audit records an event that changes nothing in the database, e.g. a pull
+// of a manifest by digest, in the events audit log.
+func (wf WorkflowImpl) audit(event *notifications.Event) error {
+	return wf.once(event, func(wf WorkflowImpl) error {
+		return nil
+	})
+}
+
+func (wf WorkflowImpl) processPull(event *notifications.Event) error {
+	if wf.ignorePulls.matches(event) {
+		log.Println("ignoring pull by", event.Request.UserAgent, event.Actor.Name)
+		return wf.audit(event)
+	}
+	role := wf.eventRole(event)
+	switch {
+	case isBlobRole(role):
 		// blob
 		blob := createBlob(event)
-		wf.db.PullBlob(&blob)
-	case "application/vnd.docker.distribution.manifest.v2+json":
+		wf.classify(&blob)
+		return wf.once(event, func(wf WorkflowImpl) error {
+			return wf.db.PullBlob(&blob)
+		})
+	case role == registry.RoleManifest:
 		// manifest
 		manifest := createManifest(event)
 		tag := createTag(event, &manifest, wf.eqr)
 		if tag.Tag == "" {
 			// the tag will be missing on the response to a pull of a manifest by
-			// digest; that usually only happens for technical reasons - e.g. when
-			// we want to discover the blobs that are associated with a tag - and
-			// so we skip it in order to avoid creating an empty tag entry
-			log.Println("ignoring pull of manifest with no tag")
-		} else {
-			wf.db.PullManifest(&manifest)
-			wf.db.PullTag(&tag)
+			// digest, e.g. by Kubernetes running a pinned image, so no tag entry
+			// is created; the pull may instead be attributed to the tags that
+			// currently refer to the manifest. Pulls made in order to discover
+			// the blobs that are associated with a tag are filtered out above
+			return wf.once(event, func(wf WorkflowImpl) error {
+				err := wf.db.PullManifest(&manifest)
+				if err != nil || !wf.digestPullTags {
+					return err
+				}
+				return wf.db.PullManifestTags(&tag)
+			})
 		}
+		return wf.once(event, func(wf WorkflowImpl) error {
+			err := wf.db.PullManifest(&manifest)
+			if err != nil {
+				return err
+			}
+			return wf.db.PullTag(&tag)
+		})
 	default:
 		log.Println("unknown event media type", event.Target.MediaType)
 	}
+	return wf.audit(event)
 }
 
-func (wf WorkflowImpl) processPush(event *notifications.Event) {
-	switch event.Target.MediaType {
-	case "application/octet-stream",
-		"application/vnd.docker.image.rootfs.diff.tar.gzip":
-		// blob
+func (wf WorkflowImpl) processPush(event *notifications.Event) error {
+	role := wf.eventRole(event)
+	if isBlobRole(role) {
 		blob := createBlob(event)
-		wf.db.PushBlob(&blob)
+		wf.classify(&blob)
+		return wf.once(event, func(wf WorkflowImpl) error {
+			return wf.db.PushBlob(&blob)
+		})
+	}
+	if role != registry.RoleManifest {
+		log.Println("unknown event media type", event.Target.MediaType)
+		return wf.audit(event)
+	}
+	// a redelivered event is skipped before fetching its manifest from the
+	// registry; once remains the authoritative check
+	if event.ID != "" {
+		processed, err := wf.db.IsEventProcessed(event.ID)
+		if err != nil {
+			return err
+		}
+		if processed {
+			log.Println("skipping duplicate event", event.ID)
+			duplicateEvents.Add(1)
+			return nil
+		}
+	}
+	manifest := createManifest(event)
+	tag := createTag(event, &manifest, wf.eqr)
+	var pending *database.PendingEnrichment
+	err := wf.enrich(&manifest, event.Target.URL, event.Target.MediaType, event.Timestamp)
+	if err != nil {
+		// the manifest is recorded without its blobs or children for now, and
+		// enriched by a later retry
+		log.Println("failed to fetch manifest", event.Target.URL, err)
+		pending = wf.createPendingEnrichment(&manifest, event.Target.URL, event.Target.MediaType, err)
+	}
+	return wf.pushManifest(event, &manifest, &tag, pending)
+}
+
+// enrich fetches a manifest of the given media type from the registry and adds
+// the blobs, or the children, that it refers to, returning an error if the
+// manifest can't be fetched or parsed.
+func (wf WorkflowImpl) enrich(manifest *database.Manifest, url string, mediaType string, timestamp time.Time) error {
+	switch mediaType {
 	case "application/vnd.docker.distribution.manifest.v2+json":
-		// manifest
-		manifest := createManifest(event)
-		tag := createTag(event, &manifest, wf.eqr)
-		manifestJSON, err := wf.client.GetV2Manifest(event.Target.URL)
-		if err == nil {
-			enrichManifest(&manifest, &manifestJSON, event.Timestamp)
+		var manifestJSON schema2.Manifest
+		err := wf.getManifest(url, mediaType, &manifestJSON)
+		if err != nil {
+			return err
+		}
+		enrichManifest(manifest, &manifestJSON, timestamp)
+		wf.enrichImageConfig(manifest, url, manifestJSON.Config.MediaType, manifestJSON.Config.Digest.String())
+	case "application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.oci.artifact.manifest.v1+json":
+		// OCI image or artifact manifest
+		var ociManifest artifact.Manifest
+		err := wf.getManifest(url, mediaType, &ociManifest)
+		if err != nil {
+			return err
+		}
+		wf.enrichArtifact(manifest, url, &ociManifest, timestamp)
+	case "application/vnd.docker.distribution.manifest.v1+prettyjws",
+		"application/vnd.docker.distribution.manifest.v1+json":
+		// legacy schema1 manifest, signed or not
+		var v1Manifest schema1.Manifest
+		err := wf.getManifest(url, mediaType, &v1Manifest)
+		if err != nil {
+			return err
+		}
+		return enrichSchema1Manifest(manifest, &v1Manifest, timestamp)
+	case "application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.oci.image.index.v1+json":
+		// manifest list or OCI image index, which have the same form
+		var manifestList imageIndex
+		err := wf.getManifest(url, mediaType, &manifestList)
+		if err != nil {
+			return err
+		}
+		enrichManifestList(manifest, &manifestList.ManifestList)
+		if manifestList.Subject != nil {
+			manifest.Subject = manifestList.Subject.Digest
 		}
-		wf.db.PushManifest(&manifest)
-		wf.db.PushTag(&tag)
 	default:
-		log.Println("unknown event media type", event.Target.MediaType)
+		// the manifest of some other kind of artifact, e.g. one that predates OCI
+		// artifact support, which is parsed as if it were an OCI manifest in
+		// order to find whatever blobs it refers to, so that at least the
+		// manifest and its blobs are recorded
+		var ociManifest artifact.Manifest
+		_, body, err := wf.fetcher.GetManifest(url)
+		if err == nil {
+			err = json.Unmarshal(body, &ociManifest)
+		}
+		if err != nil {
+			return err
+		}
+		wf.enrichArtifact(manifest, url, &ociManifest, timestamp)
+	}
+	return nil
+}
+
+// pushManifest records the push of a manifest and of the tag that refers to it.
+// The platform manifests of a multi-arch image are pushed by digest, before
+// the index that refers to them, and so have no tag. A manifest that couldn't
+// be enriched is recorded as pending, to be retried later; one that could
+// replaces any pending enrichment of an earlier push.
+func (wf WorkflowImpl) pushManifest(event *notifications.Event, manifest *database.Manifest, tag *database.Tag, pending *database.PendingEnrichment) error {
+	for i := range manifest.Blobs {
+		wf.classify(&manifest.Blobs[i])
+	}
+	return wf.once(event, func(wf WorkflowImpl) error {
+		err := wf.db.PushManifest(manifest)
+		if err != nil {
+			return err
+		}
+		if pending != nil {
+			err = wf.db.SavePendingEnrichment(pending)
+		} else {
+			err = wf.db.DeletePendingEnrichment(manifest.Digest)
+		}
+		if err != nil || tag.Tag == "" {
+			return err
+		}
+		return wf.db.PushTag(tag)
+	})
+}
+
+// maxEnrichmentBackoff bounds the interval between retries of a pending
+// enrichment.
+const maxEnrichmentBackoff = 24 * time.Hour
+
+// enrichmentBackoff returns how long to wait before retrying an enrichment
+// that has failed the given number of times: the retry interval, doubled for
+// each failure after the first, up to maxEnrichmentBackoff.
+func enrichmentBackoff(interval time.Duration, attempts int) time.Duration {
+	backoff := interval
+	for i := 1; i < attempts && backoff < maxEnrichmentBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxEnrichmentBackoff {
+		backoff = maxEnrichmentBackoff
+	}
+	return backoff
+}
+
+// createPendingEnrichment records the first failed attempt to enrich a
+// manifest.
+func (wf WorkflowImpl) createPendingEnrichment(manifest *database.Manifest, url string, mediaType string, err error) *database.PendingEnrichment {
+	return &database.PendingEnrichment{
+		Digest:      manifest.Digest,
+		Repository:  manifest.Repository,
+		MediaType:   mediaType,
+		URL:         url,
+		Pushed:      manifest.Pushed,
+		Attempts:    1,
+		LastError:   err.Error(),
+		NextAttempt: time.Now().UTC().Add(enrichmentBackoff(wf.retryInterval, 1)),
+	}
+}
+
+// retryEnrichments retries each pending enrichment that is due, returning an
+// error if the outcome of a retry couldn't be recorded. It stops early once
+// quit is closed, leaving the rest for another time.
+func (wf WorkflowImpl) retryEnrichments(quit <-chan struct{}) error {
+	now := time.Now().UTC()
+	pendings, err := wf.db.PendingEnrichments(now)
+	if err != nil {
+		return err
+	}
+	for i := range pendings {
+		select {
+		case <-quit:
+			return nil
+		default:
+		}
+		err = wf.retryEnrichment(&pendings[i], now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryEnrichment fetches a pending manifest again. If that succeeds then the
+// manifest is recorded along with its blobs or children, and is no longer
+// pending; otherwise its next attempt is put off for longer. A manifest that
+// has been deleted since is no longer pending either.
+func (wf WorkflowImpl) retryEnrichment(pending *database.PendingEnrichment, now time.Time) error {
+	manifest := database.Manifest{Digest: pending.Digest, Repository: pending.Repository, Pushed: pending.Pushed}
+	enrichErr := wf.enrich(&manifest, pending.URL, pending.MediaType, pending.Pushed)
+	for i := range manifest.Blobs {
+		wf.classify(&manifest.Blobs[i])
+	}
+	return wf.db.Transaction(func(db database.Database) error {
+		// the manifest stays locked until it's recorded, so a delete that
+		// arrives in the meantime waits rather than being undone
+		isManifest, err := db.IsManifest(pending.Digest)
+		if err != nil {
+			return err
+		}
+		if !isManifest {
+			return db.DeletePendingEnrichment(pending.Digest)
+		}
+		if enrichErr != nil {
+			log.Println("failed to retry manifest fetch", pending.URL, pending.Attempts, enrichErr)
+			pending.Attempts++
+			pending.LastError = enrichErr.Error()
+			pending.NextAttempt = now.Add(enrichmentBackoff(wf.retryInterval, pending.Attempts))
+			return db.SavePendingEnrichment(pending)
+		}
+		err = db.PushManifest(&manifest)
+		if err != nil {
+			return err
+		}
+		log.Println("enriched manifest", pending.Digest, "after", pending.Attempts+1, "attempts")
+		return db.DeletePendingEnrichment(pending.Digest)
+	})
+}
+
+// processMount records a blob mounted into the event's repository from
+// another repository, which is a push of the blob that didn't need to upload
+// it. Only blobs are ever mounted, so the media type isn't checked.
+func (wf WorkflowImpl) processMount(event *notifications.Event) error {
+	mount := database.BlobMount{
+		Blob:           createBlob(event),
+		Repository:     event.Target.Repository,
+		FromRepository: event.Target.FromRepository,
 	}
+	wf.classify(&mount.Blob)
+	return wf.once(event, func(wf WorkflowImpl) error {
+		return wf.db.MountBlob(&mount)
+	})
 }
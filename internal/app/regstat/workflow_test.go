@@ -4,36 +4,119 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/docker/distribution/notifications"
-	"github.com/vleurgat/dockerclient/pkg/client"
+	"github.com/vleurgat/regstat/internal/app/artifact"
+	"github.com/vleurgat/regstat/internal/app/database"
 	"github.com/vleurgat/regstat/internal/app/database/mock"
 	"github.com/vleurgat/regstat/internal/app/registry"
+	registrymock "github.com/vleurgat/regstat/internal/app/registry/mock"
 )
 
+const ociManifestFixture = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.manifest.v1+json",
+  "config": {
+    "mediaType": "application/vnd.oci.image.config.v1+json",
+    "digest": "sha256:c0ffee",
+    "size": 1469
+  },
+  "layers": [
+    {
+      "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+      "digest": "sha256:1a7e41",
+      "size": 3370706
+    },
+    {
+      "mediaType": "application/vnd.oci.image.layer.v1.tar+gzip",
+      "digest": "sha256:1a7e42",
+      "size": 1204
+    }
+  ]
+}`
+
+const schema1ManifestFixture = `{
+  "schemaVersion": 1,
+  "name": "hello",
+  "tag": "hoo",
+  "architecture": "amd64",
+  "fsLayers": [
+    {"blobSum": "sha256:a3ed95"},
+    {"blobSum": "sha256:5f70bf"},
+    {"blobSum": "sha256:a3ed95"}
+  ],
+  "history": [
+    {"v1Compatibility": "{\"id\":\"e45a5a\",\"parent\":\"31cbcc\",\"os\":\"linux\",\"architecture\":\"amd64\",\"created\":\"2016-09-23T18:08:50Z\",\"config\":{\"Cmd\":[\"/hello\"]},\"throwaway\":true}"},
+    {"v1Compatibility": "{\"id\":\"31cbcc\",\"parent\":\"b5b2b2\"}"},
+    {"v1Compatibility": "{\"id\":\"b5b2b2\",\"throwaway\":true}"}
+  ],
+  "signatures": [{"header": {"alg": "ES256"}, "signature": "c2lnbmF0dXJl", "protected": "cHJvdGVjdGVk"}]
+}`
+
+const ociIndexFixture = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.index.v1+json",
+  "manifests": [
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:a3d64",
+      "size": 1024,
+      "platform": {"architecture": "amd64", "os": "linux"}
+    },
+    {
+      "mediaType": "application/vnd.oci.image.manifest.v1+json",
+      "digest": "sha256:a3d7",
+      "size": 1024,
+      "platform": {"architecture": "arm", "os": "linux", "variant": "v7"}
+    }
+  ]
+}`
+
 type MockWorkflow struct {
 	receivedEvents *[]*notifications.Event
+	err            error
 }
 
 func createMockWorkflow() MockWorkflow {
 	return MockWorkflow{receivedEvents: &[]*notifications.Event{}}
 }
 
-func (wf MockWorkflow) processDelete(event *notifications.Event) {
+func (wf MockWorkflow) processDelete(event *notifications.Event) error {
+	*wf.receivedEvents = append(*wf.receivedEvents, event)
+	return wf.err
+}
+
+func (wf MockWorkflow) processPush(event *notifications.Event) error {
 	*wf.receivedEvents = append(*wf.receivedEvents, event)
+	return wf.err
 }
 
-func (wf MockWorkflow) processPush(event *notifications.Event) {
+func (wf MockWorkflow) processPull(event *notifications.Event) error {
 	*wf.receivedEvents = append(*wf.receivedEvents, event)
+	return wf.err
 }
 
-func (wf MockWorkflow) processPull(event *notifications.Event) {
+func (wf MockWorkflow) processMount(event *notifications.Event) error {
 	*wf.receivedEvents = append(*wf.receivedEvents, event)
+	return wf.err
+}
+
+func (wf MockWorkflow) retryEnrichments(quit <-chan struct{}) error {
+	return wf.err
+}
+
+// countingFetcher counts the manifests fetched through it.
+type countingFetcher struct {
+	registry.Fetcher
+	fetches *int
+}
+
+func (f countingFetcher) GetManifest(url string) (string, []byte, error) {
+	*f.fetches++
+	return f.Fetcher.GetManifest(url)
 }
 
 func createEvent(t *testing.T, body string) *notifications.Event {
@@ -60,7 +143,7 @@ func TestProcessDelete(t *testing.T) {
 		db := mock.CreateDatabase()
 		db.IsManifestRetValue = true
 		wf := WorkflowImpl{db: db}
-		event := createEvent(t, "{\"target\":{\"digest\":\"boo\"}}")
+		event := createEvent(t, "{\"target\":{\"repository\":\"hello\", \"digest\":\"boo\"}}")
 		wf.processDelete(event)
 		if len(*db.DeletedManifests) != 1 || len(*db.DeletedBlobs) != 0 {
 			t.Fatal("expected 1 manifest and no blob deletions")
@@ -68,13 +151,48 @@ func TestProcessDelete(t *testing.T) {
 		if (*db.DeletedManifests)[0] != "boo" {
 			t.Error("unexpected deleted manifest digest")
 		}
+		if (*db.DeletedManifestRepositories)[0] != "hello" {
+			t.Error("unexpected deleted manifest repository", (*db.DeletedManifestRepositories)[0])
+		}
+	})
+
+	t.Run("lookup error", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		db.Err = errors.New("oops")
+		wf := WorkflowImpl{db: db}
+		event := createEvent(t, "{\"target\":{\"digest\":\"boo\"}}")
+		err := wf.processDelete(event)
+		if err == nil {
+			t.Fatal("expected non nil err")
+		}
+		if len(*db.DeletedManifests) != 0 || len(*db.DeletedBlobs) != 0 {
+			t.Fatal("expected no deletions")
+		}
+	})
+
+	t.Run("tag", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		db.IsManifestRetValue = true
+		eqr := registry.EquivRegistries{Equivs: map[string][]string{"my.registry.com": {"my.registry.com:443"}}}
+		wf := WorkflowImpl{db: db, eqr: &eqr}
+		event := createEvent(t, "{\"target\":{\"repository\":\"hello\", \"tag\":\"hoo\"}, \"request\":{\"host\":\"my.registry.com:443\"}}")
+		err := wf.processDelete(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.DeletedTags) != 1 || len(*db.DeletedManifests) != 0 || len(*db.DeletedBlobs) != 0 {
+			t.Fatal("expected 1 tag and no manifest or blob deletions")
+		}
+		if (*db.DeletedTags)[0] != "my.registry.com/hello:hoo" {
+			t.Error("unexpected deleted tag name", (*db.DeletedTags)[0])
+		}
 	})
 
 	t.Run("blob", func(t *testing.T) {
 		db := mock.CreateDatabase()
 		db.IsBlobRetValue = true
 		wf := WorkflowImpl{db: db}
-		event := createEvent(t, "{\"target\":{\"digest\":\"boo\"}}")
+		event := createEvent(t, "{\"target\":{\"repository\":\"hello\", \"digest\":\"boo\"}}")
 		wf.processDelete(event)
 		if len(*db.DeletedManifests) != 0 || len(*db.DeletedBlobs) != 1 {
 			t.Fatal("expected 1 blob and no manifest deletions")
@@ -82,6 +200,9 @@ func TestProcessDelete(t *testing.T) {
 		if (*db.DeletedBlobs)[0] != "boo" {
 			t.Error("unexpected deleted blob digest")
 		}
+		if (*db.DeletedBlobRepositories)[0] != "hello" {
+			t.Error("unexpected deleted blob repository", (*db.DeletedBlobRepositories)[0])
+		}
 	})
 }
 
@@ -125,8 +246,71 @@ func TestProcessPull(t *testing.T) {
 			"{\"target\":{\"digest\":\"boo\", \"mediaType\":\"application/vnd.docker.distribution.manifest.v2+json\"}, \"timestamp\":\"%s\"}",
 			nowStr))
 		wf.processPull(event)
-		if len(*db.PulledManifests) != 0 || len(*db.PulledBlobs) != 0 || len(*db.PulledTags) != 0 {
-			t.Fatal("expected no pulls")
+		if len(*db.PulledManifests) != 1 || len(*db.PulledTags) != 0 || len(*db.PulledManifestTags) != 0 {
+			t.Fatal("expected 1 manifest pull only")
+		}
+		if (*db.PulledManifests)[0].Digest != "boo" || !now.Equal((*db.PulledManifests)[0].Pulled) {
+			t.Error("unexpected pulled manifest", (*db.PulledManifests)[0])
+		}
+	})
+
+	t.Run("manifest no tag attributed to tags", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{Equivs: map[string][]string{"my.registry.com": {"my.registry.com:443"}}}
+		wf := WorkflowImpl{db: db, eqr: &eqr, digestPullTags: true}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"target\":{\"repository\":\"hello\", \"digest\":\"boo\", \"mediaType\":\"application/vnd.docker.distribution.manifest.v2+json\"}, "+
+				"\"request\":{\"host\":\"my.registry.com:443\"}, \"timestamp\":\"%s\"}",
+			nowStr))
+		wf.processPull(event)
+		if len(*db.PulledManifests) != 1 || len(*db.PulledTags) != 0 || len(*db.PulledManifestTags) != 1 {
+			t.Fatal("expected 1 manifest pull attributed to its tags")
+		}
+		tag := (*db.PulledManifestTags)[0]
+		if tag.Name != "my.registry.com/hello" || tag.Manifest.Digest != "boo" || !now.Equal(tag.Pulled) {
+			t.Error("unexpected pulled manifest tags", tag)
+		}
+	})
+
+	t.Run("ignored pulls", func(t *testing.T) {
+		filter, err := createPullFilter(`^regstat\b`, "^scanner$")
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		for _, test := range []struct {
+			userAgent string
+			actor     string
+			ignored   bool
+		}{
+			{"regstat", "", true},
+			{"regstat/1.0", "", true},
+			{"Go-http-client/1.1", "", false},
+			{"docker/18.09.2", "scanner", true},
+			{"containerd/1.6.0", "", false},
+			{"docker/18.09.2", "joe", false},
+		} {
+			db := mock.CreateDatabase()
+			eqr := registry.EquivRegistries{}
+			wf := WorkflowImpl{db: db, eqr: &eqr, ignorePulls: filter}
+			event := createEvent(t, fmt.Sprintf(
+				"{\"target\":{\"digest\":\"boo\", \"mediaType\":\"application/vnd.docker.distribution.manifest.v2+json\"}, "+
+					"\"request\":{\"useragent\":\"%s\"}, \"actor\":{\"name\":\"%s\"}}",
+				test.userAgent, test.actor))
+			wf.processPull(event)
+			if (len(*db.PulledManifests) == 0) != test.ignored {
+				t.Errorf("%s %s: expected ignored %t", test.userAgent, test.actor, test.ignored)
+			}
+			// the pull is audited either way
+			if len(*db.RecordedEvents) != 1 {
+				t.Error("expected pull to be recorded in the audit log", *db.RecordedEvents)
+			}
+		}
+	})
+
+	t.Run("invalid pull filter", func(t *testing.T) {
+		_, err := createPullFilter("(", "")
+		if err == nil {
+			t.Error("expected non nil err")
 		}
 	})
 
@@ -154,6 +338,48 @@ func TestProcessPull(t *testing.T) {
 			t.Error("unexpected pulled tag timestamp")
 		}
 	})
+
+	t.Run("oci manifest with tag", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		wf := WorkflowImpl{db: db, eqr: &eqr}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"target\":{\"tag\":\"hoo\", \"digest\":\"boo\", \"mediaType\":\"application/vnd.oci.image.manifest.v1+json\"}, \"timestamp\":\"%s\"}",
+			nowStr))
+		wf.processPull(event)
+		if len(*db.PulledManifests) != 1 || len(*db.PulledBlobs) != 0 || len(*db.PulledTags) != 1 {
+			t.Fatal("expected 1 manifest and 1 tag pull")
+		}
+		if (*db.PulledManifests)[0].Digest != "boo" {
+			t.Error("unexpected pulled manifest digest")
+		}
+	})
+
+	t.Run("schema1 manifest with tag", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		wf := WorkflowImpl{db: db, eqr: &eqr}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"target\":{\"tag\":\"hoo\", \"digest\":\"boo\", \"mediaType\":\"application/vnd.docker.distribution.manifest.v1+prettyjws\"}, \"timestamp\":\"%s\"}",
+			nowStr))
+		wf.processPull(event)
+		if len(*db.PulledManifests) != 1 || len(*db.PulledTags) != 1 {
+			t.Fatal("expected 1 manifest and 1 tag pull")
+		}
+	})
+
+	t.Run("manifest list with tag", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		wf := WorkflowImpl{db: db, eqr: &eqr}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"target\":{\"tag\":\"hoo\", \"digest\":\"boo\", \"mediaType\":\"application/vnd.docker.distribution.manifest.list.v2+json\"}, \"timestamp\":\"%s\"}",
+			nowStr))
+		wf.processPull(event)
+		if len(*db.PulledManifests) != 1 || len(*db.PulledTags) != 1 {
+			t.Fatal("expected 1 manifest and 1 tag pull")
+		}
+	})
 }
 
 func TestProcessPush(t *testing.T) {
@@ -174,7 +400,7 @@ func TestProcessPush(t *testing.T) {
 		db := mock.CreateDatabase()
 		wf := WorkflowImpl{db: db}
 		event := createEvent(t, fmt.Sprintf(
-			"{\"target\":{\"digest\":\"boo\", \"mediaType\":\"application/octet-stream\"}, \"timestamp\":\"%s\"}",
+			"{\"target\":{\"digest\":\"boo\", \"size\":1234, \"mediaType\":\"application/octet-stream\"}, \"timestamp\":\"%s\"}",
 			nowStr))
 		wf.processPush(event)
 		if len(*db.PushedManifests) != 0 || len(*db.PushedBlobs) != 1 || len(*db.PushedTags) != 0 {
@@ -183,20 +409,75 @@ func TestProcessPush(t *testing.T) {
 		if (*db.PushedBlobs)[0].Digest != "boo" {
 			t.Error("unexpected pushed blob digest")
 		}
+		if (*db.PushedBlobs)[0].Size != 1234 {
+			t.Error("unexpected pushed blob size")
+		}
 		if !now.Equal((*db.PushedBlobs)[0].Pushed) {
 			t.Error("unexpected pushed blob timestamp")
 		}
 	})
 
-	t.Run("manifest no enrichment", func(t *testing.T) {
+	t.Run("duplicate event", func(t *testing.T) {
 		db := mock.CreateDatabase()
+		wf := WorkflowImpl{db: db}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"id\":\"event1\", \"target\":{\"digest\":\"boo\", \"mediaType\":\"application/octet-stream\"}, \"timestamp\":\"%s\"}",
+			nowStr))
+		before := duplicateEvents.Value()
+		wf.processPush(event)
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.PushedBlobs) != 1 {
+			t.Fatal("expected 1 blob push only")
+		}
+		if len(*db.RecordedEvents) != 1 {
+			t.Error("expected 1 audit event only", len(*db.RecordedEvents))
+		}
+		if duplicateEvents.Value() != before+1 {
+			t.Error("expected duplicate events counter to be incremented")
+		}
+	})
+
+	t.Run("duplicate manifest event", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		(*db.ProcessedEvents)["event1"] = true
 		eqr := registry.EquivRegistries{}
-		httpClient := client.CreateMockHTTPClientErr(errors.New("oops"))
-		wf := WorkflowImpl{
-			db:     db,
-			eqr:    &eqr,
-			client: client.CreateClientProvidingHTTPClient(httpClient, nil),
+		fetcher := countingFetcher{Fetcher: registrymock.CreateFetcher(), fetches: new(int)}
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"id\":\"event1\", \"target\":{\"tag\":\"hoo\", \"url\":\"http://hello\", \"digest\":\"boo\", \"mediaType\":\"application/vnd.docker.distribution.manifest.v2+json\"}, \"timestamp\":\"%s\"}",
+			nowStr))
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if *fetcher.fetches != 0 {
+			t.Error("expected the manifest of a duplicate event to not be fetched", *fetcher.fetches)
+		}
+		if len(*db.PushedManifests) != 0 || len(*db.SavedPendingEnrichments) != 0 {
+			t.Error("expected duplicate event to be skipped")
+		}
+	})
+
+	t.Run("database error", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		db.Err = errors.New("oops")
+		wf := WorkflowImpl{db: db}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"target\":{\"digest\":\"boo\", \"mediaType\":\"application/octet-stream\"}, \"timestamp\":\"%s\"}",
+			nowStr))
+		err := wf.processPush(event)
+		if err == nil || err.Error() != "oops" {
+			t.Fatalf("expected oops; got %v", err)
 		}
+	})
+
+	t.Run("manifest no enrichment", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: registrymock.CreateFetcher()}
 		event := createEvent(t, fmt.Sprintf(
 			"{\"target\":{\"tag\":\"hoo\", \"digest\":\"boo\", \"mediaType\":\"application/vnd.docker.distribution.manifest.v2+json\"}, \"timestamp\":\"%s\"}",
 			nowStr))
@@ -213,6 +494,9 @@ func TestProcessPush(t *testing.T) {
 		if len((*db.PushedManifests)[0].Blobs) != 0 {
 			t.Error("expected no associated blobs")
 		}
+		if len(*db.SavedPendingEnrichments) != 1 {
+			t.Error("expected enrichment to be pending")
+		}
 		if (*db.PushedTags)[0].Tag != "hoo" && (*db.PushedTags)[0].Name != "/:hoo" {
 			t.Error("unexpected pushed tag name")
 		}
@@ -224,15 +508,12 @@ func TestProcessPush(t *testing.T) {
 	t.Run("manifest with enrichment", func(t *testing.T) {
 		db := mock.CreateDatabase()
 		eqr := registry.EquivRegistries{}
-		httpClient := client.CreateMockHTTPClient(http.Response{
-			StatusCode: 200,
-			Body:       ioutil.NopCloser(strings.NewReader("{\"config\":{\"digest\": \"123456\"}}")),
-		})
-		wf := WorkflowImpl{
-			db:     db,
-			eqr:    &eqr,
-			client: client.CreateClientProvidingHTTPClient(httpClient, nil),
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests["http://hello"] = registrymock.Content{
+			MediaType: "application/vnd.docker.distribution.manifest.v2+json",
+			Body:      "{\"config\":{\"digest\": \"123456\"}}",
 		}
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher}
 		event := createEvent(t, fmt.Sprintf(
 			"{\"target\":{\"tag\":\"hoo\", \"url\":\"http://hello\", \"digest\":\"boo\", \"mediaType\":\"application/vnd.docker.distribution.manifest.v2+json\"}, \"timestamp\":\"%s\"}",
 			nowStr))
@@ -259,4 +540,729 @@ func TestProcessPush(t *testing.T) {
 			t.Error("unexpected pushed tag timestamp")
 		}
 	})
+
+	t.Run("oci manifest with enrichment", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests["http://hello"] = registrymock.Content{
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Body:      ociManifestFixture,
+		}
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"target\":{\"tag\":\"hoo\", \"url\":\"http://hello\", \"digest\":\"boo\", \"size\":759, \"mediaType\":\"application/vnd.oci.image.manifest.v1+json\"}, \"timestamp\":\"%s\"}",
+			nowStr))
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.PushedManifests) != 1 || len(*db.PushedBlobs) != 0 || len(*db.PushedTags) != 1 {
+			t.Fatal("expected 1 manifest and 1 tag push")
+		}
+		manifest := (*db.PushedManifests)[0]
+		if manifest.Digest != "boo" {
+			t.Error("unexpected pushed manifest digest")
+		}
+		if len(manifest.Blobs) != 3 {
+			t.Fatal("expected config and 2 layer blobs", manifest.Blobs)
+		}
+		for i, digest := range []string{"sha256:c0ffee", "sha256:1a7e41", "sha256:1a7e42"} {
+			if manifest.Blobs[i].Digest != digest {
+				t.Errorf("expected blob %d to be %s; got %s", i, digest, manifest.Blobs[i].Digest)
+			}
+			if !now.Equal(manifest.Blobs[i].Pushed) {
+				t.Error("unexpected pushed blob timestamp")
+			}
+		}
+		if manifest.Blobs[0].Size != 1469 || manifest.Blobs[1].Size != 3370706 {
+			t.Error("unexpected blob sizes", manifest.Blobs)
+		}
+		if manifest.Blobs[0].Role != "config" || manifest.Blobs[1].Role != "layer" ||
+			manifest.Blobs[1].MediaType != "application/vnd.oci.image.layer.v1.tar+gzip" {
+			t.Error("unexpected blob media types", manifest.Blobs)
+		}
+		if manifest.Size != 759 {
+			t.Error("expected manifest size from the event", manifest.Size)
+		}
+		if (*db.PushedTags)[0].Tag != "hoo" {
+			t.Error("unexpected pushed tag")
+		}
+	})
+
+	t.Run("oci manifest no enrichment", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			content registrymock.Content
+		}{
+			{"not found", registrymock.Content{}},
+			{"unexpected media type", registrymock.Content{MediaType: "application/vnd.docker.distribution.manifest.v2+json", Body: ociManifestFixture}},
+			{"bad json", registrymock.Content{MediaType: "application/vnd.oci.image.manifest.v1+json", Body: "abc"}},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				db := mock.CreateDatabase()
+				eqr := registry.EquivRegistries{}
+				fetcher := registrymock.CreateFetcher()
+				if test.content.MediaType != "" {
+					fetcher.Manifests["http://hello"] = test.content
+				}
+				wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher}
+				event := createEvent(t, fmt.Sprintf(
+					"{\"target\":{\"tag\":\"hoo\", \"url\":\"http://hello\", \"digest\":\"boo\", \"mediaType\":\"application/vnd.oci.image.manifest.v1+json\"}, \"timestamp\":\"%s\"}",
+					nowStr))
+				wf.processPush(event)
+				if len(*db.PushedManifests) != 1 || len(*db.PushedTags) != 1 {
+					t.Fatal("expected 1 manifest and 1 tag push")
+				}
+				if len((*db.PushedManifests)[0].Blobs) != 0 {
+					t.Error("expected no associated blobs")
+				}
+			})
+		}
+	})
+
+	t.Run("image index", func(t *testing.T) {
+		for _, mediaType := range []string{"application/vnd.oci.image.index.v1+json", "application/vnd.docker.distribution.manifest.list.v2+json"} {
+			t.Run(mediaType, func(t *testing.T) {
+				db := mock.CreateDatabase()
+				eqr := registry.EquivRegistries{}
+				fetcher := registrymock.CreateFetcher()
+				fetcher.Manifests["http://hello"] = registrymock.Content{MediaType: mediaType, Body: ociIndexFixture}
+				wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher}
+				event := createEvent(t, fmt.Sprintf(
+					"{\"target\":{\"tag\":\"hoo\", \"url\":\"http://hello\", \"digest\":\"boo\", \"mediaType\":\"%s\"}, \"timestamp\":\"%s\"}",
+					mediaType, nowStr))
+				err := wf.processPush(event)
+				if err != nil {
+					t.Fatalf("expected nil err; got %s", err)
+				}
+				if len(*db.PushedManifests) != 1 || len(*db.PushedTags) != 1 {
+					t.Fatal("expected 1 manifest and 1 tag push")
+				}
+				manifest := (*db.PushedManifests)[0]
+				if len(manifest.Blobs) != 0 || len(manifest.Children) != 2 {
+					t.Fatal("expected 2 children and no blobs", manifest)
+				}
+				if manifest.Children[0].Size != 1024 {
+					t.Error("unexpected child size", manifest.Children[0])
+				}
+				if manifest.Children[0].Digest != "sha256:a3d64" || manifest.Children[0].Platform.Architecture != "amd64" || manifest.Children[0].Platform.OS != "linux" {
+					t.Error("unexpected first child", manifest.Children[0])
+				}
+				if manifest.Children[1].Digest != "sha256:a3d7" || manifest.Children[1].Platform.Architecture != "arm" || manifest.Children[1].Platform.Variant != "v7" {
+					t.Error("unexpected second child", manifest.Children[1])
+				}
+			})
+		}
+	})
+
+	t.Run("manifest no tag", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests["http://hello"] = registrymock.Content{
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Body:      ociManifestFixture,
+		}
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"target\":{\"url\":\"http://hello\", \"digest\":\"boo\", \"mediaType\":\"application/vnd.oci.image.manifest.v1+json\"}, \"timestamp\":\"%s\"}",
+			nowStr))
+		wf.processPush(event)
+		if len(*db.PushedManifests) != 1 || len(*db.PushedTags) != 0 {
+			t.Fatal("expected 1 manifest and no tag push")
+		}
+		if len((*db.PushedManifests)[0].Blobs) != 3 {
+			t.Error("expected associated blobs")
+		}
+	})
+
+	t.Run("schema1 manifest", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			body  string
+			blobs []string
+		}{
+			{"valid", schema1ManifestFixture, []string{"sha256:a3ed95", "sha256:5f70bf"}},
+			{"missing history", "{\"schemaVersion\":1,\"fsLayers\":[{\"blobSum\":\"sha256:5f70bf\"}]}", nil},
+			{"bad history", "{\"schemaVersion\":1,\"fsLayers\":[{\"blobSum\":\"sha256:5f70bf\"}],\"history\":[{\"v1Compatibility\":\"abc\"}]}", nil},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				db := mock.CreateDatabase()
+				eqr := registry.EquivRegistries{}
+				fetcher := registrymock.CreateFetcher()
+				fetcher.Manifests["http://hello"] = registrymock.Content{
+					MediaType: "application/vnd.docker.distribution.manifest.v1+prettyjws",
+					Body:      test.body,
+				}
+				wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher}
+				event := createEvent(t, fmt.Sprintf(
+					"{\"target\":{\"tag\":\"hoo\", \"url\":\"http://hello\", \"digest\":\"boo\", \"mediaType\":\"application/vnd.docker.distribution.manifest.v1+prettyjws\"}, \"timestamp\":\"%s\"}",
+					nowStr))
+				err := wf.processPush(event)
+				if err != nil {
+					t.Fatalf("expected nil err; got %s", err)
+				}
+				if len(*db.PushedManifests) != 1 || len(*db.PushedTags) != 1 {
+					t.Fatal("expected 1 manifest and 1 tag push")
+				}
+				blobs := (*db.PushedManifests)[0].Blobs
+				if len(blobs) != len(test.blobs) {
+					t.Fatalf("expected %d blobs; got %d", len(test.blobs), len(blobs))
+				}
+				for i, digest := range test.blobs {
+					if blobs[i].Digest != digest {
+						t.Errorf("expected blob %d to be %s; got %s", i, digest, blobs[i].Digest)
+					}
+					if blobs[i].MediaType != registry.MediaTypeDockerLayer {
+						t.Errorf("expected blob %d to be a layer; got %s", i, blobs[i].MediaType)
+					}
+				}
+				if test.blobs == nil {
+					return
+				}
+				config := (*db.PushedManifests)[0].Config
+				if config == nil || config.Digest != "" || config.Platform.OS != "linux" || config.Platform.Architecture != "amd64" ||
+					!config.Created.Equal(time.Date(2016, 9, 23, 18, 8, 50, 0, time.UTC)) ||
+					len(config.Cmd) != 1 || config.HistoryLength != 3 {
+					t.Errorf("unexpected image config %+v", config)
+				}
+			})
+		}
+	})
+}
+
+const imageConfigFixture = `{
+  "architecture": "arm64",
+  "os": "linux",
+  "variant": "v8",
+  "created": "2019-02-28T10:11:12Z",
+  "author": "joe",
+  "config": {
+    "Entrypoint": ["/bin/hello"],
+    "Cmd": ["--verbose"],
+    "ExposedPorts": {"8080/tcp": {}, "443/tcp": {}}
+  },
+  "history": [{"created_by": "ADD file"}, {"created_by": "CMD"}]
+}`
+
+func TestImageConfig(t *testing.T) {
+	manifestURL := "http://my.registry.com/v2/hello/manifests/sha256:b00"
+	event := createEvent(t, fmt.Sprintf(
+		"{\"target\":{\"tag\":\"hoo\", \"url\":\"%s\", \"digest\":\"sha256:b00\", \"mediaType\":\"application/vnd.oci.image.manifest.v1+json\"}}",
+		manifestURL))
+
+	t.Run("fetched", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests[manifestURL] = registrymock.Content{MediaType: "application/vnd.oci.image.manifest.v1+json", Body: ociManifestFixture}
+		fetcher.Blobs["http://my.registry.com/v2/hello/blobs/sha256:c0ffee"] = imageConfigFixture
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher}
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		config := (*db.PushedManifests)[0].Config
+		if config == nil {
+			t.Fatal("expected image config")
+		}
+		if config.Digest != "sha256:c0ffee" || config.Platform.OS != "linux" || config.Platform.Architecture != "arm64" || config.Platform.Variant != "v8" {
+			t.Error("unexpected image config platform", config)
+		}
+		if !config.Created.Equal(time.Date(2019, 2, 28, 10, 11, 12, 0, time.UTC)) || config.Author != "joe" {
+			t.Error("unexpected image config created and author", config)
+		}
+		if fmt.Sprint(config.Entrypoint) != "[/bin/hello]" || fmt.Sprint(config.Cmd) != "[--verbose]" {
+			t.Error("unexpected image config entrypoint and cmd", config)
+		}
+		if fmt.Sprint(config.ExposedPorts) != "[443/tcp 8080/tcp]" || config.HistoryLength != 2 {
+			t.Error("unexpected image config ports and history", config)
+		}
+	})
+
+	t.Run("not fetched", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests[manifestURL] = registrymock.Content{MediaType: "application/vnd.oci.image.manifest.v1+json", Body: ociManifestFixture}
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher}
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.PushedManifests) != 1 || (*db.PushedManifests)[0].Config != nil {
+			t.Error("expected manifest to be pushed without an image config")
+		}
+	})
+}
+
+func TestPendingEnrichments(t *testing.T) {
+	manifestURL := "http://my.registry.com/v2/hello/manifests/sha256:b00"
+	now := time.Now().UTC().Truncate(time.Second)
+	event := createEvent(t, fmt.Sprintf(
+		"{\"target\":{\"repository\":\"hello\", \"url\":\"%s\", \"digest\":\"sha256:b00\", \"mediaType\":\"application/vnd.oci.image.manifest.v1+json\"}, \"timestamp\":\"%s\"}",
+		manifestURL, now.Format(time.RFC3339)))
+
+	t.Run("push not fetched", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Err = errors.New("oops")
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher, retryInterval: time.Minute}
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.PushedManifests) != 1 || len(*db.SavedPendingEnrichments) != 1 {
+			t.Fatal("expected manifest to be pushed and its enrichment to be pending")
+		}
+		pending := (*db.SavedPendingEnrichments)[0]
+		if pending.Digest != "sha256:b00" || pending.URL != manifestURL || pending.Attempts != 1 || pending.LastError != "oops" {
+			t.Error("unexpected pending enrichment", pending)
+		}
+		if !pending.NextAttempt.After(now) {
+			t.Error("expected next attempt to be in the future", pending.NextAttempt)
+		}
+	})
+
+	t.Run("push fetched", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests[manifestURL] = registrymock.Content{MediaType: "application/vnd.oci.image.manifest.v1+json", Body: ociManifestFixture}
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher}
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.SavedPendingEnrichments) != 0 {
+			t.Error("expected no pending enrichment")
+		}
+		if len(*db.DeletedPendingEnrichments) != 1 || (*db.DeletedPendingEnrichments)[0] != "sha256:b00" {
+			t.Error("expected any pending enrichment to be deleted", *db.DeletedPendingEnrichments)
+		}
+	})
+
+	createPending := func() database.PendingEnrichment {
+		return database.PendingEnrichment{
+			Digest:      "sha256:b00",
+			Repository:  "hello",
+			MediaType:   "application/vnd.oci.image.manifest.v1+json",
+			URL:         manifestURL,
+			Pushed:      now.Add(-time.Hour),
+			Attempts:    2,
+			LastError:   "oops",
+			NextAttempt: now.Add(-time.Minute),
+		}
+	}
+
+	t.Run("retry succeeds", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		db.IsManifestRetValue = true
+		db.PendingEnrichmentsRetValue = []database.PendingEnrichment{createPending()}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests[manifestURL] = registrymock.Content{MediaType: "application/vnd.oci.image.manifest.v1+json", Body: ociManifestFixture}
+		wf := WorkflowImpl{db: db, fetcher: fetcher, retryInterval: time.Minute}
+		err := wf.retryEnrichments(nil)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.PushedManifests) != 1 || len((*db.PushedManifests)[0].Blobs) != 3 {
+			t.Fatal("expected manifest to be pushed with its blobs", *db.PushedManifests)
+		}
+		if !(*db.PushedManifests)[0].Pushed.Equal(now.Add(-time.Hour)) {
+			t.Error("expected original push time", (*db.PushedManifests)[0].Pushed)
+		}
+		if len(*db.DeletedPendingEnrichments) != 1 || len(*db.SavedPendingEnrichments) != 0 {
+			t.Error("expected pending enrichment to be deleted")
+		}
+	})
+
+	t.Run("retry schema2 manifest", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		db.IsManifestRetValue = true
+		pending := createPending()
+		pending.MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+		db.PendingEnrichmentsRetValue = []database.PendingEnrichment{pending}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests[manifestURL] = registrymock.Content{
+			MediaType: "application/vnd.docker.distribution.manifest.v2+json",
+			Body:      "{\"config\":{\"digest\": \"123456\"}, \"layers\":[{\"digest\": \"7890ab\"}]}",
+		}
+		wf := WorkflowImpl{db: db, fetcher: fetcher, retryInterval: time.Minute}
+		err := wf.retryEnrichments(nil)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.PushedManifests) != 1 || len((*db.PushedManifests)[0].Blobs) != 2 {
+			t.Fatal("expected manifest to be pushed with its blobs", *db.PushedManifests)
+		}
+		if (*db.PushedManifests)[0].Blobs[1].Digest != "7890ab" {
+			t.Error("unexpected layer", (*db.PushedManifests)[0].Blobs[1])
+		}
+		if len(*db.DeletedPendingEnrichments) != 1 || len(*db.SavedPendingEnrichments) != 0 {
+			t.Error("expected pending enrichment to be deleted")
+		}
+	})
+
+	t.Run("retry fails", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		db.IsManifestRetValue = true
+		db.PendingEnrichmentsRetValue = []database.PendingEnrichment{createPending()}
+		fetcher := registrymock.CreateFetcher()
+		wf := WorkflowImpl{db: db, fetcher: fetcher, retryInterval: time.Minute}
+		err := wf.retryEnrichments(nil)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.PushedManifests) != 0 || len(*db.DeletedPendingEnrichments) != 0 {
+			t.Error("expected manifest to be left as it is")
+		}
+		if len(*db.SavedPendingEnrichments) != 1 {
+			t.Fatal("expected pending enrichment to be saved")
+		}
+		pending := (*db.SavedPendingEnrichments)[0]
+		if pending.Attempts != 3 || !strings.Contains(pending.LastError, "404") {
+			t.Error("unexpected pending enrichment", pending)
+		}
+		if pending.NextAttempt.Sub(now) < 4*time.Minute {
+			t.Error("expected next attempt to back off", pending.NextAttempt)
+		}
+	})
+
+	t.Run("retry deleted manifest", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		db.PendingEnrichmentsRetValue = []database.PendingEnrichment{createPending()}
+		fetcher := registrymock.CreateFetcher()
+		wf := WorkflowImpl{db: db, fetcher: fetcher, retryInterval: time.Minute}
+		err := wf.retryEnrichments(nil)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.DeletedPendingEnrichments) != 1 || len(*db.SavedPendingEnrichments) != 0 {
+			t.Error("expected pending enrichment to be deleted")
+		}
+	})
+
+	t.Run("retry stopped", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		db.IsManifestRetValue = true
+		db.PendingEnrichmentsRetValue = []database.PendingEnrichment{createPending()}
+		wf := WorkflowImpl{db: db, fetcher: registrymock.CreateFetcher(), retryInterval: time.Minute}
+		quit := make(chan struct{})
+		close(quit)
+		err := wf.retryEnrichments(quit)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.DeletedPendingEnrichments) != 0 || len(*db.SavedPendingEnrichments) != 0 {
+			t.Error("expected pending enrichment to be left for another time")
+		}
+	})
+
+	t.Run("retry not due", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		pending := createPending()
+		pending.NextAttempt = now.Add(time.Hour)
+		db.PendingEnrichmentsRetValue = []database.PendingEnrichment{pending}
+		wf := WorkflowImpl{db: db, fetcher: registrymock.CreateFetcher(), retryInterval: time.Minute}
+		wf.retryEnrichments(nil)
+		if len(*db.DeletedPendingEnrichments) != 0 || len(*db.SavedPendingEnrichments) != 0 {
+			t.Error("expected pending enrichment not to be retried")
+		}
+	})
+}
+
+func TestEnrichmentBackoff(t *testing.T) {
+	for _, test := range []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{20, maxEnrichmentBackoff},
+		{1000, maxEnrichmentBackoff},
+	} {
+		backoff := enrichmentBackoff(time.Minute, test.attempts)
+		if backoff != test.backoff {
+			t.Errorf("expected %s after %d attempts; got %s", test.backoff, test.attempts, backoff)
+		}
+	}
+}
+
+const helmManifestFixture = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.oci.image.manifest.v1+json",
+  "config": {
+    "mediaType": "application/vnd.cncf.helm.config.v1+json",
+    "digest": "sha256:c4a7",
+    "size": 117
+  },
+  "layers": [
+    {
+      "mediaType": "application/vnd.cncf.helm.chart.content.v1.tar+gzip",
+      "digest": "sha256:7a7",
+      "size": 3456
+    }
+  ]
+}`
+
+const helmConfigFixture = `{"name": "hello", "version": "1.2.3", "appVersion": "4.5", "apiVersion": "v2"}`
+
+func TestArtifacts(t *testing.T) {
+	manifestURL := "http://my.registry.com/v2/hello/manifests/sha256:b00"
+
+	t.Run("helm chart", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests[manifestURL] = registrymock.Content{MediaType: "application/vnd.oci.image.manifest.v1+json", Body: helmManifestFixture}
+		fetcher.Blobs["http://my.registry.com/v2/hello/blobs/sha256:c4a7"] = helmConfigFixture
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher, artifacts: artifact.Default()}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"target\":{\"tag\":\"1.2.3\", \"url\":\"%s\", \"digest\":\"sha256:b00\", \"mediaType\":\"application/vnd.oci.image.manifest.v1+json\"}}",
+			manifestURL))
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.PushedManifests) != 1 || len(*db.PushedTags) != 1 {
+			t.Fatal("expected 1 manifest and 1 tag push")
+		}
+		manifest := (*db.PushedManifests)[0]
+		if manifest.ArtifactType != "application/vnd.cncf.helm.config.v1+json" || manifest.Config != nil || len(manifest.Blobs) != 2 {
+			t.Error("unexpected helm chart manifest", manifest)
+		}
+		expected := "[{application/vnd.cncf.helm.config.v1+json chart_name hello} " +
+			"{application/vnd.cncf.helm.config.v1+json chart_version 1.2.3} " +
+			"{application/vnd.cncf.helm.config.v1+json app_version 4.5} " +
+			"{application/vnd.cncf.helm.config.v1+json api_version v2}]"
+		if fmt.Sprint(manifest.Metadata) != expected {
+			t.Error("unexpected helm chart metadata", manifest.Metadata)
+		}
+	})
+
+	t.Run("handler error", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests[manifestURL] = registrymock.Content{MediaType: "application/vnd.oci.image.manifest.v1+json", Body: helmManifestFixture}
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher, artifacts: artifact.Default()}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"target\":{\"url\":\"%s\", \"digest\":\"sha256:b00\", \"mediaType\":\"application/vnd.oci.image.manifest.v1+json\"}}",
+			manifestURL))
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		manifest := (*db.PushedManifests)[0]
+		if manifest.Metadata != nil || len(manifest.Blobs) != 2 {
+			t.Error("expected helm chart to be pushed without metadata", manifest)
+		}
+	})
+
+	t.Run("referrer", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests[manifestURL] = registrymock.Content{
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Body: `{"mediaType": "application/vnd.oci.image.manifest.v1+json", ` +
+				`"artifactType": "application/vnd.cncf.notary.signature", ` +
+				`"config": {"mediaType": "application/vnd.oci.empty.v1+json", "digest": "sha256:44136f", "size": 2}, ` +
+				`"layers": [{"mediaType": "application/jose+json", "digest": "sha256:5197", "size": 2000}], ` +
+				`"subject": {"mediaType": "application/vnd.oci.image.manifest.v1+json", "digest": "sha256:1ma6e", "size": 1000}}`,
+		}
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher, artifacts: artifact.Default()}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"target\":{\"url\":\"%s\", \"digest\":\"sha256:b00\", \"mediaType\":\"application/vnd.oci.image.manifest.v1+json\"}}",
+			manifestURL))
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		manifest := (*db.PushedManifests)[0]
+		if manifest.Subject != "sha256:1ma6e" || manifest.ArtifactType != "application/vnd.cncf.notary.signature" || len(manifest.Blobs) != 2 {
+			t.Error("unexpected referrer manifest", manifest)
+		}
+	})
+
+	t.Run("referrer index", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests[manifestURL] = registrymock.Content{
+			MediaType: "application/vnd.oci.image.index.v1+json",
+			Body: `{"mediaType": "application/vnd.oci.image.index.v1+json", "manifests": [], ` +
+				`"subject": {"mediaType": "application/vnd.oci.image.index.v1+json", "digest": "sha256:1nd3x", "size": 1000}}`,
+		}
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"target\":{\"url\":\"%s\", \"digest\":\"sha256:b00\", \"mediaType\":\"application/vnd.oci.image.index.v1+json\"}}",
+			manifestURL))
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if manifest := (*db.PushedManifests)[0]; manifest.Subject != "sha256:1nd3x" {
+			t.Error("unexpected referrer index subject", manifest.Subject)
+		}
+	})
+
+	t.Run("unknown manifest", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		eqr := registry.EquivRegistries{}
+		fetcher := registrymock.CreateFetcher()
+		fetcher.Manifests[manifestURL] = registrymock.Content{
+			MediaType: "application/vnd.example.manifest.v1+json",
+			Body:      `{"layers": [{"mediaType": "application/vnd.example.data", "digest": "sha256:da7a", "size": 42}]}`,
+		}
+		wf := WorkflowImpl{db: db, eqr: &eqr, fetcher: fetcher, artifacts: artifact.Default()}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"target\":{\"tag\":\"hoo\", \"url\":\"%s\", \"digest\":\"sha256:b00\", \"mediaType\":\"application/vnd.example.manifest.v1+json\"}}",
+			manifestURL))
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.PushedManifests) != 1 || len(*db.PushedTags) != 1 {
+			t.Fatal("expected 1 manifest and 1 tag push")
+		}
+		blobs := (*db.PushedManifests)[0].Blobs
+		if len(blobs) != 1 || blobs[0].Digest != "sha256:da7a" || blobs[0].MediaType != "application/vnd.example.data" || blobs[0].Role != "" {
+			t.Error("unexpected blobs of unknown manifest", blobs)
+		}
+	})
+
+	t.Run("unknown blob", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		wf := WorkflowImpl{db: db}
+		event := createEvent(t, "{\"target\":{\"url\":\"http://my.registry.com/v2/hello/blobs/sha256:da7a\", "+
+			"\"digest\":\"sha256:da7a\", \"mediaType\":\"application/vnd.example.data\"}}")
+		err := wf.processPush(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.PushedBlobs) != 1 || (*db.PushedBlobs)[0].MediaType != "application/vnd.example.data" || (*db.PushedBlobs)[0].Role != "" {
+			t.Error("expected blob of unknown media type to be pushed without a role")
+		}
+	})
+}
+
+func TestBlobMediaTypes(t *testing.T) {
+	mediaTypes := &registry.MediaTypes{Roles: map[string]string{"application/vnd.example.layer.v1.tar+lz4": "layer"}}
+	tests := []struct {
+		mediaType     string
+		blobMediaType string
+		role          string
+	}{
+		{"application/octet-stream", "", ""},
+		{"application/vnd.docker.image.rootfs.diff.tar.gzip", "application/vnd.docker.image.rootfs.diff.tar.gzip", "layer"},
+		{"application/vnd.oci.image.layer.v1.tar", "application/vnd.oci.image.layer.v1.tar", "layer"},
+		{"application/vnd.oci.image.layer.v1.tar+zstd", "application/vnd.oci.image.layer.v1.tar+zstd", "layer"},
+		{"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip", "foreign"},
+		{"application/vnd.oci.image.layer.nondistributable.v1.tar+gzip", "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip", "foreign"},
+		{"application/vnd.docker.container.image.v1+json", "application/vnd.docker.container.image.v1+json", "config"},
+		{"application/vnd.example.layer.v1.tar+lz4", "application/vnd.example.layer.v1.tar+lz4", "layer"},
+	}
+	for _, test := range tests {
+		t.Run(test.mediaType, func(t *testing.T) {
+			db := mock.CreateDatabase()
+			wf := WorkflowImpl{db: db, mediaTypes: mediaTypes}
+			event := createEvent(t, fmt.Sprintf("{\"target\":{\"digest\":\"boo\", \"mediaType\":\"%s\"}}", test.mediaType))
+			wf.processPush(event)
+			wf.processPull(event)
+			if len(*db.PushedBlobs) != 1 || len(*db.PulledBlobs) != 1 {
+				t.Fatal("expected 1 blob push and 1 blob pull")
+			}
+			for _, blob := range []*database.Blob{(*db.PushedBlobs)[0], (*db.PulledBlobs)[0]} {
+				if blob.MediaType != test.blobMediaType || blob.Role != test.role {
+					t.Errorf("expected %q, %q; got %q, %q", test.blobMediaType, test.role, blob.MediaType, blob.Role)
+				}
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		wf := WorkflowImpl{db: db}
+		event := createEvent(t, "{\"target\":{\"digest\":\"boo\", \"mediaType\":\"text/plain\"}}")
+		wf.processPush(event)
+		wf.processPull(event)
+		if len(*db.PushedBlobs) != 0 || len(*db.PulledBlobs) != 0 {
+			t.Error("expected no blob pushes or pulls")
+		}
+	})
+}
+
+func TestProcessMount(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	nowStr := now.Format("2006-01-02T15:04:05Z07:00")
+
+	t.Run("blob", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		wf := WorkflowImpl{db: db}
+		event := createEvent(t, fmt.Sprintf(
+			"{\"action\":\"mount\", \"target\":{\"digest\":\"boo\", \"size\":1234, \"mediaType\":\"application/vnd.docker.image.rootfs.diff.tar.gzip\", \"repository\":\"to\", \"fromRepository\":\"from\"}, \"timestamp\":\"%s\"}",
+			nowStr))
+		err := wf.processMount(event)
+		if err != nil {
+			t.Fatalf("expected nil err; got %s", err)
+		}
+		if len(*db.MountedBlobs) != 1 || len(*db.PushedBlobs) != 0 {
+			t.Fatal("expected 1 blob mount only")
+		}
+		mount := (*db.MountedBlobs)[0]
+		if mount.Blob.Digest != "boo" || mount.Blob.Size != 1234 || !now.Equal(mount.Blob.Pushed) {
+			t.Error("unexpected mounted blob", mount.Blob)
+		}
+		if mount.Repository != "to" || mount.FromRepository != "from" {
+			t.Error("unexpected mount repositories", mount)
+		}
+	})
+
+	t.Run("database error", func(t *testing.T) {
+		db := mock.CreateDatabase()
+		db.Err = errors.New("oops")
+		wf := WorkflowImpl{db: db}
+		event := createEvent(t, "{\"action\":\"mount\", \"target\":{\"digest\":\"boo\", \"repository\":\"to\", \"fromRepository\":\"from\"}}")
+		err := wf.processMount(event)
+		if err == nil || err.Error() != "oops" {
+			t.Fatalf("expected oops; got %v", err)
+		}
+	})
+}
+
+func TestAuditEvent(t *testing.T) {
+	db := mock.CreateDatabase()
+	eqr := registry.EquivRegistries{}
+	wf := WorkflowImpl{db: db, eqr: &eqr}
+	event := createEvent(t, "{\"id\":\"event1\", \"action\":\"delete\", "+
+		"\"target\":{\"repository\":\"hello\", \"tag\":\"hoo\"}, "+
+		"\"request\":{\"id\":\"req1\", \"addr\":\"10.0.0.1:1234\", \"host\":\"my.registry.com\", \"method\":\"DELETE\", \"useragent\":\"curl/7.0\"}, "+
+		"\"actor\":{\"name\":\"joe\"}, "+
+		"\"source\":{\"addr\":\"registry-1:5000\", \"instanceID\":\"instance1\"}}")
+	err := wf.processDelete(event)
+	if err != nil {
+		t.Fatalf("expected nil err; got %s", err)
+	}
+	if len(*db.RecordedEvents) != 1 {
+		t.Fatal("expected 1 audit event", len(*db.RecordedEvents))
+	}
+	audit := (*db.RecordedEvents)[0]
+	if audit.ID != "event1" || audit.Action != "delete" || audit.Registry != "my.registry.com" ||
+		audit.Repository != "hello" || audit.Tag != "hoo" {
+		t.Error("unexpected audit event target", audit)
+	}
+	if audit.Actor != "joe" || audit.RequestID != "req1" || audit.RequestAddr != "10.0.0.1:1234" ||
+		audit.RequestMethod != "DELETE" || audit.RequestUserAgent != "curl/7.0" {
+		t.Error("unexpected audit event request", audit)
+	}
+	if audit.SourceInstanceID != "instance1" || audit.SourceAddr != "registry-1:5000" {
+		t.Error("unexpected audit event source", audit)
+	}
 }